@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var roleObjectType = "role"               // role~enrollmentID -> roles of the identity
+var enrollmentIDAttribute = "enrollmentId" // certificate attribute holding the caller's enrollment ID
+
+// Roles that can be given to an enrollment ID
+// Customers, chargers and sellers act under their own ID: customer ID, charger ID or seller's customer ID
+var roleAdmin = "admin"
+var roleCharger = "charger"
+var roleSeller = "seller"
+var roleCustomer = "customer"
+
+// Permission of an invoke function
+// Roles lists the roles allowed to call it, actor returns the ID the caller must have, if any
+type permission struct {
+	roles	[]string
+	actor	func(stub shim.ChaincodeStubInterface, args []string) (string, error)
+}
+
+// Permissions of every invoke function, checked by Invoke before dispatch
+// Functions missing from this map cannot be invoked by anyone
+var invokePermissions = map[string]permission{
+	"addOfferQuantity":			{[]string{roleSeller}, sellerActor},
+	"subtractOfferQuantity":	{[]string{roleSeller}, sellerActor},
+	"addCustomer":				{[]string{roleAdmin}, nil},
+	"addCustomerFunds":			{[]string{roleAdmin}, nil},
+	"addCharger":				{[]string{roleAdmin}, nil},
+	"acceptOffer":				{[]string{roleCustomer}, argActor(1)},
+	"completeTransaction":		{[]string{roleCharger}, argActor(0)},
+	"cancelTransaction":		{[]string{roleCharger}, argActor(0)},
+	"addTransaction":			{[]string{roleAdmin}, nil},
+	"placeBid":					{[]string{roleCustomer}, argActor(1)},
+	"cancelBid":				{[]string{roleCustomer}, bidActor},
+	"migrateState":				{[]string{roleAdmin}, nil},
+	"addRole":					{[]string{roleAdmin}, nil},
+	"removeRole":				{[]string{roleAdmin}, nil},
+	"setPendingTimeout":		{[]string{roleAdmin}, nil},
+	"expirePendingTransactions":	{allRoles(), nil},
+	"setIdempotencyWindow":		{[]string{roleAdmin}, nil},
+	"purgeIdempotencyKeys":		{[]string{roleAdmin}, nil},
+	"setLimits":				{[]string{roleAdmin}, nil},
+	"purgeSyntheticTransactions":	{[]string{roleAdmin}, nil},
+	"withdrawFunds":			{[]string{roleCustomer, roleSeller}, argActor(0)},
+	"transferFunds":			{[]string{roleCustomer}, argActor(0)},
+	"confirmPayout":			{[]string{roleAdmin}, nil},
+	"rejectPayout":				{[]string{roleAdmin}, nil},
+	"batch":					{allRoles(), nil},
+	"init":						{[]string{roleAdmin}, nil},
+}
+
+type QueryResponseRoles struct {
+	Success	bool		`json:"success"`
+	Data	[]string	`json:"data"`
+}
+
+//////////////////////////////////////// QUERY FUNCTIONS ////////////////////////////////////////
+
+// Get the roles of an enrollment ID
+func getRoles(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	// Convert enrollment ID argument to lowercase
+	enrollmentID := strings.ToLower(args[0])
+	fmt.Println("Trying to get the roles of " + enrollmentID)
+
+	// Get the roles from the chaincode state
+	roles, err := getEnrollmentRoles(stub, enrollmentID)
+	if err != nil {
+		return createQueryError(codeStateError, "Failed to get roles")
+	}
+
+	return createQueryResponseRoles(true, roles)
+
+}
+
+//////////////////////////////////////// INVOKE FUNCTIONS ////////////////////////////////////////
+
+// Give a role to an enrollment ID
+func addRole(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	var retStr string
+
+	enrollmentID := strings.ToLower(args[0])
+	role := strings.ToLower(args[1])
+
+	// Debug message
+	fmt.Println("Trying to give role " + role + " to " + enrollmentID)
+
+	err := grantRole(stub, enrollmentID, role)
+	if err != nil {
+		retStr = "Could not write roles of " + enrollmentID + " to chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+	roles, err := getEnrollmentRoles(stub, enrollmentID)
+	if err != nil {
+		retStr = "Could not get roles of " + enrollmentID + " from chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+
+	// Successful return
+	retStr = "Successfully gave role " + role + " to " + enrollmentID
+	return createInvokeResponse(retStr, roles)
+
+}
+
+// Take a role away from an enrollment ID
+func removeRole(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	var retStr string
+
+	enrollmentID := strings.ToLower(args[0])
+	role := strings.ToLower(args[1])
+
+	// Debug message
+	fmt.Println("Trying to take role " + role + " from " + enrollmentID)
+
+	roles, err := getEnrollmentRoles(stub, enrollmentID)
+	if err != nil {
+		retStr = "Could not get roles of " + enrollmentID + " from chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+	remaining := []string{}
+	for _, r := range roles {
+		if r != role {
+			remaining = append(remaining, r)
+		}
+	}
+	if len(remaining) == len(roles) {
+		retStr = enrollmentID + " does not have role " + role
+		return createInvokeErrorDetails(codeRoleNotGranted, retStr, ErrorDetails{"enrollmentid": enrollmentID, "role": role})
+	}
+
+	// An admin cannot remove the last admin, nobody could manage roles anymore
+	if role == roleAdmin {
+		admins := 0
+		err = getStateByPartialCompositeKey(stub, roleObjectType, []string{}, func(key string, valAsBytes []byte) error {
+			var r []string
+			json.Unmarshal(valAsBytes, &r)
+			if hasRole(r, roleAdmin) {
+				admins++
+			}
+			return nil
+		})
+		if err != nil {
+			retStr = "Could not get roles from chaincode state"
+			return createInvokeError(codeStateError, retStr)
+		}
+		if admins <= 1 {
+			retStr = "Cannot remove the last admin"
+			return createInvokeErrorDetails(codeLastAdmin, retStr, ErrorDetails{"enrollmentid": enrollmentID})
+		}
+	}
+
+	err = putEnrollmentRoles(stub, enrollmentID, remaining)
+	if err != nil {
+		retStr = "Could not write roles of " + enrollmentID + " to chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+
+	// Successful return
+	retStr = "Successfully took role " + role + " from " + enrollmentID
+	return createInvokeResponse(retStr, remaining)
+
+}
+
+//////////////////////////////////////// UTILITY FUNCTIONS ////////////////////////////////////////
+
+// Check that the caller may invoke a function with these arguments
+// The caller needs one of the function's roles and, if the function acts for someone, must be that someone
+func checkInvokePermission(stub shim.ChaincodeStubInterface, function string, args []string) (error) {
+
+	p, ok := invokePermissions[function]
+	if !ok {
+		return newChaincodeError(codeNotAllowed, "No permissions are defined for function " + function, ErrorDetails{"function": function})
+	}
+
+	callerID, err := getCallerID(stub)
+	if err != nil {
+		return err
+	}
+	roles, err := getEnrollmentRoles(stub, callerID)
+	if err != nil {
+		return errors.New("Could not get roles of " + callerID + " from chaincode state")
+	}
+
+	allowed := false
+	for _, role := range p.roles {
+		if hasRole(roles, role) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return newChaincodeError(codeNotAllowed, callerID + " is not allowed to call " + function + ": requires role " + strings.Join(p.roles, " or "), ErrorDetails{"caller": callerID, "function": function, "roles": p.roles})
+	}
+
+	if p.actor != nil {
+		actorID, err := p.actor(stub, args)
+		if err != nil {
+			return err
+		}
+		// An empty actor means the arguments are invalid, the function itself will reject them
+		if len(actorID) > 0 && actorID != callerID {
+			return newChaincodeError(codeNotAllowed, callerID + " is not allowed to call " + function + " for " + actorID, ErrorDetails{"caller": callerID, "function": function, "actor": actorID})
+		}
+	}
+	return nil
+
+}
+
+// Get the enrollment ID of the caller from its certificate
+func getCallerID(stub shim.ChaincodeStubInterface) (string, error) {
+
+	callerIDBytes, err := stub.ReadCertAttribute(enrollmentIDAttribute)
+	if err != nil {
+		return "", newChaincodeError(codeNotAllowed, "Could not read attribute " + enrollmentIDAttribute + " of the caller's certificate", nil)
+	}
+	if len(callerIDBytes) == 0 {
+		return "", newChaincodeError(codeNotAllowed, "Caller's certificate has no " + enrollmentIDAttribute + " attribute", nil)
+	}
+	return strings.ToLower(string(callerIDBytes)), nil
+
+}
+
+// The caller must be the ID in one of the arguments
+func argActor(i int) (func(stub shim.ChaincodeStubInterface, args []string) (string, error)) {
+	return func(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+		if len(args) <= i {
+			return "", nil
+		}
+		return strings.ToLower(args[i]), nil
+	}
+}
+
+// The caller must be the seller, which defaults to the owner of the charger
+func sellerActor(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	if len(args) == 4 && len(args[3]) > 0 {
+		return strings.ToLower(args[3]), nil
+	}
+	if len(args) == 0 {
+		return "", nil
+	}
+	charger, err := getCharger(stub, strings.ToLower(args[0]))
+	if err != nil {
+		return "", nil
+	}
+	return charger.Owner, nil
+}
+
+// The caller must be the buyer of the bid
+func bidActor(stub shim.ChaincodeStubInterface, args []string) (string, error) {
+	var bid Bid
+	if len(args) != 2 {
+		return "", nil
+	}
+	bidID, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return "", nil
+	}
+	bidBytes, err := stub.GetState(createCompositeKey(bidObjectType, strings.ToLower(args[0]), fmt.Sprintf("%020d", bidID)))
+	if err != nil {
+		return "", errors.New("Could not get bid " + args[1] + " from chaincode state")
+	}
+	if len(bidBytes) == 0 {
+		return "", nil
+	}
+	json.Unmarshal(bidBytes, &bid)
+	return bid.Buyer, nil
+}
+
+// Get the roles of an enrollment ID, none if it has no key
+func getEnrollmentRoles(stub shim.ChaincodeStubInterface, enrollmentID string) ([]string, error) {
+
+	var roles []string
+
+	rolesBytes, err := stub.GetState(createCompositeKey(roleObjectType, enrollmentID))
+	if err != nil {
+		return nil, err
+	}
+	json.Unmarshal(rolesBytes, &roles)
+	return roles, nil
+
+}
+
+// Write the roles of an enrollment ID, the key is deleted if there are none
+func putEnrollmentRoles(stub shim.ChaincodeStubInterface, enrollmentID string, roles []string) (error) {
+	if len(roles) == 0 {
+		return stub.DelState(createCompositeKey(roleObjectType, enrollmentID))
+	}
+	return marshalAndPut(stub, createCompositeKey(roleObjectType, enrollmentID), roles)
+}
+
+// Give a role to an enrollment ID if it does not have it yet
+func grantRole(stub shim.ChaincodeStubInterface, enrollmentID string, role string) (error) {
+
+	roles, err := getEnrollmentRoles(stub, enrollmentID)
+	if err != nil {
+		return err
+	}
+	if hasRole(roles, role) {
+		return nil
+	}
+	return putEnrollmentRoles(stub, enrollmentID, append(roles, role))
+
+}
+
+func hasRole(roles []string, role string) (bool) {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+func allRoles() ([]string) {
+	return []string{roleAdmin, roleCharger, roleSeller, roleCustomer}
+}
+
+func createQueryResponseRoles(success bool, data []string) ([]byte, error) {
+	var response QueryResponseRoles
+	response.Success = success
+	response.Data = data
+	r, _ := json.Marshal(response)
+	return r, nil
+}
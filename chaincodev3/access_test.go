@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestEveryInvokeFunctionHasPermissions(t *testing.T) {
+	s := newMarket(t)
+	for function := range invokePermissions {
+		// Strangers never get past the permission check
+		expectError(t, s.mustFail(t, "stranger", function), "stranger is not allowed to call " + function)
+	}
+	if message := s.mustFailWith(t, codeNotAllowed, "", "addCustomer", "ross"); message != "Could not read attribute enrollmentId of the caller's certificate" {
+		t.Fatalf("invoke without a caller: %s", message)
+	}
+}
+
+func TestAddRole(t *testing.T) {
+	s := newMarket(t)
+
+	s.mustInvoke(t, "admin", "addRole", "Ross", "Seller")
+	s.mustInvoke(t, "admin", "addRole", "ross", "admin")
+	s.mustInvoke(t, "admin", "addRole", "ross", "seller")
+	var roles []string
+	s.query(t, &roles, "getRoles", "ROSS")
+	if len(roles) != 2 || roles[0] != roleSeller || roles[1] != roleAdmin {
+		t.Fatalf("roles of ross = %v", roles)
+	}
+
+	// ross can now manage customers
+	s.mustInvoke(t, "ross", "addCustomer", "joey")
+
+	expectError(t, s.mustFail(t, "admin", "addRole", "ross"), "Expecting 2")
+	expectError(t, s.mustFail(t, "admin", "addRole", "", "seller"), "First argument (enrollment ID) cannot be an empty string")
+	expectError(t, s.mustFail(t, "admin", "addRole", "ross", "king"), "Second argument (role) must be one of \"admin\", \"charger\", \"seller\", \"customer\"")
+	expectError(t, s.mustFail(t, "james", "addRole", "james", "admin"), "james is not allowed to call addRole: requires role admin")
+
+	expectError(t, s.queryFails(t, "getRoles"), "Expecting 1")
+	expectError(t, s.queryFails(t, "getRoles", ""), "cannot be an empty string")
+}
+
+func TestRemoveRole(t *testing.T) {
+	s := newMarket(t)
+
+	s.mustInvoke(t, "admin", "removeRole", "sam", "seller")
+	expectError(t, s.mustFail(t, "sam", "addOfferQuantity", "charger1", "5", "10"), "sam is not allowed to call addOfferQuantity: requires role seller")
+	s.mustInvoke(t, "admin", "removeRole", "sam", "customer")
+	if _, ok := s.state[createCompositeKey(roleObjectType, "sam")]; ok {
+		t.Fatal("key of an ID without roles was not removed")
+	}
+
+	expectError(t, s.mustFail(t, "admin", "removeRole", "sam", "customer"), "sam does not have role customer")
+	expectError(t, s.mustFail(t, "admin", "removeRole", "sam"), "Expecting 2")
+	expectError(t, s.mustFail(t, "admin", "removeRole", "", "customer"), "First argument (enrollment ID) cannot be an empty string")
+	expectError(t, s.mustFail(t, "james", "removeRole", "james", "customer"), "requires role admin")
+
+	// The last admin stays
+	expectError(t, s.mustFail(t, "admin", "removeRole", "admin", "admin"), "Cannot remove the last admin")
+	s.mustInvoke(t, "admin", "addRole", "ross", "admin")
+	s.mustInvoke(t, "ross", "removeRole", "admin", "admin")
+	expectError(t, s.mustFail(t, "ross", "removeRole", "ross", "admin"), "Cannot remove the last admin")
+	expectError(t, s.mustFail(t, "admin", "addCustomer", "joey"), "admin is not allowed to call addCustomer")
+}
+
+func TestActors(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "admin", "addCharger", "charger2", "james")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+	s.mustInvoke(t, "james", "addOfferQuantity", "charger2", "5", "100")
+
+	// Sellers act for the owner by default and for themselves otherwise
+	expectError(t, s.mustFail(t, "james", "addOfferQuantity", "charger1", "5", "10"), "james is not allowed to call addOfferQuantity for sam")
+	s.mustInvoke(t, "james", "addOfferQuantity", "charger1", "5", "10", "james")
+	expectError(t, s.mustFail(t, "sam", "subtractOfferQuantity", "charger1", "5", "10", "james"), "sam is not allowed to call subtractOfferQuantity for james")
+
+	// Chargers only settle their own transactions
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "10")
+	expectError(t, s.mustFail(t, "charger2", "cancelTransaction", "charger1", "10"), "charger2 is not allowed to call cancelTransaction for charger1")
+	s.mustInvoke(t, "charger1", "cancelTransaction", "Charger1", "10")
+
+	// Invalid arguments are left to the function
+	expectError(t, s.mustFail(t, "sam", "addOfferQuantity", "charger9", "5", "10"), "Charger charger9 does not exist")
+	expectError(t, s.mustFail(t, "james", "cancelBid", "charger1", "x"), "Second argument (bid ID) must be an integer string")
+}
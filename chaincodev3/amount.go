@@ -0,0 +1,150 @@
+package main
+
+import (
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Decimal places of every amount of money or energy: balances, costs, prices per unit and units of energy
+var amountScale = 4
+var amountOne Amount = 10000 // 10^amountScale, the amount 1
+
+// Fixed-point decimal amount, counted in 10^-amountScale
+// In JSON an amount is a number with up to amountScale decimal places, so whole amounts look like the ints used before
+type Amount int64
+
+// Amount of a whole number
+func wholeAmount(n int64) (Amount) {
+	return Amount(n) * amountOne
+}
+
+// Parse a decimal string such as "12", "-3.5" or "0.0025"
+func parseAmount(s string) (Amount, error) {
+
+	digits := s
+	negative := strings.HasPrefix(digits, "-")
+	if negative {
+		digits = digits[1:]
+	}
+	whole, fraction := digits, ""
+	if i := strings.Index(digits, "."); i >= 0 {
+		whole, fraction = digits[:i], digits[i+1:]
+		if len(fraction) == 0 {
+			return 0, newChaincodeError(codeBadArgument, "Amount " + s + " has no digits after the decimal point", nil)
+		}
+		// Trailing zeros don't count as decimal places
+		fraction = strings.TrimRight(fraction, "0")
+	}
+	if len(whole) == 0 || len(fraction) > amountScale || strings.IndexFunc(whole + fraction, func(r rune) bool { return r < '0' || r > '9' }) >= 0 {
+		return 0, newChaincodeError(codeBadArgument, "Amount " + s + " is not a decimal number with at most " + strconv.Itoa(amountScale) + " decimal places", nil)
+	}
+
+	// Read the digits as a count of 10^-amountScale
+	units, err := strconv.ParseInt(whole + fraction + strings.Repeat("0", amountScale - len(fraction)), 10, 64)
+	if err != nil {
+		return 0, newChaincodeError(codeAmountOverflow, "Amount " + s + " is too large", nil)
+	}
+	if negative {
+		units = -units
+	}
+	return Amount(units), nil
+
+}
+
+// Decimal string of the amount without trailing zeros, the form used in offer IDs
+func (a Amount) String() string {
+	sign := ""
+	units := uint64(a)
+	if a < 0 {
+		sign = "-"
+		units = uint64(-a)
+	}
+	whole := strconv.FormatUint(units / uint64(amountOne), 10)
+	fraction := strconv.FormatUint(units % uint64(amountOne), 10)
+	if fraction == "0" {
+		return sign + whole
+	}
+	fraction = strings.TrimRight(strings.Repeat("0", amountScale - len(fraction)) + fraction, "0")
+	return sign + whole + "." + fraction
+}
+
+func (a Amount) MarshalJSON() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+// Amounts are read from JSON numbers or decimal strings
+func (a *Amount) UnmarshalJSON(data []byte) (error) {
+	s := strings.Trim(string(data), "\"")
+	if s == "null" {
+		return nil
+	}
+	amount, err := parseAmount(s)
+	if err != nil {
+		return err
+	}
+	*a = amount
+	return nil
+}
+
+// Sorts amounts in ascending order
+type amountsAscending []Amount
+
+func (a amountsAscending) Len() int {
+	return len(a)
+}
+
+func (a amountsAscending) Swap(i, j int) {
+	a[i], a[j] = a[j], a[i]
+}
+
+func (a amountsAscending) Less(i, j int) bool {
+	return a[i] < a[j]
+}
+
+//////////////////////////////////////// CHECKED ARITHMETIC ////////////////////////////////////////
+
+// Sum of two amounts, an error instead of wrapping around
+func addAmounts(a Amount, b Amount) (Amount, error) {
+	if (b > 0 && a > math.MaxInt64 - b) || (b < 0 && a < math.MinInt64 - b) {
+		return 0, amountOverflow(a.String() + " + " + b.String())
+	}
+	return a + b, nil
+}
+
+// Difference of two amounts, an error instead of wrapping around
+func subtractAmounts(a Amount, b Amount) (Amount, error) {
+	if (b < 0 && a > math.MaxInt64 + b) || (b > 0 && a < math.MinInt64 + b) {
+		return 0, amountOverflow(a.String() + " - " + b.String())
+	}
+	return a - b, nil
+}
+
+// Product of two amounts, such as units of energy and a price per unit
+// Rounded away from zero to amountScale decimal places, so a product that isn't zero never rounds to zero
+// and a buyer never pays less than the exact price of what they get
+func multiplyAmounts(a Amount, b Amount) (Amount, error) {
+
+	product := new(big.Int).Mul(big.NewInt(int64(a)), big.NewInt(int64(b)))
+	one := big.NewInt(int64(amountOne))
+	quotient, remainder := new(big.Int).QuoRem(product, one, new(big.Int))
+
+	// Any dropped decimal place rounds up
+	if remainder.Sign() != 0 {
+		if product.Sign() < 0 {
+			quotient.Sub(quotient, big.NewInt(1))
+		} else {
+			quotient.Add(quotient, big.NewInt(1))
+		}
+	}
+	if quotient.BitLen() > 63 {
+		return 0, amountOverflow(a.String() + " * " + b.String())
+	}
+	return Amount(quotient.Int64()), nil
+
+}
+
+func amountOverflow(operation string) (error) {
+	return newChaincodeError(codeAmountOverflow, "Amount overflow: " + operation + " is out of range", ErrorDetails{"operation": operation})
+}
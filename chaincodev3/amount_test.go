@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseAmount(t *testing.T) {
+	for s, want := range map[string]Amount{
+		"12": 120000,
+		"-3.5": -35000,
+		"0.0025": 25,
+		"007.10": 71000,
+		"1.500000": 15000,
+		"922337203685477.5807": 9223372036854775807,
+	} {
+		if got, err := parseAmount(s); err != nil || got != want {
+			t.Fatalf("parseAmount(%q) = %d, %v, want %d", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "-", ".5", "1.", "1.23456", "1,5", "1e3", "+1", "ten"} {
+		if _, err := parseAmount(s); errorCode(err) != codeBadArgument {
+			t.Fatalf("parseAmount(%q) returned %v, want %s", s, err, codeBadArgument)
+		}
+	}
+	if _, err := parseAmount("922337203685477.5808"); errorCode(err) != codeAmountOverflow {
+		t.Fatalf("parseAmount of a too large amount returned %v", err)
+	}
+
+	for a, want := range map[Amount]string{0: "0", 25: "0.0025", -35000: "-3.5", 71000: "7.1", wholeAmount(12): "12"} {
+		if a.String() != want {
+			t.Fatalf("%d formats as %s, want %s", int64(a), a, want)
+		}
+	}
+}
+
+func TestAmountJSON(t *testing.T) {
+	var balances map[string]Amount
+	err := json.Unmarshal([]byte(`{"sam": 7, "james": 1.25, "ross": "0.5"}`), &balances)
+	if err != nil || balances["sam"] != wholeAmount(7) || balances["james"] != 12500 || balances["ross"] != 5000 {
+		t.Fatalf("decoded %v, %v", balances, err)
+	}
+	bytes, _ := json.Marshal(balances)
+	if string(bytes) != `{"james":1.25,"ross":0.5,"sam":7}` {
+		t.Fatalf("encoded %s", bytes)
+	}
+	if json.Unmarshal([]byte(`{"sam": 0.00001}`), &balances) == nil {
+		t.Fatal("decoded an amount with too many decimal places")
+	}
+}
+
+func TestAmountArithmetic(t *testing.T) {
+	max := Amount(9223372036854775807)
+
+	// Products are rounded up to the scale, away from zero
+	for _, c := range []struct{ a, b, want string }{
+		{"3", "1.25", "3.75"},
+		{"0.5", "0.3333", "0.1667"},
+		{"0.25", "0.3333", "0.0834"},
+		{"-0.5", "0.3333", "-0.1667"},
+		{"0.0001", "0.4999", "0.0001"},
+		{"100000000", "9223.372", "922337200000"},
+	} {
+		a, _ := parseAmount(c.a)
+		b, _ := parseAmount(c.b)
+		if got, err := multiplyAmounts(a, b); err != nil || got.String() != c.want {
+			t.Fatalf("%s * %s = %s, %v, want %s", c.a, c.b, got, err, c.want)
+		}
+	}
+
+	_, err := multiplyAmounts(max, wholeAmount(2))
+	if errorCode(err) != codeAmountOverflow || errorDetails(err)["operation"] != "922337203685477.5807 * 2" {
+		t.Fatalf("multiplying past the largest amount returned %v", err)
+	}
+	if _, err = addAmounts(max, 1); errorCode(err) != codeAmountOverflow {
+		t.Fatalf("adding past the largest amount returned %v", err)
+	}
+	if _, err = subtractAmounts(-max, 2); errorCode(err) != codeAmountOverflow {
+		t.Fatalf("subtracting past the smallest amount returned %v", err)
+	}
+	if sum, err := addAmounts(max, -max); err != nil || sum != 0 {
+		t.Fatalf("max - max = %s, %v", sum, err)
+	}
+}
+
+func TestFractionalTrading(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "admin", "addCustomer", "ross")
+	s.mustInvoke(t, "admin", "addRole", "ross", "seller")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "0.3333", "0.5")
+	s.mustInvoke(t, "ross", "addOfferQuantity", "charger1", "0.33330", "0.5", "ross")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "1.25", "10")
+
+	// Prices are the same offer however many trailing zeros they are written with
+	var tiers map[string]map[string]Amount
+	s.query(t, &tiers, "getOfferTiers", "charger1")
+	if len(tiers) != 2 || len(tiers["0.3333"]) != 2 {
+		t.Fatalf("offer tiers = %v", tiers)
+	}
+
+	// Every seller is paid for their own units: 0.5 * 0.3333 rounds to 0.1667 for both
+	var tx Transaction
+	s.invokeData(t, &tx, "james", "acceptOffer", "charger1", "james", "2.5")
+	if tx.Energy.String() != "2.5" || tx.Cost.String() != "2.2084" {
+		t.Fatalf("bought %s for %s, want 2.5 for 2.2084", tx.Energy, tx.Cost)
+	}
+
+	// The refund takes 1.5 units at 1.25 and 0.25 of sam's units at 0.3333 back
+	// The cost left is what the sellers keep for the rest: 0.0834 to sam and 0.1667 to ross
+	// The status shows the refund as an amount, not as it was passed
+	s.invokeData(t, &tx, "charger1", "cancelTransaction", "charger1", "01.750")
+	if tx.Energy.String() != "0.75" || tx.Cost.String() != "0.2501" || tx.Status != "Refunded 1.75" {
+		t.Fatalf("refunded transaction has %s for %s with status %q, want 0.75 for 0.2501", tx.Energy, tx.Cost, tx.Status)
+	}
+	var data TransactionCancelledEvent
+	json.Unmarshal(s.lastEvent(t, eventTransactionCancelled).Events[0].Data, &data)
+	if data.UnitsRefunded.String() != "1.75" || data.AmountRefunded.String() != "1.9583" {
+		t.Fatalf("transactionCancelled event = %+v", data)
+	}
+
+	// No money was made or lost by rounding
+	var balances map[string]Amount
+	s.query(t, &balances, "getCustomers")
+	if balances["james"].String() != "9999.7499" || balances["sam"].String() != "0.0834" || balances["ross"].String() != "0.1667" {
+		t.Fatalf("customers = %v", balances)
+	}
+	s.query(t, &tiers, "getOfferTiers", "charger1")
+	if len(tiers) != 2 || tiers["0.3333"]["sam"].String() != "0.25" || tiers["1.25"]["sam"].String() != "10" {
+		t.Fatalf("offer tiers = %v", tiers)
+	}
+
+	var balance Amount
+	s.query(t, &balance, "getCustomer", "james")
+	if balance.String() != "9999.7499" {
+		t.Fatalf("getCustomer returned %s", balance)
+	}
+	s.mustFailWith(t, codeBadArgument, "james", "acceptOffer", "charger1", "james", "0.00001")
+
+	// The smallest purchase still costs something
+	s = newMarket(t)
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "0.4999", "1")
+	s.invokeData(t, &tx, "james", "acceptOffer", "charger1", "james", "0.0001")
+	if tx.Cost.String() != "0.0001" {
+		t.Fatalf("bought 0.0001 at 0.4999 for %s, want 0.0001", tx.Cost)
+	}
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Checks made by auditLedger, as reported in the check of a discrepancy
+var auditLegacyState = "legacyState"         // key, a monolithic blob or offer that migrateState has not split yet, or a charger whose supply it has not recorded
+var auditUnknownCustomer = "unknownCustomer" // customer, the ledger entry, transaction, offer or payout that refers to it
+var auditUnknownCharger = "unknownCharger"   // charger, the transaction, pending transaction or offer that refers to it
+var auditLedgerChain = "ledgerChain"         // customer, entryid, expected, actual
+var auditBalance = "balance"                 // customer, expected from the ledger, actual balance
+var auditTrading = "trading"                 // expected, actual sum of the purchase, sale and refund entries
+var auditTransfers = "transfers"             // expected, actual sum of the transfer entries
+var auditPurchases = "purchases"             // customer, expected from the transactions, actual from the ledger
+var auditPayouts = "payouts"                 // customer, expected from the payouts, actual from the ledger
+var auditPendingCount = "pendingCount"       // charger, count
+var auditOfferTier = "offerTier"             // charger, offer, seller, quantity, an offer tier that can't be bought from
+var auditSupply = "supply"                   // charger, offer, seller, expected from the supply movements and transactions, actual units of the tier
+var auditTransactionTier = "transactionTier" // txid, charger, offer
+var auditEnergy = "energy"                   // txid, charger, expected sum of the tiers, actual energy
+var auditTierSellers = "tierSellers"         // txid, charger, offer, expected units of the tier, actual sum of its sellers' units
+var auditCost = "cost"                       // txid, charger, expected sum of the tiers' prices, actual cost
+
+// A check that failed, with what it found in the details
+type Discrepancy struct {
+	Check	string			`json:"check"`
+	Message	string			`json:"message"`
+	Details	ErrorDetails	`json:"details"`
+}
+
+// Report of auditLedger
+// Discrepancies of transactions written by addTransaction are kept apart, they were never paid for
+type AuditReport struct {
+	Consistent				bool			`json:"consistent"`
+	Customers				int				`json:"customers"`
+	LedgerEntries			int				`json:"ledgerentries"`
+	Transactions			int				`json:"transactions"`
+	PendingTransactions		int				`json:"pendingtransactions"`
+	InjectedTransactions	[]int64			`json:"injectedtransactions"`
+	Discrepancies			[]Discrepancy	`json:"discrepancies"`
+	InjectedDiscrepancies	[]Discrepancy	`json:"injecteddiscrepancies"`
+}
+
+type QueryResponseAudit struct {
+	Success	bool		`json:"success"`
+	Data	AuditReport	`json:"data"`
+}
+
+//////////////////////////////////////// QUERY FUNCTIONS ////////////////////////////////////////
+
+// Re-derive the balances from the ledger and the transactions and check them against the chaincode state
+// Also checks that every transaction adds up, that chargers have at most one pending transaction and that offers can be bought from
+// and hold what their sellers offered less what was withdrawn and sold
+func auditLedger(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	var report AuditReport
+	report.InjectedTransactions = []int64{}
+	report.Discrepancies = []Discrepancy{}
+	report.InjectedDiscrepancies = []Discrepancy{}
+
+	fmt.Println("Trying to audit the ledger")
+
+	// Monolithic blobs are invisible to everything else, so they are reported rather than audited
+	for _, key := range []string{legacyCustomersKey, legacyChargersKey, legacyOffersKey, legacyTransactionsKey, legacyPendingTransactionKey} {
+		valAsBytes, err := stub.GetState(key)
+		if err != nil {
+			return createQueryError(codeStateError, "Failed to get " + key)
+		}
+		if len(valAsBytes) > 0 {
+			report.flag(false, auditLegacyState, "Legacy state " + key + " has not been migrated", ErrorDetails{"key": key})
+		}
+	}
+
+	// Customers and chargers, in key order so the report is the same on every peer
+	var customerIDs []string
+	customers := make(map[string]Amount)
+	err := getStateByPartialCompositeKey(stub, customerObjectType, nil, func(key string, valAsBytes []byte) error {
+		var balance Amount
+		json.Unmarshal(valAsBytes, &balance)
+		_, attributes := splitCompositeKey(key)
+		customerIDs = append(customerIDs, attributes[0])
+		customers[attributes[0]] = balance
+		return nil
+	})
+	if err != nil {
+		return createQueryError(codeStateError, "Failed to get customers")
+	}
+	report.Customers = len(customerIDs)
+	chargers := make(map[string]Charger)
+	err = getStateByPartialCompositeKey(stub, chargerObjectType, nil, func(key string, valAsBytes []byte) error {
+		var charger Charger
+		json.Unmarshal(valAsBytes, &charger)
+		chargers[charger.ID] = charger
+		return nil
+	})
+	if err != nil {
+		return createQueryError(codeStateError, "Failed to get chargers")
+	}
+
+	// Balances and totals from the ledger
+	ledger, err := auditLedgerEntries(stub, &report, customers)
+	if err != nil {
+		return createQueryErrorFrom(err, "Failed to audit the ledger entries: " + err.Error())
+	}
+
+	// What sellers offered, compared with the offer tiers below
+	supply, err := getSupplyTotals(stub)
+	if err != nil {
+		return createQueryError(codeStateError, "Failed to get supply movements")
+	}
+
+	// Transactions, what their buyers paid is compared with the ledger below
+	paid := make(map[string]Amount)
+	err = auditTransactions(stub, &report, customers, chargers, ledger, paid, supply.sold)
+	if err != nil {
+		return createQueryErrorFrom(err, "Failed to audit the transactions: " + err.Error())
+	}
+	for _, customerID := range customerIDs {
+		if paid[customerID] != ledger.purchases[customerID] {
+			report.flag(false, auditPurchases, "Transactions of " + customerID + " cost " + paid[customerID].String() + ", the ledger has purchases of " + ledger.purchases[customerID].String(), ErrorDetails{"customer": customerID, "expected": paid[customerID], "actual": ledger.purchases[customerID]})
+		}
+	}
+
+	// Payouts hold what was withdrawn until they are rejected
+	held := make(map[string]Amount)
+	err = getStateByPartialCompositeKey(stub, payoutObjectType, nil, func(key string, valAsBytes []byte) error {
+		var payout Payout
+		json.Unmarshal(valAsBytes, &payout)
+		if _, ok := customers[payout.Customer]; !ok {
+			report.flag(false, auditUnknownCustomer, "Payout of unknown customer " + payout.Customer, ErrorDetails{"customer": payout.Customer, "payout": payout.PayoutID})
+		}
+		first, ok := ledger.firstEntry[payout.Customer]
+		if payout.Status == payoutRejected || !ok || payout.Requested < first {
+			return nil
+		}
+		var err error
+		held[payout.Customer], err = addAmounts(held[payout.Customer], payout.Amount)
+		return err
+	})
+	if err != nil {
+		return createQueryErrorFrom(err, "Failed to audit the payouts: " + err.Error())
+	}
+	for _, customerID := range customerIDs {
+		if held[customerID] != ledger.withdrawn[customerID] {
+			report.flag(false, auditPayouts, "Payouts of " + customerID + " hold " + held[customerID].String() + ", the ledger has withdrawals of " + ledger.withdrawn[customerID].String(), ErrorDetails{"customer": customerID, "expected": held[customerID], "actual": ledger.withdrawn[customerID]})
+		}
+	}
+
+	// Offer tiers
+	err = getStateByPartialCompositeKey(stub, offerObjectType, nil, func(key string, valAsBytes []byte) error {
+		var quantity Amount
+		json.Unmarshal(valAsBytes, &quantity)
+		_, attributes := splitCompositeKey(key)
+		if len(attributes) < 3 {
+			report.flag(false, auditLegacyState, "Offer " + key + " has no seller, it has not been migrated", ErrorDetails{"key": key})
+			return nil
+		}
+		auditOffer(&report, attributes[0], attributes[1], attributes[2], quantity, customers, chargers)
+		return supply.check(&report, key, quantity)
+	})
+	if err != nil {
+		return createQueryErrorFrom(err, "Failed to audit the offers: " + err.Error())
+	}
+	// Tiers that were sold out or withdrawn should hold nothing
+	err = supply.checkRest(&report)
+	if err != nil {
+		return createQueryErrorFrom(err, "Failed to audit the offers: " + err.Error())
+	}
+
+	report.Consistent = len(report.Discrepancies) == 0
+	return createQueryResponseAudit(true, report)
+
+}
+
+//////////////////////////////////////// UTILITY FUNCTIONS ////////////////////////////////////////
+
+// What the ledger says about each customer
+type ledgerTotals struct {
+	firstEntry	map[string]int64	// timestamp of the first entry, anything earlier predates the ledger
+	purchases	map[string]Amount	// paid for purchases less refunds
+	withdrawn	map[string]Amount	// withdrawn less returned payouts
+}
+
+// What each seller's offer tiers should hold, keyed like the offer tiers
+type supplyTotals struct {
+	recorded	map[string]bool		// chargers with supply movements, the supply of the others has not been migrated
+	offered		map[string]Amount	// units offered less units withdrawn
+	sold		map[string]Amount	// units sold less units refunded, added by auditTransactions
+	checked		map[string]bool		// offer tiers and chargers already checked
+}
+
+// Replay every customer's ledger entries and compare where they end up with the customer's balance
+// Balances from before the ledger existed have no entries and are taken as they are
+func auditLedgerEntries(stub shim.ChaincodeStubInterface, report *AuditReport, customers map[string]Amount) (ledgerTotals, error) {
+
+	var trading, transfers Amount
+	ledger := ledgerTotals{firstEntry: make(map[string]int64), purchases: make(map[string]Amount), withdrawn: make(map[string]Amount)}
+	last := make(map[string]LedgerEntry)
+	var customerIDs []string
+
+	err := getStateByPartialCompositeKey(stub, ledgerObjectType, nil, func(key string, valAsBytes []byte) error {
+		var entry LedgerEntry
+		var err error
+		json.Unmarshal(valAsBytes, &entry)
+		report.LedgerEntries++
+
+		previous, ok := last[entry.Customer]
+		if !ok {
+			customerIDs = append(customerIDs, entry.Customer)
+			ledger.firstEntry[entry.Customer] = entry.Timestamp
+		} else {
+			expected, err := addAmounts(previous.Balance, entry.Amount)
+			if err != nil {
+				return err
+			}
+			if entry.Balance != expected {
+				report.flag(false, auditLedgerChain, "Ledger entry " + fmt.Sprint(entry.EntryID) + " of " + entry.Customer + " leaves a balance of " + entry.Balance.String() + ", the previous entry adds up to " + expected.String(), ErrorDetails{"customer": entry.Customer, "entryid": entry.EntryID, "expected": expected, "actual": entry.Balance})
+			}
+		}
+		last[entry.Customer] = entry
+
+		switch entry.Type {
+		case entryPurchase:
+			trading, err = addAmounts(trading, entry.Amount)
+			if err == nil {
+				ledger.purchases[entry.Customer], err = subtractAmounts(ledger.purchases[entry.Customer], entry.Amount)
+			}
+		case entrySale:
+			trading, err = addAmounts(trading, entry.Amount)
+		case entryRefund:
+			// The buyer is credited, the sellers are debited
+			trading, err = addAmounts(trading, entry.Amount)
+			if err == nil && entry.Amount > 0 {
+				ledger.purchases[entry.Customer], err = subtractAmounts(ledger.purchases[entry.Customer], entry.Amount)
+			}
+		case entryTransfer:
+			transfers, err = addAmounts(transfers, entry.Amount)
+		case entryWithdrawal, entryPayoutReturned:
+			ledger.withdrawn[entry.Customer], err = subtractAmounts(ledger.withdrawn[entry.Customer], entry.Amount)
+		}
+		return err
+	})
+	if err != nil {
+		return ledgerTotals{}, err
+	}
+
+	for _, customerID := range customerIDs {
+		balance, ok := customers[customerID]
+		if !ok {
+			report.flag(false, auditUnknownCustomer, "Ledger entries of unknown customer " + customerID, ErrorDetails{"customer": customerID})
+			continue
+		}
+		if balance != last[customerID].Balance {
+			report.flag(false, auditBalance, "Balance of " + customerID + " is " + balance.String() + ", the ledger adds up to " + last[customerID].Balance.String(), ErrorDetails{"customer": customerID, "expected": last[customerID].Balance, "actual": balance})
+		}
+	}
+
+	// Money only changes hands when trading or transferring
+	if trading != 0 {
+		report.flag(false, auditTrading, "Purchases, sales and refunds add up to " + trading.String() + " instead of 0", ErrorDetails{"expected": Amount(0), "actual": trading})
+	}
+	if transfers != 0 {
+		report.flag(false, auditTransfers, "Transfers add up to " + transfers.String() + " instead of 0", ErrorDetails{"expected": Amount(0), "actual": transfers})
+	}
+	return ledger, nil
+
+}
+
+// Check the past and pending transactions, add what each buyer paid to paid and the units they took from each tier to sold
+// Only transactions accepted since the buyer's first ledger entry are paid for in the ledger
+func auditTransactions(stub shim.ChaincodeStubInterface, report *AuditReport, customers map[string]Amount, chargers map[string]Charger, ledger ledgerTotals, paid map[string]Amount, sold map[string]Amount) (error) {
+
+	var transactions []Transaction
+	for _, objectType := range []string{transactionObjectType, syntheticTransactionObjectType} {
+		err := getStateByPartialCompositeKey(stub, objectType, nil, func(key string, valAsBytes []byte) error {
+			var transaction Transaction
+			json.Unmarshal(valAsBytes, &transaction)
+			transactions = append(transactions, transaction)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	report.Transactions = len(transactions)
+	past := len(transactions)
+
+	// Every charger has a single pending transaction at most
+	err := getStateByPartialCompositeKey(stub, pendingTransactionObjectType, nil, func(key string, valAsBytes []byte) error {
+		var pendingTransaction []Transaction
+		json.Unmarshal(valAsBytes, &pendingTransaction)
+		_, attributes := splitCompositeKey(key)
+		if len(pendingTransaction) > 1 {
+			report.flag(false, auditPendingCount, "Charger " + attributes[0] + " has " + fmt.Sprint(len(pendingTransaction)) + " pending transactions", ErrorDetails{"charger": attributes[0], "count": len(pendingTransaction)})
+		}
+		report.PendingTransactions += len(pendingTransaction)
+		transactions = append(transactions, pendingTransaction...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i, transaction := range transactions {
+		injected := isInjectedTransaction(transaction)
+		if injected {
+			report.InjectedTransactions = append(report.InjectedTransactions, transaction.TXID)
+		}
+		err = auditTransaction(report, transaction, injected, customers, chargers)
+		if err == nil {
+			err = addSoldUnits(sold, transaction, i >= past, chargers[transaction.Charger].Owner)
+		}
+		if err != nil {
+			return err
+		}
+
+		first, ok := ledger.firstEntry[transaction.Buyer]
+		if injected || !ok || transaction.Accepted < first {
+			continue
+		}
+		paid[transaction.Buyer], err = addAmounts(paid[transaction.Buyer], transaction.Cost)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+
+}
+
+// Check that a transaction's tiers add up to its energy and cost and that its buyer and charger exist
+func auditTransaction(report *AuditReport, transaction Transaction, injected bool, customers map[string]Amount, chargers map[string]Charger) (error) {
+
+	var energy, cost Amount
+
+	identify := func(details ErrorDetails) ErrorDetails {
+		details["txid"] = transaction.TXID
+		details["charger"] = transaction.Charger
+		return details
+	}
+	name := "Transaction " + fmt.Sprint(transaction.TXID)
+	if transaction.Status == "Pending" {
+		name = "Pending transaction of " + transaction.Charger
+	}
+
+	if _, ok := customers[transaction.Buyer]; !ok {
+		report.flag(injected, auditUnknownCustomer, name + " has unknown buyer " + transaction.Buyer, identify(ErrorDetails{"customer": transaction.Buyer}))
+	}
+	if _, ok := chargers[transaction.Charger]; !ok && len(transaction.Charger) > 0 {
+		report.flag(injected, auditUnknownCharger, name + " is at an unknown charger", identify(ErrorDetails{}))
+	}
+
+	// Like acceptOffer, every seller's units at each tier are paid for separately
+	// Transactions accepted before sellers were recorded were sold by a single seller
+	offerIDs := make([]string, 0, len(transaction.Offers))
+	for offerID := range transaction.Offers {
+		offerIDs = append(offerIDs, offerID)
+	}
+	sort.Strings(offerIDs)
+	for _, offerID := range offerIDs {
+		units := transaction.Offers[offerID]
+		pricePerUnit, err := parseAmount(offerID)
+		if err != nil || pricePerUnit <= 0 || pricePerUnit.String() != offerID || units <= 0 {
+			report.flag(injected, auditTransactionTier, name + " has an invalid offer tier", identify(ErrorDetails{"offer": offerID}))
+			continue
+		}
+		energy, err = addAmounts(energy, units)
+		if err != nil {
+			return err
+		}
+
+		sellers := map[string]Amount{"": units}
+		if transaction.Sellers != nil {
+			sellers = transaction.Sellers[offerID]
+			var sold Amount
+			for _, sellerUnits := range sellers {
+				sold, err = addAmounts(sold, sellerUnits)
+				if err != nil {
+					return err
+				}
+			}
+			if sold != units {
+				report.flag(injected, auditTierSellers, name + " has " + units.String() + " units at " + offerID + ", its sellers have " + sold.String(), identify(ErrorDetails{"offer": offerID, "expected": units, "actual": sold}))
+			}
+		}
+		for _, sellerUnits := range sellers {
+			payment, err := multiplyAmounts(sellerUnits, pricePerUnit)
+			if err == nil {
+				cost, err = addAmounts(cost, payment)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if energy != transaction.Energy {
+		report.flag(injected, auditEnergy, name + " has " + transaction.Energy.String() + " units, its tiers add up to " + energy.String(), identify(ErrorDetails{"expected": energy, "actual": transaction.Energy}))
+	}
+	if cost != transaction.Cost {
+		report.flag(injected, auditCost, name + " cost " + transaction.Cost.String() + ", its tiers add up to " + cost.String(), identify(ErrorDetails{"expected": cost, "actual": transaction.Cost}))
+	}
+	return nil
+
+}
+
+// Check that an offer tier can be bought from: a positive quantity at a positive price, by a seller and at a charger that exist
+func auditOffer(report *AuditReport, chargerID string, offerID string, seller string, quantity Amount, customers map[string]Amount, chargers map[string]Charger) {
+
+	details := ErrorDetails{"charger": chargerID, "offer": offerID, "seller": seller, "quantity": quantity}
+	if _, ok := chargers[chargerID]; !ok {
+		report.flag(false, auditUnknownCharger, "Offer " + offerID + " of " + seller + " is at unknown charger " + chargerID, details)
+	}
+	if _, ok := customers[seller]; !ok {
+		report.flag(false, auditUnknownCustomer, "Offer " + offerID + " at " + chargerID + " is sold by unknown customer " + seller, details)
+	}
+	pricePerUnit, err := parseAmount(offerID)
+	if err != nil || pricePerUnit <= 0 || pricePerUnit.String() != offerID || quantity <= 0 {
+		report.flag(false, auditOfferTier, "Offer " + offerID + " of " + seller + " at " + chargerID + " has " + quantity.String() + " units", details)
+	}
+
+}
+
+// Sum the supply movements of every seller at each tier
+func getSupplyTotals(stub shim.ChaincodeStubInterface) (supplyTotals, error) {
+
+	supply := supplyTotals{recorded: make(map[string]bool), offered: make(map[string]Amount), sold: make(map[string]Amount), checked: make(map[string]bool)}
+	err := getStateByPartialCompositeKey(stub, supplyObjectType, nil, func(key string, valAsBytes []byte) error {
+		var movement SupplyMovement
+		var err error
+		json.Unmarshal(valAsBytes, &movement)
+		supply.recorded[movement.Charger] = true
+		tierKey := createCompositeKey(offerObjectType, movement.Charger, movement.Offer, movement.Seller)
+		supply.offered[tierKey], err = addAmounts(supply.offered[tierKey], movement.Quantity)
+		return err
+	})
+	if err != nil {
+		return supplyTotals{}, err
+	}
+	return supply, nil
+
+}
+
+// Check that an offer tier, by its key, holds what its seller offered less what was withdrawn and sold
+// A charger without supply movements is reported once as not migrated instead
+func (supply supplyTotals) check(report *AuditReport, key string, quantity Amount) (error) {
+
+	supply.checked[key] = true
+	_, attributes := splitCompositeKey(key)
+	chargerID, offerID, seller := attributes[0], attributes[1], attributes[2]
+	if !supply.recorded[chargerID] {
+		if !supply.checked[chargerID] {
+			supply.checked[chargerID] = true
+			report.flag(false, auditLegacyState, "Supply of charger " + chargerID + " has not been recorded, it has not been migrated", ErrorDetails{"key": createCompositeKey(supplyObjectType, chargerID)})
+		}
+		return nil
+	}
+	expected, err := subtractAmounts(supply.offered[key], supply.sold[key])
+	if err != nil {
+		return err
+	}
+	if quantity != expected {
+		report.flag(false, auditSupply, "Offer " + offerID + " of " + seller + " at " + chargerID + " has " + quantity.String() + " units, " + expected.String() + " were offered and not withdrawn or sold", ErrorDetails{"charger": chargerID, "offer": offerID, "seller": seller, "expected": expected, "actual": quantity})
+	}
+	return nil
+
+}
+
+// Check the tiers that were offered or sold from but are no longer in the chaincode state, in key order
+func (supply supplyTotals) checkRest(report *AuditReport) (error) {
+
+	var keys []string
+	for _, totals := range []map[string]Amount{supply.offered, supply.sold} {
+		for key := range totals {
+			if !supply.checked[key] {
+				supply.checked[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		expected, err := subtractAmounts(supply.offered[key], supply.sold[key])
+		if err != nil {
+			return err
+		}
+		if expected == 0 {
+			continue
+		}
+		err = supply.check(report, key, 0)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+
+}
+
+// Add a discrepancy to the report, apart from the others if it is in an injected transaction
+func (report *AuditReport) flag(injected bool, check string, message string, details ErrorDetails) {
+	discrepancy := Discrepancy{Check: check, Message: message, Details: details}
+	if injected {
+		report.InjectedDiscrepancies = append(report.InjectedDiscrepancies, discrepancy)
+		return
+	}
+	report.Discrepancies = append(report.Discrepancies, discrepancy)
+}
+
+func createQueryResponseAudit(success bool, data AuditReport) ([]byte, error) {
+	var response QueryResponseAudit
+	response.Success = success
+	response.Data = data
+	r, _ := json.Marshal(response)
+	return r, nil
+}
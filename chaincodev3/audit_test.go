@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+)
+
+func (s *mockStub) audit(t *testing.T) AuditReport {
+	var report AuditReport
+	s.query(t, &report, "auditLedger")
+	return report
+}
+
+func expectChecks(t *testing.T, what string, got []Discrepancy, want ...string) {
+	if len(got) != len(want) {
+		t.Fatalf("%s: got %+v, want checks %v", what, got, want)
+	}
+	for i := range want {
+		if got[i].Check != want[i] {
+			t.Fatalf("%s: got %+v, want checks %v", what, got, want)
+		}
+	}
+}
+
+func TestAuditConsistentMarket(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "admin", "addCustomer", "ross")
+	s.mustInvoke(t, "admin", "addRole", "ross", "seller")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "0.3333", "0.5")
+	s.mustInvoke(t, "ross", "addOfferQuantity", "charger1", "0.3333", "0.5", "ross")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "1.25", "10")
+
+	// A partial refund is rounded separately from the payment, the audit allows for it
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "2.5")
+	s.mustInvoke(t, "charger1", "cancelTransaction", "charger1", "1.75")
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "3")
+	s.mustInvoke(t, "charger1", "completeTransaction", "charger1")
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "1")
+	s.mustInvoke(t, "james", "transferFunds", "james", "ross", "10")
+	s.mustInvoke(t, "ross", "withdrawFunds", "ross", "5")
+	s.mustInvoke(t, "ross", "withdrawFunds", "ross", "1")
+	s.mustInvoke(t, "admin", "confirmPayout", "1")
+	s.mustInvoke(t, "admin", "rejectPayout", "2")
+
+	report := s.audit(t)
+	if !report.Consistent || report.Customers != 3 || report.Transactions != 2 || report.PendingTransactions != 1 || report.LedgerEntries != 15 {
+		t.Fatalf("audit returned %+v", report)
+	}
+	expectChecks(t, "discrepancies", report.Discrepancies)
+	expectChecks(t, "injected discrepancies", report.InjectedDiscrepancies)
+}
+
+func TestAuditInjectedTransactions(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "10")
+	s.mustInvoke(t, "charger1", "completeTransaction", "charger1")
+
+	// Injected transactions were never paid for, and may not add up
+	s.mustInvoke(t, "admin", "addTransaction", "2", "1490000000", "james", "20", "100", "5", "20")
+	s.mustInvoke(t, "admin", "addTransaction", "2", "1490000000", "ross", "20", "90", "5", "10", "6", "10")
+
+	report := s.audit(t)
+	if !report.Consistent || len(report.InjectedTransactions) != 2 || report.InjectedTransactions[0] != 2 || report.InjectedTransactions[1] != 3 {
+		t.Fatalf("audit returned %+v", report)
+	}
+	expectChecks(t, "injected discrepancies", report.InjectedDiscrepancies, auditUnknownCustomer, auditCost)
+	expectDetails(t, "cost", report.InjectedDiscrepancies[1].Details, ErrorDetails{"actual": wholeAmount(90), "charger": "", "expected": wholeAmount(110), "txid": 3})
+}
+
+func TestAuditFindsDiscrepancies(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "10")
+	s.mustInvoke(t, "charger1", "completeTransaction", "charger1")
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "10")
+
+	// A balance that was changed without a ledger entry
+	marshalAndPut(s, createCompositeKey(customerObjectType, "sam"), wholeAmount(60))
+	report := s.audit(t)
+	expectChecks(t, "discrepancies", report.Discrepancies, auditBalance)
+	expectDetails(t, "balance", report.Discrepancies[0].Details, ErrorDetails{"actual": wholeAmount(60), "customer": "sam", "expected": wholeAmount(100)})
+	marshalAndPut(s, createCompositeKey(customerObjectType, "sam"), wholeAmount(100))
+
+	// A past transaction that doesn't add up, and that its buyer didn't pay for
+	var transactions []Transaction
+	s.query(t, &transactions, "getTransactions")
+	transactions[0].Cost = wholeAmount(40)
+	transactions[0].Energy = wholeAmount(11)
+	marshalAndPut(s, createCompositeKey(transactionObjectType, "00000000000000000001", "0"), transactions[0])
+	report = s.audit(t)
+	if report.Consistent {
+		t.Fatal("audit of a tampered transaction is consistent")
+	}
+	expectChecks(t, "discrepancies", report.Discrepancies, auditEnergy, auditCost, auditPurchases)
+	expectDetails(t, "purchases", report.Discrepancies[2].Details, ErrorDetails{"actual": wholeAmount(100), "customer": "james", "expected": wholeAmount(90)})
+	transactions[0].Cost = wholeAmount(50)
+	transactions[0].Energy = wholeAmount(10)
+	marshalAndPut(s, createCompositeKey(transactionObjectType, "00000000000000000001", "0"), transactions[0])
+
+	// A second pending transaction and an offer tier that can't be bought from, and was never offered
+	pending := s.pending(t, "charger1")
+	marshalAndPut(s, createCompositeKey(pendingTransactionObjectType, "charger1"), append(pending, pending[0]))
+	marshalAndPut(s, createCompositeKey(offerObjectType, "charger1", "5.50", "ross"), wholeAmount(1))
+	marshalAndPut(s, legacyOffersKey, map[string]Amount{"5": wholeAmount(1)})
+	report = s.audit(t)
+	expectChecks(t, "discrepancies", report.Discrepancies, auditLegacyState, auditPendingCount, auditPurchases, auditUnknownCustomer, auditOfferTier, auditSupply, auditSupply)
+	expectDetails(t, "pendingCount", report.Discrepancies[1].Details, ErrorDetails{"charger": "charger1", "count": 2})
+	expectDetails(t, "offerTier", report.Discrepancies[4].Details, ErrorDetails{"charger": "charger1", "offer": "5.50", "quantity": wholeAmount(1), "seller": "ross"})
+	// The second pending transaction took units the tier still has
+	expectDetails(t, "supply", report.Discrepancies[6].Details, ErrorDetails{"charger": "charger1", "offer": "5", "seller": "sam", "expected": wholeAmount(70), "actual": wholeAmount(80)})
+}
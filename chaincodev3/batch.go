@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var maxBatchSize = 1000 // most operations in a single batch
+
+// Operation of a batch
+// Args are positional arguments, or an object with the arguments as named fields
+type BatchOperation struct {
+	Function	string			`json:"function"`
+	Args		json.RawMessage	`json:"args"`
+}
+
+// Result of a batch operation, returned in the order of the operations
+type BatchResult struct {
+	Function	string			`json:"function"`
+	Message		string			`json:"message"`
+	Data		json.RawMessage	`json:"data"`
+}
+
+//////////////////////////////////////// INVOKE FUNCTIONS ////////////////////////////////////////
+
+// Run several invoke functions in order as a single transaction
+// The first operation that fails rejects the batch, so either every operation is kept or none is
+func batch(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	var retStr string
+	var operations []BatchOperation
+
+	err := json.Unmarshal([]byte(args[0]), &operations)
+	if err != nil {
+		retStr = "First argument (operations) must be a JSON array of operations: " + err.Error()
+		return createInvokeError(codeBadArgument, retStr)
+	}
+	if len(operations) == 0 || len(operations) > maxBatchSize {
+		retStr = "First argument (operations) must hold between 1 and " + strconv.Itoa(maxBatchSize) + " operations"
+		return createInvokeError(codeBadArgument, retStr)
+	}
+
+	// Debug message
+	fmt.Println("Trying to run a batch of " + strconv.Itoa(len(operations)) + " operations")
+
+	results := make([]BatchResult, len(operations))
+	for i, op := range operations {
+		opArgs, err := op.arguments()
+		if err != nil {
+			return batchError(i, op, codeBadArgument, err.Error(), nil)
+		}
+		// Init resets the whole chaincode state, and batches are not nested
+		if op.Function == "init" || op.Function == "batch" {
+			return batchError(i, op, codeBadArgument, op.Function + " cannot be run in a batch", nil)
+		}
+
+		// Operations share the stub, so they see each other's writes and add to the same events
+		retBytes, err := invokeFunction(stub, op.Function, opArgs)
+		if err != nil {
+			var response InvokeResponse
+			json.Unmarshal(retBytes, &response)
+			return batchError(i, op, response.Code, response.Message, response.Details)
+		}
+		json.Unmarshal(retBytes, &results[i])
+		results[i].Function = op.Function
+	}
+
+	// Successful return
+	retStr = "Successfully ran a batch of " + strconv.Itoa(len(operations)) + " operations"
+	return createInvokeResponse(retStr, results)
+
+}
+
+//////////////////////////////////////// UTILITY FUNCTIONS ////////////////////////////////////////
+
+// Arguments of an operation: an array of strings, an object of named fields or nothing
+func (op BatchOperation) arguments() ([]string, error) {
+
+	var args []string
+	if len(op.Args) == 0 || string(op.Args) == "null" {
+		return args, nil
+	}
+	if op.Args[0] == '{' {
+		return []string{string(op.Args)}, nil
+	}
+	err := json.Unmarshal(op.Args, &args)
+	if err != nil {
+		return nil, fmt.Errorf("Arguments must be an array of strings or an object: %s", err)
+	}
+	return args, nil
+
+}
+
+// Report the failure of an operation as the failure of the batch
+// The details of the operation's error get the index and function of the operation
+func batchError(i int, op BatchOperation, code string, message string, details ErrorDetails) ([]byte, error) {
+	batchDetails := ErrorDetails{"index": i, "function": op.Function}
+	for key, value := range details {
+		batchDetails[key] = value
+	}
+	return createInvokeErrorDetails(code, "Operation " + strconv.Itoa(i) + " (" + op.Function + ") failed: " + message, batchDetails)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestBatch(t *testing.T) {
+	s := newMarket(t)
+	var results []BatchResult
+
+	s.invokeData(t, &results, "admin", "batch", `[
+		{"function": "addCustomer", "args": ["ross"]},
+		{"function": "addCustomerFunds", "args": {"customer": "ross", "amount": 500}},
+		{"function": "addCharger", "args": ["charger2", "ross"]},
+		{"function": "addRole", "args": ["ross", "seller"]},
+		{"function": "expirePendingTransactions"}
+	]`)
+	if len(results) != 5 || results[1].Function != "addCustomerFunds" || results[1].Message != "Successfully added 500 to ross's balance" {
+		t.Fatalf("batch returned %+v", results)
+	}
+	var customer Customer
+	json.Unmarshal(results[1].Data, &customer)
+	if customer != (Customer{ID: "ross", Balance: wholeAmount(500)}) {
+		t.Fatalf("addCustomerFunds in a batch returned %s", results[1].Data)
+	}
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 0, "james": 10000, "ross": 500})
+
+	// The events of every operation are set together
+	s.mustInvoke(t, "admin", "batch", `[
+		{"function": "addCustomerFunds", "args": ["ross", "1"]},
+		{"function": "addCustomerFunds", "args": ["james", "1"]},
+		{"function": "addRole", "args": ["sam", "customer"]}
+	]`)
+	s.lastEvent(t, eventCustomerFundsAdded, eventCustomerFundsAdded)
+}
+
+func TestBatchIsAtomic(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+
+	// Operations see the writes of the operations before them
+	s.mustInvoke(t, "admin", "batch", `[{"function": "addCustomer", "args": ["ross"]}, {"function": "addCustomerFunds", "args": ["ross", "100"]}]`)
+
+	// A later failure rejects the whole transaction, so the funds added before it are not kept
+	message := s.mustFailWith(t, codeUnknownCustomer, "admin", "batch", `[
+		{"function": "addCustomerFunds", "args": ["james", "100"]},
+		{"function": "addCustomerFunds", "args": ["ross", "100"]},
+		{"function": "addCharger", "args": ["charger2", "ghost"]}
+	]`)
+	expectError(t, message, "Operation 2 (addCharger) failed: ")
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 0, "james": 10000, "ross": 100})
+}
+
+func TestBatchFailures(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+
+	details := s.mustFailDetails(t, codeInsufficientFunds, "admin", "batch", `[
+		{"function": "addCustomer", "args": ["ross"]},
+		{"function": "addRole", "args": ["admin", "customer"]},
+		{"function": "addCustomer", "args": ["admin"]},
+		{"function": "acceptOffer", "args": ["charger1", "admin", "50"]}
+	]`)
+	expectDetails(t, "batch", details, ErrorDetails{"index": 3, "function": "acceptOffer", "customer": "admin", "required": 250, "available": 0})
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 0, "james": 10000})
+	var roles []string
+	s.query(t, &roles, "getRoles", "admin")
+	if len(roles) != 1 {
+		t.Fatalf("admin has roles %v after a failed batch", roles)
+	}
+
+	// Every operation is checked against the caller
+	details = s.mustFailDetails(t, codeNotAllowed, "james", "batch", `[{"function": "acceptOffer", "args": ["charger1", "james", "1"]}, {"function": "addCustomerFunds", "args": ["james", "1000"]}]`)
+	if details["index"] != float64(1) {
+		t.Fatalf("batch failed with details %v", details)
+	}
+	if n := len(s.pending(t, "charger1")); n != 0 {
+		t.Fatalf("%d pending transactions, want 0", n)
+	}
+
+	expectError(t, s.mustFailWith(t, codeUnknownFunction, "admin", "batch", `[{"function": "mintMoney"}]`), "Operation 0 (mintMoney) failed: Received unknown function invocation: mintMoney")
+	expectError(t, s.mustFailWith(t, codeBadArgument, "admin", "batch", `[{"function": "addCustomer", "args": ["ross"]}, {"function": "batch", "args": ["[]"]}]`), "Operation 1 (batch) failed: batch cannot be run in a batch")
+	expectError(t, s.mustFailWith(t, codeBadArgument, "admin", "batch", `[{"function": "init", "args": ["1"]}]`), "init cannot be run in a batch")
+	expectError(t, s.mustFailWith(t, codeBadArgument, "admin", "batch", `[{"function": "addCustomer", "args": "ross"}]`), "Arguments must be an array of strings or an object")
+	expectError(t, s.mustFailWith(t, codeBadArgument, "admin", "batch", `[{"function": "addCustomerFunds", "args": ["james"]}]`), "Operation 0 (addCustomerFunds) failed: Incorrect number of arguments")
+	expectError(t, s.mustFailWith(t, codeBadArgument, "admin", "batch", `[]`), "must hold between 1 and 1000 operations")
+	expectError(t, s.mustFailWith(t, codeBadArgument, "admin", "batch", `"addCustomer"`), "must be a JSON array of operations")
+	expectError(t, s.mustFailWith(t, codeBadArgument, "admin", "batch", `[{`), "First argument (array of operations) must be valid JSON")
+}
@@ -0,0 +1,61 @@
+package main
+
+// Catalogue of error codes reported by invoke and query functions, so clients don't have to match messages
+// Details lists the structured details each code comes with, all keys are optional
+var codeBadArgument = "BAD_ARGUMENT"                              // missing, malformed or out of range argument
+var codeUnknownFunction = "UNKNOWN_FUNCTION"                      // function
+var codeUnknownCustomer = "UNKNOWN_CUSTOMER"                      // customer
+var codeUnknownCharger = "UNKNOWN_CHARGER"                        // charger
+var codeUnknownOffer = "UNKNOWN_OFFER"                            // charger, offer, seller
+var codeUnknownBid = "UNKNOWN_BID"                                // charger, bid
+var codeUnknownVariable = "UNKNOWN_VARIABLE"                      // variable
+var codeCustomerExists = "CUSTOMER_EXISTS"                        // customer
+var codeChargerExists = "CHARGER_EXISTS"                          // charger
+var codePendingTXExists = "PENDING_TX_EXISTS"                     // charger
+var codeNoPendingTX = "NO_PENDING_TX"                             // charger
+var codeInsufficientFunds = "INSUFFICIENT_FUNDS"                  // customer, required, available
+var codeInsufficientSupply = "INSUFFICIENT_SUPPLY"                // charger, requested, available, maxprice
+var codeRefundExceedsTransaction = "REFUND_EXCEEDS_TRANSACTION"   // charger, requested, available
+var codeNotAllowed = "NOT_ALLOWED"                                // caller, function, roles or actor
+var codeRoleNotGranted = "ROLE_NOT_GRANTED"                       // enrollmentid, role
+var codeLastAdmin = "LAST_ADMIN"                                  // enrollmentid
+var codeNothingToMigrate = "NOTHING_TO_MIGRATE"
+var codeIdempotencyKeyReused = "IDEMPOTENCY_KEY_REUSED"           // function, key
+var codeUnknownPayout = "UNKNOWN_PAYOUT"                          // payout
+var codePayoutSettled = "PAYOUT_SETTLED"                          // payout, status
+var codeAmountOverflow = "AMOUNT_OVERFLOW"                        // operation
+var codeLimitExceeded = "LIMIT_EXCEEDED"                          // limit, value, max, customer for the balance limit
+var codeStateError = "STATE_ERROR"                                // reading or writing the chaincode state failed
+
+// Structured details of an error, such as the required and available amounts
+type ErrorDetails map[string]interface{}
+
+// Error returned by utility functions that know which code it should be reported under
+type ChaincodeError struct {
+	Code	string
+	Message	string
+	Details	ErrorDetails
+}
+
+func (e ChaincodeError) Error() string {
+	return e.Message
+}
+
+func newChaincodeError(code string, message string, details ErrorDetails) (error) {
+	return ChaincodeError{Code: code, Message: message, Details: details}
+}
+
+// Code to report an error under, errors without one come from the chaincode state
+func errorCode(err error) (string) {
+	if ce, ok := err.(ChaincodeError); ok {
+		return ce.Code
+	}
+	return codeStateError
+}
+
+func errorDetails(err error) (ErrorDetails) {
+	if ce, ok := err.(ChaincodeError); ok {
+		return ce.Details
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestErrorDetails(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "200", "100")
+
+	details := s.mustFailDetails(t, codeInsufficientSupply, "james", "acceptOffer", "charger1", "james", "150", "5")
+	expectDetails(t, "acceptOffer above max price", details, ErrorDetails{"charger": "charger1", "requested": 150, "available": 100, "maxprice": 5})
+	details = s.mustFailDetails(t, codeInsufficientFunds, "james", "acceptOffer", "charger1", "james", "150")
+	expectDetails(t, "acceptOffer without funds", details, ErrorDetails{"customer": "james", "required": 10500, "available": 10000})
+
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "10")
+	details = s.mustFailDetails(t, codePendingTXExists, "james", "acceptOffer", "charger1", "james", "10")
+	expectDetails(t, "acceptOffer with a pending transaction", details, ErrorDetails{"charger": "charger1"})
+	details = s.mustFailDetails(t, codeRefundExceedsTransaction, "charger1", "cancelTransaction", "charger1", "11")
+	expectDetails(t, "cancelTransaction", details, ErrorDetails{"charger": "charger1", "requested": 11, "available": 10})
+	s.mustInvoke(t, "charger1", "completeTransaction", "charger1")
+	details = s.mustFailDetails(t, codeNoPendingTX, "charger1", "completeTransaction", "charger1")
+	expectDetails(t, "completeTransaction", details, ErrorDetails{"charger": "charger1"})
+
+	details = s.mustFailDetails(t, codeUnknownCustomer, "admin", "addCharger", "charger2", "nobody")
+	expectDetails(t, "addCharger", details, ErrorDetails{"customer": "nobody"})
+	details = s.mustFailDetails(t, codeUnknownCharger, "sam", "addOfferQuantity", "Charger9", "5", "1")
+	expectDetails(t, "addOfferQuantity", details, ErrorDetails{"charger": "charger9"})
+	details = s.mustFailDetails(t, codeUnknownOffer, "sam", "subtractOfferQuantity", "charger1", "6", "1")
+	expectDetails(t, "subtractOfferQuantity", details, ErrorDetails{"charger": "charger1", "offer": "6", "seller": "sam"})
+	details = s.mustFailDetails(t, codeUnknownBid, "james", "cancelBid", "charger1", "7")
+	expectDetails(t, "cancelBid", details, ErrorDetails{"charger": "charger1", "bid": 7})
+	details = s.mustFailDetails(t, codeChargerExists, "admin", "addCharger", "charger1", "sam")
+	expectDetails(t, "addCharger twice", details, ErrorDetails{"charger": "charger1"})
+
+	details = s.mustFailDetails(t, codeNotAllowed, "sam", "addCustomer", "ross")
+	expectDetails(t, "addCustomer as a customer", details, ErrorDetails{"caller": "sam", "function": "addCustomer", "roles": []string{roleAdmin}})
+	details = s.mustFailDetails(t, codeNotAllowed, "sam", "acceptOffer", "charger1", "james", "1")
+	expectDetails(t, "acceptOffer for someone else", details, ErrorDetails{"caller": "sam", "function": "acceptOffer", "actor": "james"})
+	details = s.mustFailDetails(t, codeRoleNotGranted, "admin", "removeRole", "james", "seller")
+	expectDetails(t, "removeRole", details, ErrorDetails{"enrollmentid": "james", "role": "seller"})
+	details = s.mustFailDetails(t, codeLastAdmin, "admin", "removeRole", "admin", "admin")
+	expectDetails(t, "removeRole of the last admin", details, ErrorDetails{"enrollmentid": "admin"})
+	s.mustFailWith(t, codeNothingToMigrate, "admin", "migrateState")
+}
+
+func TestQueryErrorCodes(t *testing.T) {
+	s := newMarket(t)
+
+	s.queryFailsWith(t, codeBadArgument, "getOffers")
+	s.queryFailsWith(t, codeBadArgument, "getTransactions", "0")
+	s.queryFailsWith(t, codeUnknownCharger, "getOfferTiers", "charger9")
+	s.queryFailsWith(t, codeUnknownCustomer, "getCustomer", "nobody")
+	s.queryFailsWith(t, codeUnknownVariable, "read", "nothing")
+	s.queryFailsWith(t, codeUnknownFunction, "mintMoney")
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Name of the chaincode event, the same for every invocation so clients can subscribe to it once
+var eventName = "tradingEvents"
+
+// Version of the event payload below, bumped whenever a field changes meaning or is removed
+var eventSchemaVersion = 1
+
+// Event types, one for each state-changing invoke that clients subscribe to
+var eventOfferQuantityAdded = "offerQuantityAdded"
+var eventOfferQuantitySubtracted = "offerQuantitySubtracted"
+var eventCustomerFundsAdded = "customerFundsAdded"
+var eventOfferAccepted = "offerAccepted"
+var eventTransactionCompleted = "transactionCompleted"
+var eventTransactionCancelled = "transactionCancelled"
+var eventTransactionExpired = "transactionExpired"
+var eventPayoutRequested = "payoutRequested"
+var eventPayoutConfirmed = "payoutConfirmed"
+var eventPayoutRejected = "payoutRejected"
+var eventFundsTransferred = "fundsTransferred"
+var eventBidRejected = "bidRejected"
+
+// Payload of the chaincode event
+// An invocation sets at most one chaincode event, so everything it changed is listed in Events in the order it happened
+// The chaincode event is always named eventName, the types are only in the payload
+type EventPayload struct {
+	Version	int		`json:"version"`
+	Events	[]Event	`json:"events"`
+}
+
+// A single change, Data is one of the event structs below depending on Type
+type Event struct {
+	Type		string		`json:"type"`
+	Timestamp	int64		`json:"timestamp"`
+	Data		interface{}	`json:"data"`
+}
+
+// Data of offerQuantityAdded and offerQuantitySubtracted
+// Quantity is the change, Available what the seller has left in the tier
+type OfferQuantityEvent struct {
+	Charger		string	`json:"charger"`
+	Offer		string	`json:"offer"`
+	Seller		string	`json:"seller"`
+	Quantity	Amount	`json:"quantity"`
+	Available	Amount	`json:"available"`
+}
+
+// Data of customerFundsAdded
+type CustomerFundsEvent struct {
+	Customer	string	`json:"customer"`
+	Amount		Amount	`json:"amount"`
+	Balance		Amount	`json:"balance"`
+}
+
+// Data of offerAccepted and transactionCompleted
+type TransactionEvent struct {
+	Transaction	Transaction	`json:"transaction"`
+}
+
+// Data of transactionCancelled and transactionExpired
+// Transaction is what is left of the transaction after the refund
+type TransactionCancelledEvent struct {
+	Transaction		Transaction	`json:"transaction"`
+	UnitsRefunded	Amount		`json:"unitsrefunded"`
+	AmountRefunded	Amount		`json:"amountrefunded"`
+}
+
+// Data of payoutRequested, payoutConfirmed and payoutRejected
+// Balance is the customer's balance after the payout was requested or settled
+type PayoutEvent struct {
+	Payout	Payout	`json:"payout"`
+	Balance	Amount	`json:"balance"`
+}
+
+// Data of bidRejected, set when a resting bid could not be filled while matching bids
+// Removed is true if the bid was removed from the order book, otherwise it keeps resting
+// Code, Message and Details are those of the acceptOffer that failed
+type BidRejectedEvent struct {
+	Bid		Bid				`json:"bid"`
+	Removed	bool			`json:"removed"`
+	Code	string			`json:"code"`
+	Message	string			`json:"message"`
+	Details	ErrorDetails	`json:"details"`
+}
+
+// Stub handed to invoke functions by Invoke, collects their events so they can be set once at the end
+type eventStub struct {
+	shim.ChaincodeStubInterface
+	events	[]Event
+}
+
+//////////////////////////////////////// UTILITY FUNCTIONS ////////////////////////////////////////
+
+// Record an event of an invoke function
+// Outside of Invoke the event is set right away
+func emitEvent(stub shim.ChaincodeStubInterface, eventType string, data interface{}) (error) {
+
+	timestamp, err := getTxTimestamp(stub)
+	if err != nil {
+		return err
+	}
+	event := Event{Type: eventType, Timestamp: timestamp, Data: data}
+
+	if es, ok := stub.(*eventStub); ok {
+		es.events = append(es.events, event)
+		return nil
+	}
+	return setEvents(stub, []Event{event})
+
+}
+
+// Set the events collected during an invocation as its chaincode event
+func (es *eventStub) flushEvents() (error) {
+	if len(es.events) == 0 {
+		return nil
+	}
+	return setEvents(es.ChaincodeStubInterface, es.events)
+}
+
+func setEvents(stub shim.ChaincodeStubInterface, events []Event) (error) {
+	payload, err := json.Marshal(EventPayload{Version: eventSchemaVersion, Events: events})
+	if err != nil {
+		return err
+	}
+	return stub.SetEvent(eventName, payload)
+}
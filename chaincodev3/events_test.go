@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// Decoded chaincode event of the last invocation, the data of each event is left raw
+type testEventPayload struct {
+	Version	int	`json:"version"`
+	Events	[]struct {
+		Type		string			`json:"type"`
+		Timestamp	int64			`json:"timestamp"`
+		Data		json.RawMessage	`json:"data"`
+	}	`json:"events"`
+}
+
+// Check the chaincode event set by the last invocation and return its payload
+func (s *mockStub) lastEvent(t *testing.T, types ...string) testEventPayload {
+	var payload testEventPayload
+	if len(s.events) != 1 {
+		t.Fatalf("%d chaincode events set, want 1", len(s.events))
+	}
+	if s.events[0].name != eventName {
+		t.Fatalf("chaincode event is named %s, want %s", s.events[0].name, eventName)
+	}
+	err := json.Unmarshal(s.events[0].payload, &payload)
+	if err != nil {
+		t.Fatalf("could not decode event payload %s: %v", s.events[0].payload, err)
+	}
+	if payload.Version != eventSchemaVersion {
+		t.Fatalf("event version %d, want %d", payload.Version, eventSchemaVersion)
+	}
+	if len(payload.Events) != len(types) {
+		t.Fatalf("got %d events, want %v", len(payload.Events), types)
+	}
+	for i, event := range payload.Events {
+		if event.Type != types[i] || event.Timestamp != s.now {
+			t.Fatalf("event %d is %s at %d, want %s at %d", i, event.Type, event.Timestamp, types[i], s.now)
+		}
+	}
+	return payload
+}
+
+func TestOfferQuantityEvents(t *testing.T) {
+	s := newMarket(t)
+	var data OfferQuantityEvent
+
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "20")
+	json.Unmarshal(s.lastEvent(t, eventOfferQuantityAdded).Events[0].Data, &data)
+	if data != (OfferQuantityEvent{Charger: "charger1", Offer: "5", Seller: "sam", Quantity: wholeAmount(20), Available: wholeAmount(120)}) {
+		t.Fatalf("event data = %+v", data)
+	}
+
+	// Called directly the event is set right away
+	s.events = nil
+	subtractOfferQuantity(s, []string{"charger1", "5", "30"})
+	json.Unmarshal(s.lastEvent(t, eventOfferQuantitySubtracted).Events[0].Data, &data)
+	if data != (OfferQuantityEvent{Charger: "charger1", Offer: "5", Seller: "sam", Quantity: wholeAmount(30), Available: wholeAmount(90)}) {
+		t.Fatalf("event data = %+v", data)
+	}
+
+	// Subtracting more than the seller has reports what was taken back
+	s.mustInvoke(t, "sam", "subtractOfferQuantity", "charger1", "5", "500")
+	json.Unmarshal(s.lastEvent(t, eventOfferQuantitySubtracted).Events[0].Data, &data)
+	if data != (OfferQuantityEvent{Charger: "charger1", Offer: "5", Seller: "sam", Quantity: wholeAmount(90), Available: 0}) {
+		t.Fatalf("event data = %+v", data)
+	}
+}
+
+func TestCustomerFundsEvent(t *testing.T) {
+	s := newMarket(t)
+	var data CustomerFundsEvent
+
+	s.mustInvoke(t, "admin", "addCustomerFunds", "james", "5")
+	json.Unmarshal(s.lastEvent(t, eventCustomerFundsAdded).Events[0].Data, &data)
+	if data != (CustomerFundsEvent{Customer: "james", Amount: wholeAmount(5), Balance: wholeAmount(10005)}) {
+		t.Fatalf("event data = %+v", data)
+	}
+}
+
+func TestTransactionEvents(t *testing.T) {
+	s := newMarket(t)
+	var data TransactionEvent
+	var cancelled TransactionCancelledEvent
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "6", "100")
+
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "150")
+	json.Unmarshal(s.lastEvent(t, eventOfferAccepted).Events[0].Data, &data)
+	if data.Transaction.Buyer != "james" || data.Transaction.Energy != wholeAmount(150) || data.Transaction.Cost != wholeAmount(800) || data.Transaction.Status != "Pending" {
+		t.Fatalf("event data = %+v", data)
+	}
+
+	s.mustInvoke(t, "charger1", "cancelTransaction", "charger1", "60")
+	json.Unmarshal(s.lastEvent(t, eventTransactionCancelled).Events[0].Data, &cancelled)
+	if cancelled.UnitsRefunded != wholeAmount(60) || cancelled.AmountRefunded != wholeAmount(350) || cancelled.Transaction.Energy != wholeAmount(90) || cancelled.Transaction.TXID != 1 {
+		t.Fatalf("event data = %+v", cancelled)
+	}
+
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "10")
+	s.mustInvoke(t, "charger1", "completeTransaction", "charger1")
+	json.Unmarshal(s.lastEvent(t, eventTransactionCompleted).Events[0].Data, &data)
+	if data.Transaction.TXID != 2 || data.Transaction.Status != "Completed" || data.Transaction.Timestamp != s.now {
+		t.Fatalf("event data = %+v", data)
+	}
+
+	// An offer accepted after the pending transaction expired is still under the same event name
+	s.mustInvoke(t, "admin", "setPendingTimeout", "5")
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "10")
+	s.now += 10
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "10")
+	s.lastEvent(t, eventTransactionExpired, eventOfferAccepted)
+}
+
+func TestBidFillEventsAreAppended(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "james", "placeBid", "charger1", "james", "10", "5", s.later())
+	if len(s.events) != 0 {
+		t.Fatal("resting bid set an event")
+	}
+
+	// Adding the offer fills the bid in the same invocation
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+	s.lastEvent(t, eventOfferQuantityAdded, eventOfferAccepted)
+
+	s.mustInvoke(t, "charger1", "completeTransaction", "charger1")
+	s.lastEvent(t, eventTransactionCompleted)
+}
+
+func TestNoEventOnFailure(t *testing.T) {
+	s := newMarket(t)
+	// Called without the helper, which drops the events of failed invocations itself
+	s.caller, s.events = "james", nil
+	if _, err := testChaincode.Invoke(s, "acceptOffer", []string{"charger1", "james", "10"}); err == nil {
+		t.Fatal("expected acceptOffer to fail without offers")
+	}
+	if len(s.events) != 0 {
+		t.Fatalf("failed invoke set %d events", len(s.events))
+	}
+
+	// Invocations without changes to report set no event
+	s.mustInvoke(t, "admin", "addCustomer", "ross")
+	if len(s.events) != 0 {
+		t.Fatalf("addCustomer set %d events", len(s.events))
+	}
+}
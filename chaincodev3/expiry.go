@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var pendingTimeoutKey = "_pendingtimeout" // key for the seconds a pending transaction may stay open
+var defaultPendingTimeout int64 = 86400   // used until setPendingTimeout is invoked
+
+// Result of expirePendingTransactions
+type ExpiryResult struct {
+	Expired	[]string		`json:"expired"`
+	Failed	[]ExpiryFailure	`json:"failed"`
+}
+
+// Charger whose pending transaction could not be expired, with the error it failed with
+type ExpiryFailure struct {
+	Charger	string			`json:"charger"`
+	Code	string			`json:"code"`
+	Message	string			`json:"message"`
+	Details	ErrorDetails	`json:"details"`
+}
+
+//////////////////////////////////////// INVOKE FUNCTIONS ////////////////////////////////////////
+
+// Set the timeout given to pending transactions from now on
+func setPendingTimeout(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	var retStr string
+
+	timeout, _ := strconv.ParseInt(args[0], 10, 64)
+
+	// Debug message
+	fmt.Println("Trying to set the pending transaction timeout to " + args[0] + " seconds")
+
+	err := marshalAndPut(stub, pendingTimeoutKey, timeout)
+	if err != nil {
+		retStr = "Could not write pending transaction timeout to chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+
+	// Successful return
+	retStr = "Successfully set the pending transaction timeout to " + args[0] + " seconds"
+	return createInvokeResponse(retStr, timeout)
+
+}
+
+// Expire the pending transactions that have been open longer than their timeout
+// With a charger ID only that charger is checked, otherwise every charger is
+// Checking every charger skips the ones that fail, other than on a chaincode state error, and lists them
+// Those fail before anything is written, so nothing of them is kept
+func expirePendingTransactions(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	var retStr string
+	var chargerIDs []string
+
+	now, err := getTxTimestamp(stub)
+	if err != nil {
+		retStr = "Could not get transaction timestamp"
+		return createInvokeError(codeStateError, retStr)
+	}
+
+	// Find the chargers to check
+	sweep := len(args) == 0 || len(args[0]) == 0
+	if !sweep {
+		chargerIDs = []string{strings.ToLower(args[0])}
+	} else {
+		err = getStateByPartialCompositeKey(stub, pendingTransactionObjectType, []string{}, func(key string, valAsBytes []byte) error {
+			_, attributes := splitCompositeKey(key)
+			chargerIDs = append(chargerIDs, attributes[0])
+			return nil
+		})
+		if err != nil {
+			retStr = "Could not get pending transactions from chaincode state"
+			return createInvokeError(codeStateError, retStr)
+		}
+	}
+
+	// Debug message
+	fmt.Println("Trying to expire the pending transactions of " + strconv.Itoa(len(chargerIDs)) + " chargers")
+
+	result := ExpiryResult{Expired: []string{}, Failed: []ExpiryFailure{}}
+	for _, chargerID := range chargerIDs {
+		charger, err := getCharger(stub, chargerID)
+		ok := false
+		if err == nil {
+			ok, err = expirePendingTransaction(stub, charger, now)
+		}
+		// One charger that can't be expired doesn't keep the others locked
+		if err != nil && sweep && errorCode(err) != codeStateError {
+			fmt.Println("Skipping charger " + chargerID + ": " + err.Error())
+			result.Failed = append(result.Failed, ExpiryFailure{Charger: chargerID, Code: errorCode(err), Message: err.Error(), Details: errorDetails(err)})
+			continue
+		}
+		if err != nil {
+			retStr = "Could not expire the pending transaction of charger " + chargerID + ": " + err.Error()
+			return createInvokeErrorFrom(err, retStr)
+		}
+		if !ok {
+			continue
+		}
+		result.Expired = append(result.Expired, chargerID)
+
+		// The charger is free again and has its units back, resting bids may be filled
+		err = matchBids(stub, chargerID)
+		if err != nil {
+			retStr = "Could not match bids at charger " + chargerID + ": " + err.Error()
+			return createInvokeErrorFrom(err, retStr)
+		}
+	}
+
+	// Successful return
+	retStr = "Successfully expired the pending transactions of " + strconv.Itoa(len(result.Expired)) + " chargers"
+	if len(result.Expired) > 0 {
+		retStr += ": " + strings.Join(result.Expired, ", ")
+	}
+	for _, failure := range result.Failed {
+		retStr += "; could not expire charger " + failure.Charger + ": " + failure.Message
+	}
+	return createInvokeResponse(retStr, result)
+
+}
+
+//////////////////////////////////////// UTILITY FUNCTIONS ////////////////////////////////////////
+
+// Expire the pending transaction of a charger if its timeout has passed at now
+// The buyer is refunded in full and the units go back to their sellers' tiers
+// Returns false if there was nothing to expire
+func expirePendingTransaction(stub shim.ChaincodeStubInterface, charger Charger, now int64) (bool, error) {
+
+	var pendingTransaction []Transaction
+
+	pendingTransactionKey := createCompositeKey(pendingTransactionObjectType, charger.ID)
+	pendingTransactionBytes, err := stub.GetState(pendingTransactionKey)
+	if err != nil {
+		return false, errors.New("Could not get pending transaction of charger " + charger.ID + " from chaincode state")
+	}
+	json.Unmarshal(pendingTransactionBytes, &pendingTransaction)
+	if len(pendingTransaction) == 0 {
+		return false, nil
+	}
+	pt := pendingTransaction[0]
+
+	// Transactions accepted before timeouts existed get the current timeout, counted from the first time they are checked
+	if pt.Accepted == 0 {
+		err = startPendingTimeout(stub, &pendingTransaction[0], now)
+		if err != nil {
+			return false, err
+		}
+		err = marshalAndPut(stub, pendingTransactionKey, pendingTransaction)
+		if err != nil {
+			return false, errors.New("Could not write pending transaction of charger " + charger.ID + " to chaincode state")
+		}
+		return false, nil
+	}
+	timeout := pt.Timeout
+	if timeout == 0 {
+		timeout, err = getPendingTimeout(stub)
+		if err != nil {
+			return false, errors.New("Could not get pending transaction timeout from chaincode state")
+		}
+	}
+	if now < pt.Accepted + timeout {
+		return false, nil
+	}
+
+	fmt.Println("Pending transaction of charger " + charger.ID + " accepted at " + strconv.FormatInt(pt.Accepted, 10) + " has expired")
+
+	// Refund everything
+	unitsRefunded := pt.Energy
+	totalRefund, err := refundPendingTransaction(stub, charger, &pt, pt.Energy)
+	if err != nil {
+		return false, err
+	}
+
+	// Keep the expired transaction in the list of past transactions
+	pt.Status = "Expired"
+	pt.TXID, err = nextTXID(stub)
+	if err != nil {
+		return false, errors.New("Could not get next TXID from chaincode state")
+	}
+	pt.Timestamp = now
+	err = putTransaction(stub, pt)
+	if err != nil {
+		return false, errors.New("Could not write transaction to chaincode state")
+	}
+
+	// Free the charger
+	err = stub.DelState(pendingTransactionKey)
+	if err != nil {
+		return false, errors.New("Could not clear pending transaction of charger " + charger.ID + " in chaincode state")
+	}
+
+	// Tell subscribers about the refund
+	err = emitEvent(stub, eventTransactionExpired, TransactionCancelledEvent{Transaction: pt, UnitsRefunded: unitsRefunded, AmountRefunded: totalRefund})
+	if err != nil {
+		return false, errors.New("Could not emit event: " + err.Error())
+	}
+	return true, nil
+
+}
+
+// Give a pending transaction accepted before timeouts existed the current timeout, starting at now
+func startPendingTimeout(stub shim.ChaincodeStubInterface, pt *Transaction, now int64) (error) {
+	timeout, err := getPendingTimeout(stub)
+	if err != nil {
+		return errors.New("Could not get pending transaction timeout from chaincode state")
+	}
+	pt.Accepted = now
+	pt.Timeout = timeout
+	return nil
+}
+
+// Get the timeout given to new pending transactions, in seconds
+func getPendingTimeout(stub shim.ChaincodeStubInterface) (int64, error) {
+
+	var timeout int64
+
+	timeoutBytes, err := stub.GetState(pendingTimeoutKey)
+	if err != nil {
+		return 0, err
+	}
+	if len(timeoutBytes) == 0 {
+		return defaultPendingTimeout, nil
+	}
+	json.Unmarshal(timeoutBytes, &timeout)
+	return timeout, nil
+
+}
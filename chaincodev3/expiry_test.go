@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestSetPendingTimeout(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+
+	s.mustInvoke(t, "admin", "setPendingTimeout", "60")
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "10")
+	if pt := s.pending(t, "charger1")[0]; pt.Timeout != 60 {
+		t.Fatalf("timeout = %d, want 60", pt.Timeout)
+	}
+
+	expectError(t, s.mustFail(t, "admin", "setPendingTimeout"), "Expecting 1")
+	expectError(t, s.mustFail(t, "admin", "setPendingTimeout", "0"), "First argument (timeout in seconds) must be an integer string greater than 0")
+	expectError(t, s.mustFail(t, "admin", "setPendingTimeout", "soon"), "First argument (timeout in seconds) must be an integer string")
+	expectError(t, s.mustFail(t, "james", "setPendingTimeout", "1"), "requires role admin")
+}
+
+func TestExpirePendingTransactions(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "admin", "addCharger", "charger2", "sam")
+	s.mustInvoke(t, "admin", "addCustomer", "ross")
+	s.mustInvoke(t, "admin", "addCustomerFunds", "ross", "1000")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "6", "100")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger2", "5", "100")
+	s.mustInvoke(t, "admin", "setPendingTimeout", "10")
+
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "150")
+	accepted := s.now
+	s.mustInvoke(t, "admin", "setPendingTimeout", "100")
+	s.mustInvoke(t, "ross", "acceptOffer", "charger2", "ross", "10")
+
+	// Nothing is due yet
+	retStr := s.mustInvoke(t, "james", "expirePendingTransactions")
+	expectError(t, retStr, "Successfully expired the pending transactions of 0 chargers")
+	if len(s.events) != 0 {
+		t.Fatal("expiring nothing set an event")
+	}
+
+	// charger1 keeps the timeout it was accepted with, the next invocation runs 10 seconds after it
+	s.now = accepted + 9
+	retStr = s.mustInvoke(t, "charger1", "expirePendingTransactions", "charger1")
+	expectError(t, retStr, "of 1 chargers: charger1")
+	if len(s.pending(t, "charger1")) != 0 || len(s.pending(t, "charger2")) != 1 {
+		t.Fatal("wrong pending transactions expired")
+	}
+	expectInts(t, "offers", s.offers(t, "charger1"), map[string]int{"5": 100, "6": 100})
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 50, "james": 10000, "ross": 950})
+	tx := s.transactions(t)[0]
+	if tx.TXID != 1 || tx.Status != "Expired" || tx.Timestamp != s.now || tx.Energy != 0 || tx.Cost != 0 || tx.Buyer != "james" {
+		t.Fatalf("expired transaction = %+v", tx)
+	}
+	var data TransactionCancelledEvent
+	json.Unmarshal(s.lastEvent(t, eventTransactionExpired).Events[0].Data, &data)
+	if data.UnitsRefunded != wholeAmount(150) || data.AmountRefunded != wholeAmount(800) {
+		t.Fatalf("event data = %+v", data)
+	}
+
+	s.now = accepted + 200
+	retStr = s.mustInvoke(t, "admin", "expirePendingTransactions", "")
+	expectError(t, retStr, "of 1 chargers: charger2")
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 0, "james": 10000, "ross": 1000})
+
+	expectError(t, s.mustFail(t, "admin", "expirePendingTransactions", "charger9"), "Charger charger9 does not exist")
+	expectError(t, s.mustFail(t, "admin", "expirePendingTransactions", "a", "b"), "Expecting 0 or 1")
+	expectError(t, s.mustFail(t, "stranger", "expirePendingTransactions"), "stranger is not allowed to call expirePendingTransactions")
+}
+
+func TestExpiredTransactionsFillBids(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "admin", "addCustomer", "ross")
+	s.mustInvoke(t, "admin", "addCustomerFunds", "ross", "1000")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+	s.mustInvoke(t, "admin", "setPendingTimeout", "10")
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "100")
+	s.mustInvoke(t, "ross", "placeBid", "charger1", "ross", "40", "5", s.later())
+
+	s.now += 10
+	s.mustInvoke(t, "sam", "expirePendingTransactions")
+	s.lastEvent(t, eventTransactionExpired, eventOfferAccepted)
+	pt := s.pending(t, "charger1")[0]
+	if pt.Buyer != "ross" || pt.Energy != wholeAmount(40) || pt.Timeout != 10 {
+		t.Fatalf("bid fill = %+v", pt)
+	}
+}
+
+func TestAcceptOfferExpiresStalePendingTransaction(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "admin", "addCustomer", "ross")
+	s.mustInvoke(t, "admin", "addCustomerFunds", "ross", "1000")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+	s.mustInvoke(t, "admin", "setPendingTimeout", "10")
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "100")
+
+	expectError(t, s.mustFail(t, "ross", "acceptOffer", "charger1", "ross", "10"), "There is already a pending transaction")
+	s.now += 10
+	s.mustInvoke(t, "ross", "acceptOffer", "charger1", "ross", "10")
+	s.lastEvent(t, eventTransactionExpired, eventOfferAccepted)
+	if pt := s.pending(t, "charger1")[0]; pt.Buyer != "ross" {
+		t.Fatalf("pending transaction = %+v", pt)
+	}
+	if tx := s.transactions(t)[0]; tx.Status != "Expired" || tx.Buyer != "james" {
+		t.Fatalf("expired transaction = %+v", tx)
+	}
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 50, "james": 10000, "ross": 950})
+}
+
+func TestPendingTransactionWithoutTimeoutGetsOne(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "10")
+	s.mustInvoke(t, "admin", "setPendingTimeout", "60")
+
+	// Accepted before timeouts were recorded
+	var pending []Transaction
+	json.Unmarshal(s.state[createCompositeKey(pendingTransactionObjectType, "charger1")], &pending)
+	pending[0].Accepted, pending[0].Timeout = 0, 0
+	marshalAndPut(s, createCompositeKey(pendingTransactionObjectType, "charger1"), pending)
+
+	// The first sweep starts its timeout instead of expiring it
+	expectError(t, s.mustInvoke(t, "james", "expirePendingTransactions"), "of 0 chargers")
+	pt := s.pending(t, "charger1")[0]
+	if pt.Accepted != s.now || pt.Timeout != 60 {
+		t.Fatalf("pending transaction = %+v", pt)
+	}
+	s.now += 58
+	expectError(t, s.mustInvoke(t, "james", "expirePendingTransactions"), "of 0 chargers")
+	expectError(t, s.mustInvoke(t, "james", "expirePendingTransactions"), "of 1 chargers: charger1")
+}
+
+func TestExpirySweepSkipsWhatItCannotRefund(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "admin", "addCharger", "charger2", "james")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "10")
+	s.mustInvoke(t, "james", "addOfferQuantity", "charger2", "5", "10")
+	s.mustInvoke(t, "admin", "setPendingTimeout", "10")
+
+	// sam is paid on acceptance and spends it, so the refund can't be taken back
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "10")
+	s.mustInvoke(t, "sam", "transferFunds", "sam", "james", "40")
+	s.mustInvoke(t, "james", "acceptOffer", "charger2", "james", "2")
+
+	// The sweep skips that charger and still expires the others
+	s.now += 10
+	var result ExpiryResult
+	retStr := s.invokeData(t, &result, "admin", "expirePendingTransactions")
+	expectError(t, retStr, "of 1 chargers: charger2; could not expire charger charger1: Seller sam does not have enough funds to refund 50")
+	if len(result.Expired) != 1 || result.Expired[0] != "charger2" || len(result.Failed) != 1 {
+		t.Fatalf("expirePendingTransactions returned %+v", result)
+	}
+	if f := result.Failed[0]; f.Charger != "charger1" || f.Code != codeInsufficientFunds {
+		t.Fatalf("failure = %+v", f)
+	}
+	expectDetails(t, "failure", result.Failed[0].Details, ErrorDetails{"customer": "sam", "required": wholeAmount(50), "available": wholeAmount(10)})
+	if len(s.pending(t, "charger1")) != 1 || len(s.pending(t, "charger2")) != 0 {
+		t.Fatal("wrong pending transactions expired")
+	}
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 10, "james": 9990})
+
+	// Asked for that charger alone, the error is returned
+	s.mustFailWith(t, codeInsufficientFunds, "admin", "expirePendingTransactions", "charger1")
+}
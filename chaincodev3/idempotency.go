@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var idempotencyObjectType = "idempotency"          // idempotency~function~caller~key -> IdempotencyRecord
+var idempotencyWindowKey = "_idempotencywindow"    // key for the seconds an idempotency key is remembered
+var defaultIdempotencyWindow int64 = 86400         // used until setIdempotencyWindow is invoked
+
+// Result of an invocation made with an idempotency key
+// Args are the arguments without the key, a repeat must pass the same ones to get the response back
+type IdempotencyRecord struct {
+	Function	string			`json:"function"`
+	Caller		string			`json:"caller"`
+	Key			string			`json:"key"`
+	Args		[]string		`json:"args"`
+	Response	json.RawMessage	`json:"response"`
+	Recorded	int64			`json:"recorded"`
+	Expires		int64			`json:"expires"`
+}
+
+//////////////////////////////////////// INVOKE FUNCTIONS ////////////////////////////////////////
+
+// Set how long idempotency keys used from now on are remembered
+func setIdempotencyWindow(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	var retStr string
+
+	window, _ := strconv.ParseInt(args[0], 10, 64)
+
+	// Debug message
+	fmt.Println("Trying to set the idempotency window to " + args[0] + " seconds")
+
+	err := marshalAndPut(stub, idempotencyWindowKey, window)
+	if err != nil {
+		retStr = "Could not write idempotency window to chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+
+	// Successful return
+	retStr = "Successfully set the idempotency window to " + args[0] + " seconds"
+	return createInvokeResponse(retStr, window)
+
+}
+
+// Delete the idempotency keys whose window has passed
+// A key is only looked up when its caller uses it again, so keys that are never reused stay in the chaincode state until this is invoked
+func purgeIdempotencyKeys(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	var retStr string
+
+	// Debug message
+	fmt.Println("Trying to purge the expired idempotency keys")
+
+	now, err := getTxTimestamp(stub)
+	if err != nil {
+		retStr = "Could not get transaction timestamp"
+		return createInvokeError(codeStateError, retStr)
+	}
+	purged, err := deleteExpiredIdempotencyRecords(stub, now)
+	if err != nil {
+		retStr = "Could not delete expired idempotency keys from chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+
+	// Successful return
+	retStr = "Successfully purged " + strconv.Itoa(purged) + " expired idempotency keys"
+	return createInvokeResponse(retStr, purged)
+
+}
+
+//////////////////////////////////////// UTILITY FUNCTIONS ////////////////////////////////////////
+
+// Wrap the handler of an invoke function that takes an optional idempotency key as argument keyArg
+// The response of the first successful invocation with a key is kept for the idempotency window,
+// repeats by the same caller with the same key and arguments get it back without running the function again
+// Only the caller's own record is read, records of keys that are never used again are deleted with purgeIdempotencyKeys
+func idempotent(function string, keyArg int, handler func(stub shim.ChaincodeStubInterface, args []string) ([]byte, error)) (func(stub shim.ChaincodeStubInterface, args []string) ([]byte, error)) {
+	return func(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+		var retStr string
+		var record IdempotencyRecord
+
+		// Without a key every invocation is applied
+		if len(args) <= keyArg || len(args[keyArg]) == 0 {
+			return handler(stub, args)
+		}
+		key := args[keyArg]
+		keyedArgs := trimArguments(args[:keyArg])
+
+		now, err := getTxTimestamp(stub)
+		if err != nil {
+			retStr = "Could not get transaction timestamp"
+			return createInvokeError(codeStateError, retStr)
+		}
+		callerID, err := getCallerID(stub)
+		if err != nil {
+			retStr = err.Error()
+			return createInvokeErrorFrom(err, retStr)
+		}
+
+		// A key that is still remembered returns the first response
+		// A key whose window has passed is new again, its record is overwritten below
+		recordKey := createCompositeKey(idempotencyObjectType, function, callerID, key)
+		recordBytes, err := stub.GetState(recordKey)
+		if err != nil {
+			retStr = "Could not get idempotency key " + key + " from chaincode state"
+			return createInvokeError(codeStateError, retStr)
+		}
+		json.Unmarshal(recordBytes, &record)
+		if len(recordBytes) > 0 && now < record.Expires {
+			if !equalArguments(record.Args, keyedArgs) {
+				retStr = "Idempotency key " + key + " was already used for " + function + " with different arguments"
+				return createInvokeErrorDetails(codeIdempotencyKeyReused, retStr, ErrorDetails{"function": function, "key": key})
+			}
+			fmt.Println("Idempotency key " + key + " was already used for " + function + ", returning the first response")
+			return record.Response, nil
+		}
+
+		// Only successful invocations are remembered, a failed one can be retried with the same key
+		retBytes, err := handler(stub, args)
+		if err != nil {
+			return retBytes, err
+		}
+		window, err := getIdempotencyWindow(stub)
+		if err != nil {
+			retStr = "Could not get idempotency window from chaincode state"
+			return createInvokeError(codeStateError, retStr)
+		}
+		record = IdempotencyRecord{Function: function, Caller: callerID, Key: key, Args: keyedArgs, Response: retBytes, Recorded: now, Expires: now + window}
+		err = marshalAndPut(stub, recordKey, record)
+		if err != nil {
+			retStr = "Could not write idempotency key " + key + " to chaincode state"
+			return createInvokeError(codeStateError, retStr)
+		}
+		return retBytes, nil
+
+	}
+}
+
+// Delete the idempotency records of every function and caller whose window has passed at now
+// Returns the number of records deleted
+func deleteExpiredIdempotencyRecords(stub shim.ChaincodeStubInterface, now int64) (int, error) {
+
+	var expired []string
+	err := getStateByPartialCompositeKey(stub, idempotencyObjectType, nil, func(key string, valAsBytes []byte) error {
+		var record IdempotencyRecord
+		json.Unmarshal(valAsBytes, &record)
+		if now >= record.Expires {
+			expired = append(expired, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// Deleted once the range query is done, not while it is running
+	for _, key := range expired {
+		err = stub.DelState(key)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(expired), nil
+
+}
+
+// Get how long new idempotency keys are remembered, in seconds
+func getIdempotencyWindow(stub shim.ChaincodeStubInterface) (int64, error) {
+
+	var window int64
+
+	windowBytes, err := stub.GetState(idempotencyWindowKey)
+	if err != nil {
+		return 0, err
+	}
+	if len(windowBytes) == 0 {
+		return defaultIdempotencyWindow, nil
+	}
+	json.Unmarshal(windowBytes, &window)
+	return window, nil
+
+}
+
+// Drop trailing empty arguments, which are the same as leaving optional arguments out
+func trimArguments(args []string) ([]string) {
+	n := len(args)
+	for n > 0 && len(args[n-1]) == 0 {
+		n--
+	}
+	return append([]string{}, args[:n]...)
+}
+
+func equalArguments(a []string, b []string) (bool) {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
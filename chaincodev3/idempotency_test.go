@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestIdempotentFunds(t *testing.T) {
+	s := newMarket(t)
+
+	first, err := s.invoke("admin", "addCustomerFunds", "james", "500", "deposit-1")
+	if err != nil {
+		t.Fatalf("addCustomerFunds failed: %v", err)
+	}
+	s.lastEvent(t, eventCustomerFundsAdded)
+
+	// A retry gets the first response back without adding the funds again or telling subscribers
+	repeat, err := s.invoke("admin", "addCustomerFunds", "JAMES", "500", "deposit-1")
+	if err == nil {
+		t.Fatalf("retry with different arguments returned %s", repeat)
+	}
+	repeat, err = s.invoke("admin", "addCustomerFunds", `{"customer": "james", "amount": 500, "idempotencyKey": "deposit-1"}`)
+	if err != nil || string(repeat) != string(first) {
+		t.Fatalf("retry returned %s, %v, want %s", repeat, err, first)
+	}
+	if len(s.events) != 0 {
+		t.Fatalf("retry set events %+v", s.events)
+	}
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 0, "james": 10500})
+
+	// Other keys, and invocations without a key, are applied
+	s.mustInvoke(t, "admin", "addCustomerFunds", "james", "500", "deposit-2")
+	s.mustInvoke(t, "admin", "addCustomerFunds", "james", "500")
+	s.mustInvoke(t, "admin", "addCustomerFunds", "james", "500", "")
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 0, "james": 12000})
+
+	details := s.mustFailDetails(t, codeIdempotencyKeyReused, "admin", "addCustomerFunds", "james", "600", "deposit-1")
+	expectDetails(t, "addCustomerFunds", details, ErrorDetails{"function": "addCustomerFunds", "key": "deposit-1"})
+
+	// Failures are not remembered, so they can be retried with the same key
+	s.mustFailWith(t, codeUnknownCustomer, "admin", "addCustomerFunds", "ross", "100", "deposit-3")
+	s.mustInvoke(t, "admin", "addCustomer", "ross")
+	s.mustInvoke(t, "admin", "addCustomerFunds", "ross", "100", "deposit-3")
+	s.mustInvoke(t, "admin", "addCustomerFunds", "ross", "100", "deposit-3")
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 0, "james": 12000, "ross": 100})
+}
+
+func TestIdempotentPurchase(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+
+	var tx, repeat Transaction
+	s.invokeData(t, &tx, "james", "acceptOffer", "charger1", "james", "10", "", "", "purchase-1")
+	s.invokeData(t, &repeat, "james", "acceptOffer", `{"charger": "charger1", "customer": "james", "quantity": 10, "idempotencyKey": "purchase-1"}`)
+	if repeat.Accepted != tx.Accepted || repeat.Cost != wholeAmount(50) {
+		t.Fatalf("retry returned %+v, want %+v", repeat, tx)
+	}
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 50, "james": 9950})
+
+	// Without the key the charger is busy
+	s.mustFailWith(t, codePendingTXExists, "james", "acceptOffer", "charger1", "james", "10")
+
+	// Keys are kept apart by function
+	s.mustInvoke(t, "admin", "addCustomerFunds", "james", "50", "purchase-1")
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 50, "james": 10000})
+
+	// and by caller, another buyer's key doesn't return james' purchase
+	s.mustInvoke(t, "admin", "addCharger", "charger2", "sam")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger2", "5", "100")
+	s.mustInvoke(t, "admin", "addCustomerFunds", "sam", "50")
+	s.invokeData(t, &repeat, "sam", "acceptOffer", "charger2", "sam", "10", "", "", "purchase-1")
+	if repeat.Buyer != "sam" || repeat.Charger != "charger2" {
+		t.Fatalf("purchase of sam returned %+v", repeat)
+	}
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 100, "james": 10000})
+}
+
+func TestIdempotencyWindow(t *testing.T) {
+	s := newMarket(t)
+
+	s.mustInvoke(t, "admin", "setIdempotencyWindow", "60")
+	s.mustInvoke(t, "admin", "addCustomerFunds", "james", "500", "deposit-1")
+	used := s.now
+
+	s.now = used + 58
+	s.mustInvoke(t, "admin", "addCustomerFunds", "james", "500", "deposit-1")
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 0, "james": 10500})
+
+	// Once the window has passed the key is new again, even with other arguments
+	s.mustInvoke(t, "admin", "addCustomerFunds", "james", "250", "deposit-1")
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 0, "james": 10750})
+
+	// Using a key only reads the caller's own record, keys that are not used again stay until they are purged
+	s.mustInvoke(t, "admin", "addCustomerFunds", "james", "1", "deposit-2")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "10")
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "1", "", "", "purchase-1")
+	s.now += 60
+	s.mustInvoke(t, "admin", "addCustomerFunds", "james", "1", "deposit-3")
+	if _, ok := s.state[createCompositeKey(idempotencyObjectType, "addCustomerFunds", "admin", "deposit-2")]; !ok {
+		t.Fatal("idempotency key of another invocation was deleted")
+	}
+	var purged int
+	s.invokeData(t, &purged, "admin", "purgeIdempotencyKeys")
+	if purged != 3 {
+		t.Fatalf("purgeIdempotencyKeys purged %d keys, want 3", purged)
+	}
+	for _, key := range []string{"deposit-1", "deposit-2", "deposit-3"} {
+		_, ok := s.state[createCompositeKey(idempotencyObjectType, "addCustomerFunds", "admin", key)]
+		if ok != (key == "deposit-3") {
+			t.Fatalf("idempotency key %s kept = %v after the purge", key, ok)
+		}
+	}
+	if _, ok := s.state[createCompositeKey(idempotencyObjectType, "acceptOffer", "james", "purchase-1")]; ok {
+		t.Fatal("expired idempotency key of acceptOffer was not purged")
+	}
+	expectError(t, s.mustFail(t, "james", "purgeIdempotencyKeys"), "requires role admin")
+
+	expectError(t, s.mustFail(t, "admin", "setIdempotencyWindow", "0"), "First argument (window in seconds) must be an integer string greater than 0")
+	expectError(t, s.mustFail(t, "james", "setIdempotencyWindow", "1"), "requires role admin")
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var invariantSeed = flag.Int64("invariant.seed", 1, "seed of the randomized invariant tests")
+var invariantRuns = flag.Int("invariant.runs", 200, "number of random sequences checked by the invariant tests")
+
+// Customers, sellers and chargers of the random market
+var marketBuyers = []string{"james", "ross", "sam", "alice"}
+var marketSellers = []string{"sam", "alice"}
+var marketChargers = []string{"charger1", "charger2"}
+var marketPendingTimeout = 60 // short, so that time passing in a sequence expires pending transactions
+
+// Step of a sequence that lets time pass instead of invoking a function
+var advanceTime = "advanceTime"
+
+// One invocation of a random sequence
+type marketOp struct {
+	caller		string
+	function	string
+	args		[]string
+}
+
+func (op marketOp) String() string {
+	return op.caller + " " + op.function + " [" + strings.Join(op.args, " ") + "]"
+}
+
+// Deposits made outside of trading, the customers' balances and payouts must always add up to them
+type marketLedger struct {
+	deposits	Amount
+	offered		Amount
+}
+
+// Deploy the market the random sequences run against
+// sam owns charger1 and alice charger2, both also sell at the other's charger
+func newRandomMarket(t *testing.T) (*mockStub, marketLedger) {
+	s := newMarket(t)
+	s.mustInvoke(t, "admin", "addCustomer", "ross")
+	s.mustInvoke(t, "admin", "addCustomer", "alice")
+	s.mustInvoke(t, "admin", "addCustomerFunds", "ross", "2000")
+	s.mustInvoke(t, "admin", "addCharger", "charger2", "alice")
+	s.mustInvoke(t, "admin", "setPendingTimeout", strconv.Itoa(marketPendingTimeout))
+	return s, marketLedger{deposits: wholeAmount(12000)}
+}
+
+// Random decimal string with up to places decimal places, between 1 and max
+func randomAmount(r *rand.Rand, max int, places int) string {
+	scale := []int64{1, 10, 100, 1000, 10000}[places]
+	return (Amount(1 + r.Int63n(int64(max) * scale)) * amountOne / Amount(scale)).String()
+}
+
+// Generate a random sequence of trading invocations
+// Some of them are invalid on purpose, they must fail without changing anything
+// Prices and units are fractional, so costs and refunds are rounded
+// Time passes now and then, so pending transactions expire through expirePendingTransactions or acceptOffer
+func randomSequence(r *rand.Rand, n int) []marketOp {
+	ops := make([]marketOp, n)
+	for i := range ops {
+		charger := marketChargers[r.Intn(len(marketChargers))]
+		switch r.Intn(10) {
+		case 0:
+			customer := marketBuyers[r.Intn(len(marketBuyers))]
+			ops[i] = marketOp{"admin", "addCustomerFunds", []string{customer, strconv.Itoa(r.Intn(500))}}
+		case 1:
+			seller := marketSellers[r.Intn(len(marketSellers))]
+			ops[i] = marketOp{seller, "addOfferQuantity", []string{charger, randomAmount(r, 9, 2), randomAmount(r, 100, 1), seller}}
+		case 2:
+			buyer := marketBuyers[r.Intn(len(marketBuyers))]
+			args := []string{charger, buyer, randomAmount(r, 200, 3)}
+			if r.Intn(2) == 0 {
+				args = append(args, randomAmount(r, 9, 2), []string{fillOrKill, partialFill}[r.Intn(2)])
+			}
+			ops[i] = marketOp{buyer, "acceptOffer", args}
+		case 3:
+			ops[i] = marketOp{charger, "completeTransaction", []string{charger}}
+		case 4:
+			ops[i] = marketOp{charger, "cancelTransaction", []string{charger, randomAmount(r, 100, 4)}}
+		case 5:
+			customer := marketBuyers[r.Intn(len(marketBuyers))]
+			ops[i] = marketOp{customer, "withdrawFunds", []string{customer, strconv.Itoa(1 + r.Intn(1000))}}
+		case 6:
+			ops[i] = marketOp{"admin", []string{"confirmPayout", "rejectPayout"}[r.Intn(2)], []string{strconv.Itoa(1 + r.Intn(5))}}
+		case 7:
+			sender := marketBuyers[r.Intn(len(marketBuyers))]
+			receiver := marketBuyers[r.Intn(len(marketBuyers))]
+			ops[i] = marketOp{sender, "transferFunds", []string{sender, receiver, strconv.Itoa(1 + r.Intn(1000))}}
+		case 8:
+			ops[i] = marketOp{"", advanceTime, []string{strconv.Itoa(marketPendingTimeout / 2 + r.Intn(2 * marketPendingTimeout))}}
+		case 9:
+			ops[i] = marketOp{charger, "expirePendingTransactions", []string{}}
+		}
+	}
+	return ops
+}
+
+// Run a sequence on a new market and check the invariants after every step
+// Returns the index of the step that broke an invariant and what broke, or -1
+func runSequence(t *testing.T, ops []marketOp) (int, string) {
+	s, ledger := newRandomMarket(t)
+	for i, op := range ops {
+		if op.function == advanceTime {
+			seconds, _ := strconv.ParseInt(op.args[0], 10, 64)
+			s.now += seconds
+			continue
+		}
+		_, err := s.invoke(op.caller, op.function, op.args...)
+		if err == nil {
+			switch op.function {
+			case "addCustomerFunds":
+				amount, _ := parseAmount(op.args[1])
+				ledger.deposits += amount
+			case "addOfferQuantity":
+				units, _ := parseAmount(op.args[2])
+				ledger.offered += units
+			}
+		}
+		if msg := checkInvariants(t, s, ledger); len(msg) > 0 {
+			return i, msg
+		}
+	}
+	return -1, ""
+}
+
+// Check that no money or energy was created or lost and that nothing is negative
+func checkInvariants(t *testing.T, s *mockStub, ledger marketLedger) string {
+
+	// Money only moves between customers, or out of the market through payouts that are not rejected
+	var customers map[string]Amount
+	s.query(t, &customers, "getCustomers")
+	var balances, paidOut Amount
+	for customer, balance := range customers {
+		if balance < 0 {
+			return fmt.Sprintf("balance of %s is %s", customer, balance)
+		}
+		balances += balance
+	}
+	for _, payout := range s.payouts(t) {
+		if payout.Status != payoutRejected {
+			paidOut += payout.Amount
+		}
+	}
+	if balances + paidOut != ledger.deposits {
+		return fmt.Sprintf("balances add up to %s and payouts to %s, deposits to %s", balances, paidOut, ledger.deposits)
+	}
+
+	// Every balance is accounted for by the customer's ledger entries
+	for customer, balance := range customers {
+		entries, err := getLedgerEntries(s, customer)
+		if err != nil {
+			t.Fatalf("ledger of %s: %v", customer, err)
+		}
+		var running Amount
+		for _, entry := range entries {
+			running += entry.Amount
+			if entry.Balance != running {
+				return fmt.Sprintf("ledger entry %d of %s has balance %s, the entries add up to %s", entry.EntryID, customer, entry.Balance, running)
+			}
+		}
+		if running != balance {
+			return fmt.Sprintf("ledger entries of %s add up to %s, balance is %s", customer, running, balance)
+		}
+	}
+
+	// Every unit offered is either still for sale or sold, pending or not
+	var remaining, sold Amount
+	for _, chargerID := range marketChargers {
+		var tiers map[string]map[string]Amount
+		s.query(t, &tiers, "getOfferTiers", chargerID)
+		for price, tier := range tiers {
+			for seller, units := range tier {
+				if units <= 0 {
+					return fmt.Sprintf("%s has %s units at %s at charger %s", seller, units, price, chargerID)
+				}
+				remaining += units
+			}
+		}
+		for _, pt := range s.pending(t, chargerID) {
+			sold += pt.Energy
+		}
+	}
+	for _, tx := range s.transactions(t) {
+		if tx.Energy < 0 || tx.Cost < 0 {
+			return fmt.Sprintf("transaction %d has %s units for %s", tx.TXID, tx.Energy, tx.Cost)
+		}
+		sold += tx.Energy
+	}
+	if remaining + sold != ledger.offered {
+		return fmt.Sprintf("%s units remain and %s were sold, %s were offered", remaining, sold, ledger.offered)
+	}
+
+	// The audit re-derives the same and must not find anything either
+	var report AuditReport
+	s.query(t, &report, "auditLedger")
+	if !report.Consistent || len(report.InjectedTransactions) > 0 {
+		return fmt.Sprintf("audit found %+v", report.Discrepancies)
+	}
+	return ""
+
+}
+
+// Shrink a failing sequence until removing any single step makes it pass
+// Larger chunks are tried first so long sequences shrink quickly
+func shrinkSequence(ops []marketOp, fails func([]marketOp) bool) []marketOp {
+	for chunk := len(ops) / 2; chunk >= 1; {
+		removed := false
+		for start := 0; start + chunk <= len(ops); {
+			candidate := append(append([]marketOp{}, ops[:start]...), ops[start + chunk:]...)
+			if fails(candidate) {
+				ops = candidate
+				removed = true
+			} else {
+				start += chunk
+			}
+		}
+		if !removed {
+			chunk /= 2
+		}
+	}
+	return ops
+}
+
+func formatSequence(ops []marketOp) string {
+	lines := make([]string, len(ops))
+	for i, op := range ops {
+		lines[i] = fmt.Sprintf("  %d: %s", i, op)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestTradingConservesFundsAndEnergy(t *testing.T) {
+	seed := *invariantSeed
+	r := rand.New(rand.NewSource(seed))
+
+	for run := 0; run < *invariantRuns; run++ {
+		ops := randomSequence(r, 10 + r.Intn(40))
+		step, msg := runSequence(t, ops)
+		if step < 0 {
+			continue
+		}
+
+		// Keep only what is needed to break an invariant
+		minimal := shrinkSequence(ops[:step + 1], func(candidate []marketOp) bool {
+			i, _ := runSequence(t, candidate)
+			return i >= 0
+		})
+		_, msg = runSequence(t, minimal)
+		t.Fatalf("seed %d, run %d: %s after\n%s", seed, run, msg, formatSequence(minimal))
+	}
+}
+
+func TestShrinkSequence(t *testing.T) {
+	// Fails once charger1 has accepted two offers, whatever else happens
+	fails := func(ops []marketOp) bool {
+		accepted := 0
+		for _, op := range ops {
+			if op.function == "acceptOffer" && op.args[0] == "charger1" {
+				accepted++
+			}
+		}
+		return accepted >= 2
+	}
+
+	r := rand.New(rand.NewSource(1))
+	ops := randomSequence(r, 200)
+	if !fails(ops) {
+		t.Fatal("random sequence does not fail, pick another seed")
+	}
+	minimal := shrinkSequence(ops, fails)
+	if len(minimal) != 2 || !fails(minimal) {
+		t.Fatalf("shrunk to\n%s", formatSequence(minimal))
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var ledgerObjectType = "ledger"                 // ledger~customerID~entryID -> LedgerEntry
+var lastLedgerEntryIDKey = "_lastledgerentryid" // key for the ID given to the most recent ledger entry
+
+var maxMemoLength = 256 // longest memo of a transfer
+
+// Types of ledger entries
+var entryDeposit = "deposit"               // addCustomerFunds
+var entryPurchase = "purchase"             // acceptOffer, debit of the buyer
+var entrySale = "sale"                     // acceptOffer, credit of a seller
+var entryRefund = "refund"                 // cancelTransaction and expiry, credit of the buyer and debit of the sellers
+var entryTransfer = "transfer"             // transferFunds
+var entryWithdrawal = "withdrawal"         // withdrawFunds
+var entryPayoutReturned = "payoutReturned" // rejectPayout
+
+// Ledger entry structure
+// A credit (positive amount) or debit (negative amount) of a customer's balance
+// Entry IDs count up across all customers, so they give the order of the entries
+type LedgerEntry struct {
+	EntryID			int64	`json:"entryid"`
+	Customer		string	`json:"customer"`
+	Type			string	`json:"type"`
+	Amount			Amount	`json:"amount"`
+	Balance			Amount	`json:"balance"`
+	Timestamp		int64	`json:"timestamp"`
+	Counterparty	string	`json:"counterparty,omitempty"`
+	Charger			string	`json:"charger,omitempty"`
+	PayoutID		int64	`json:"payoutid,omitempty"`
+	Memo			string	`json:"memo,omitempty"`
+}
+
+// Transfer structure
+// Funds sent from one customer to another, with the balances both are left with
+// Also the data of the fundsTransferred event
+type Transfer struct {
+	Sender			string	`json:"sender"`
+	Receiver		string	`json:"receiver"`
+	Amount			Amount	`json:"amount"`
+	Memo			string	`json:"memo,omitempty"`
+	Timestamp		int64	`json:"timestamp"`
+	SenderBalance	Amount	`json:"senderbalance"`
+	ReceiverBalance	Amount	`json:"receiverbalance"`
+}
+
+// Statement of a customer's account over a time range
+// Opening and closing balance are the balances before the first and after the last entry in the range
+type Statement struct {
+	Customer		string			`json:"customer"`
+	Balance			Amount			`json:"balance"`
+	OpeningBalance	Amount			`json:"openingbalance"`
+	ClosingBalance	Amount			`json:"closingbalance"`
+	Entries			[]LedgerEntry	`json:"entries"`
+}
+
+type QueryResponseStatement struct {
+	Success	bool		`json:"success"`
+	Data	Statement	`json:"data"`
+}
+
+//////////////////////////////////////// QUERY FUNCTIONS ////////////////////////////////////////
+
+// Get the balance of a customer and the credits and debits between two timestamps, both optional and inclusive
+func getCustomerStatement(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	var statement Statement
+	var firstTimestamp, lastTimestamp int64
+
+	// Convert customer ID argument to lowercase
+	statement.Customer = strings.ToLower(args[0])
+	if len(args) > 1 && len(args[1]) > 0 {
+		firstTimestamp, _ = strconv.ParseInt(args[1], 10, 64)
+	}
+	lastTimestamp = math.MaxInt64
+	if len(args) > 2 && len(args[2]) > 0 {
+		lastTimestamp, _ = strconv.ParseInt(args[2], 10, 64)
+	}
+	fmt.Println("Trying to get the statement of " + statement.Customer)
+
+	// Make sure the customer exists
+	customers, err := getCustomerBalances(stub, statement.Customer)
+	if err != nil {
+		return createQueryError(codeStateError, "Failed to get customer")
+	}
+	if _, ok := customers[statement.Customer]; !ok {
+		return createQueryErrorDetails(codeUnknownCustomer, "Customer " + statement.Customer + " does not exist", ErrorDetails{"customer": statement.Customer})
+	}
+	statement.Balance = customers[statement.Customer]
+
+	entries, err := getLedgerEntries(stub, statement.Customer)
+	if err != nil {
+		return createQueryError(codeStateError, "Failed to get ledger entries")
+	}
+
+	// Balances from before the ledger existed have no entries, so the opening and closing
+	// balances come from the entries before and in the range, or the current balance if there are none
+	statement.OpeningBalance = statement.Balance
+	if len(entries) > 0 {
+		statement.OpeningBalance, err = subtractAmounts(entries[0].Balance, entries[0].Amount)
+		if err != nil {
+			return createQueryErrorFrom(err, "Failed to get opening balance")
+		}
+	}
+	statement.ClosingBalance = statement.OpeningBalance
+	statement.Entries = []LedgerEntry{}
+	for _, entry := range entries {
+		if entry.Timestamp > lastTimestamp {
+			break
+		}
+		statement.ClosingBalance = entry.Balance
+		if entry.Timestamp < firstTimestamp {
+			statement.OpeningBalance = entry.Balance
+			continue
+		}
+		statement.Entries = append(statement.Entries, entry)
+	}
+
+	return createQueryResponseStatement(true, statement)
+
+}
+
+//////////////////////////////////////// INVOKE FUNCTIONS ////////////////////////////////////////
+
+// Move funds from one customer's balance to another's
+func transferFunds(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	var retStr string
+	var transfer Transfer
+
+	transfer.Sender = strings.ToLower(args[0])
+	transfer.Receiver = strings.ToLower(args[1])
+	transfer.Amount, _ = parseAmount(args[2])
+	if len(args) > 3 {
+		transfer.Memo = args[3]
+	}
+
+	// Debug message
+	fmt.Println(transfer.Sender + " is trying to transfer " + args[2] + " to " + transfer.Receiver)
+
+	if transfer.Sender == transfer.Receiver {
+		retStr = "Second argument (receiver's customer ID) must not be the sender"
+		return createInvokeError(codeBadArgument, retStr)
+	}
+	if len(transfer.Memo) > maxMemoLength {
+		retStr = "Fourth argument (memo) must be at most " + strconv.Itoa(maxMemoLength) + " bytes"
+		return createInvokeError(codeBadArgument, retStr)
+	}
+
+	// Make sure both customers exist and the sender can cover the transfer
+	customers, err := getCustomerBalances(stub, transfer.Sender, transfer.Receiver)
+	if err != nil {
+		retStr = "Could not get customers " + transfer.Sender + " and " + transfer.Receiver + " from chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+	for _, customerID := range []string{transfer.Sender, transfer.Receiver} {
+		if _, ok := customers[customerID]; !ok {
+			retStr = "Could not find customer " + customerID + " to transfer funds"
+			return createInvokeErrorDetails(codeUnknownCustomer, retStr, ErrorDetails{"customer": customerID})
+		}
+	}
+	if customers[transfer.Sender] < transfer.Amount {
+		retStr = "Sender does not have enough funds: amount = " + transfer.Amount.String() + ", available funds = " + customers[transfer.Sender].String()
+		return createInvokeErrorDetails(codeInsufficientFunds, retStr, ErrorDetails{"customer": transfer.Sender, "required": transfer.Amount, "available": customers[transfer.Sender]})
+	}
+
+	// Move the funds, both customers get an entry in their ledger
+	entries := []LedgerEntry{
+		{Customer: transfer.Sender, Type: entryTransfer, Amount: -transfer.Amount, Counterparty: transfer.Receiver, Memo: transfer.Memo},
+		{Customer: transfer.Receiver, Type: entryTransfer, Amount: transfer.Amount, Counterparty: transfer.Sender, Memo: transfer.Memo},
+	}
+	err = applyLedgerEntries(stub, customers, entries)
+	if err != nil {
+		retStr = "Could not transfer funds: " + err.Error()
+		return createInvokeErrorFrom(err, retStr)
+	}
+	err = putCustomerBalances(stub, customers)
+	if err != nil {
+		retStr = "Could not write customers " + transfer.Sender + " and " + transfer.Receiver + " to chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+	transfer.SenderBalance = customers[transfer.Sender]
+	transfer.ReceiverBalance = customers[transfer.Receiver]
+	transfer.Timestamp, err = getTxTimestamp(stub)
+	if err != nil {
+		retStr = "Could not get transaction timestamp"
+		return createInvokeError(codeStateError, retStr)
+	}
+
+	// Tell subscribers about the new balances
+	err = emitEvent(stub, eventFundsTransferred, transfer)
+	if err != nil {
+		retStr = "Could not emit event: " + err.Error()
+		return createInvokeErrorFrom(err, retStr)
+	}
+
+	// Successful return
+	retStr = "Successfully transferred " + args[2] + " from " + transfer.Sender + " to " + transfer.Receiver
+	return createInvokeResponse(retStr, transfer)
+
+}
+
+//////////////////////////////////////// UTILITY FUNCTIONS ////////////////////////////////////////
+
+// Get the ledger entries of a customer in the order they were written
+func getLedgerEntries(stub shim.ChaincodeStubInterface, customerID string) ([]LedgerEntry, error) {
+
+	entries := []LedgerEntry{}
+	err := getStateByPartialCompositeKey(stub, ledgerObjectType, []string{customerID}, func(key string, valAsBytes []byte) error {
+		var entry LedgerEntry
+		json.Unmarshal(valAsBytes, &entry)
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+
+}
+
+// Write ledger entries in order, each with the balance its customer is left with, and apply them to the balances
+// Balances are the customers' balances before the first entry and must hold every customer with an entry
+// Credits other than refunds and returned payouts must not take a balance above the maximum balance
+// Every entry is checked before any is written, so callers that carry on after an error have nothing to undo
+func applyLedgerEntries(stub shim.ChaincodeStubInterface, balances map[string]Amount, entries []LedgerEntry) (error) {
+
+	timestamp, err := getTxTimestamp(stub)
+	if err != nil {
+		return err
+	}
+	limits, err := getCurrentLimits(stub)
+	if err != nil {
+		return err
+	}
+
+	running := make(map[string]Amount, len(balances))
+	for customerID, balance := range balances {
+		running[customerID] = balance
+	}
+	applied := make([]LedgerEntry, 0, len(entries))
+	for _, entry := range entries {
+		// Nothing moved, nothing to record
+		if entry.Amount == 0 {
+			continue
+		}
+		balance, err := addAmounts(running[entry.Customer], entry.Amount)
+		if err != nil {
+			return err
+		}
+		if entry.Amount > 0 && entry.Type != entryRefund && entry.Type != entryPayoutReturned && balance > limits.MaxBalance {
+			return newChaincodeError(codeLimitExceeded, "Balance of " + entry.Customer + " would be " + balance.String() + ", above the maximum of " + limits.MaxBalance.String(), ErrorDetails{"limit": limitBalance, "value": balance, "max": limits.MaxBalance, "customer": entry.Customer})
+		}
+		running[entry.Customer] = balance
+		entry.Balance = balance
+		entry.Timestamp = timestamp
+		applied = append(applied, entry)
+	}
+
+	for _, entry := range applied {
+		err = putLedgerEntry(stub, entry)
+		if err != nil {
+			return err
+		}
+	}
+	for customerID, balance := range running {
+		balances[customerID] = balance
+	}
+	return nil
+
+}
+
+// Entries for amounts paid to or, if debit is set, taken from customers other than the buyer, in order of customer ID
+func counterpartyEntries(entryType string, amounts map[string]Amount, debit bool, buyer string, chargerID string) ([]LedgerEntry) {
+	customerIDs := make([]string, 0, len(amounts))
+	for customerID := range amounts {
+		customerIDs = append(customerIDs, customerID)
+	}
+	sort.Strings(customerIDs)
+	entries := make([]LedgerEntry, len(customerIDs))
+	for i, customerID := range customerIDs {
+		entries[i] = LedgerEntry{Customer: customerID, Type: entryType, Amount: amounts[customerID], Counterparty: buyer, Charger: chargerID}
+		if debit {
+			entries[i].Amount = -amounts[customerID]
+		}
+	}
+	return entries
+}
+
+// Write a ledger entry with the next entry ID to its own key, ledger~customerID~entryID
+func putLedgerEntry(stub shim.ChaincodeStubInterface, entry LedgerEntry) (error) {
+
+	var lastEntryID int64
+
+	lastEntryIDBytes, err := stub.GetState(lastLedgerEntryIDKey)
+	if err != nil {
+		return err
+	}
+	json.Unmarshal(lastEntryIDBytes, &lastEntryID)
+
+	lastEntryID++
+	err = marshalAndPut(stub, lastLedgerEntryIDKey, lastEntryID)
+	if err != nil {
+		return err
+	}
+	entry.EntryID = lastEntryID
+	return marshalAndPut(stub, createCompositeKey(ledgerObjectType, entry.Customer, fmt.Sprintf("%020d", entry.EntryID)), entry)
+
+}
+
+func createQueryResponseStatement(success bool, data Statement) ([]byte, error) {
+	var response QueryResponseStatement
+	response.Success = success
+	response.Data = data
+	r, _ := json.Marshal(response)
+	return r, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestTransferFunds(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "admin", "addCustomer", "ross")
+
+	var transfer Transfer
+	s.invokeData(t, &transfer, "james", "transferFunds", "James", "Ross", "2500", "top-up for March")
+	if transfer != (Transfer{Sender: "james", Receiver: "ross", Amount: wholeAmount(2500), Memo: "top-up for March", Timestamp: s.now, SenderBalance: wholeAmount(7500), ReceiverBalance: wholeAmount(2500)}) {
+		t.Fatalf("transferFunds returned %+v", transfer)
+	}
+	var data Transfer
+	json.Unmarshal(s.lastEvent(t, eventFundsTransferred).Events[0].Data, &data)
+	if data != transfer {
+		t.Fatalf("fundsTransferred event = %+v", data)
+	}
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 0, "james": 7500, "ross": 2500})
+
+	// Each side has its own ledger entry
+	sent, err := getLedgerEntries(s, "james")
+	if err != nil || len(sent) != 2 || sent[1] != (LedgerEntry{EntryID: 2, Customer: "james", Type: entryTransfer, Amount: wholeAmount(-2500), Balance: wholeAmount(7500), Timestamp: s.now, Counterparty: "ross", Memo: "top-up for March"}) {
+		t.Fatalf("ledger of james = %+v, %v", sent, err)
+	}
+	received, err := getLedgerEntries(s, "ross")
+	if err != nil || len(received) != 1 || received[0].EntryID != 3 || received[0].Amount != wholeAmount(2500) || received[0].Balance != wholeAmount(2500) || received[0].Counterparty != "james" {
+		t.Fatalf("ledger of ross = %+v, %v", received, err)
+	}
+
+	// The memo is optional
+	s.mustInvoke(t, "ross", "transferFunds", "ross", "sam", "2500")
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 2500, "james": 7500, "ross": 0})
+}
+
+func TestTransferFundsFailures(t *testing.T) {
+	s := newMarket(t)
+
+	details := s.mustFailDetails(t, codeInsufficientFunds, "james", "transferFunds", "james", "sam", "10001")
+	expectDetails(t, "transferFunds", details, ErrorDetails{"customer": "james", "required": 10001, "available": 10000})
+	details = s.mustFailDetails(t, codeUnknownCustomer, "james", "transferFunds", "james", "ross", "1")
+	expectDetails(t, "transferFunds to nobody", details, ErrorDetails{"customer": "ross"})
+	expectError(t, s.mustFailWith(t, codeBadArgument, "james", "transferFunds", "james", "JAMES", "1"), "Second argument (receiver's customer ID) must not be the sender")
+	expectError(t, s.mustFailWith(t, codeBadArgument, "james", "transferFunds", "james", "sam", "1", strings.Repeat("x", 257)), "Fourth argument (memo) must be at most 256 bytes")
+	s.mustFailWith(t, codeBadArgument, "james", "transferFunds", "james", "sam", "0")
+	s.mustFailWith(t, codeNotAllowed, "sam", "transferFunds", "james", "sam", "1")
+	s.mustFailWith(t, codeNotAllowed, "admin", "transferFunds", "james", "sam", "1")
+
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 0, "james": 10000})
+	if entries, _ := getLedgerEntries(s, "james"); len(entries) != 1 {
+		t.Fatalf("failed transfers left ledger entries %+v", entries)
+	}
+
+	// A retried transfer is only made once
+	s.mustInvoke(t, "james", "transferFunds", "james", "sam", "100", "", "transfer-1")
+	s.mustInvoke(t, "james", "transferFunds", `{"sender": "james", "receiver": "sam", "amount": 100, "idempotencyKey": "transfer-1"}`)
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 100, "james": 9900})
+}
+
+func TestCustomerStatement(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "admin", "addCustomer", "ross")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+	s.mustInvoke(t, "admin", "addCustomerFunds", "ross", "1000")
+	s.mustInvoke(t, "admin", "addRole", "ross", "seller")
+	s.mustInvoke(t, "ross", "addOfferQuantity", "charger1", "6", "100", "ross")
+	start := s.now
+
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "150")
+	s.mustInvoke(t, "charger1", "cancelTransaction", "charger1", "60")
+	s.mustInvoke(t, "james", "transferFunds", "james", "ross", "500", "thanks")
+	s.mustInvoke(t, "james", "withdrawFunds", "james", "1000")
+	s.mustInvoke(t, "admin", "rejectPayout", "1", "closed")
+	end := s.now
+
+	type line struct {
+		Type	string
+		Amount	string
+		Balance	string
+	}
+	expectStatement := func(what string, statement Statement, balance string, opening string, closing string, want ...line) {
+		got := make([]line, len(statement.Entries))
+		for i, entry := range statement.Entries {
+			got[i] = line{entry.Type, entry.Amount.String(), entry.Balance.String()}
+		}
+		if statement.Balance.String() != balance || statement.OpeningBalance.String() != opening || statement.ClosingBalance.String() != closing || fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("%s: got balance %s, opening %s, closing %s, entries %v, want %s, %s, %s, %v", what, statement.Balance, statement.OpeningBalance, statement.ClosingBalance, got, balance, opening, closing, want)
+		}
+	}
+
+	// 100 units at 5 and 50 at 6, then the 60 most expensive units are refunded: 50 at 6 and 10 at 5
+	var statement Statement
+	s.query(t, &statement, "getCustomerStatement", "James")
+	expectStatement("james", statement, "9050", "0", "9050",
+		line{entryDeposit, "10000", "10000"},
+		line{entryPurchase, "-800", "9200"},
+		line{entryRefund, "350", "9550"},
+		line{entryTransfer, "-500", "9050"},
+		line{entryWithdrawal, "-1000", "8050"},
+		line{entryPayoutReturned, "1000", "9050"})
+	if e := statement.Entries[1]; e.Charger != "charger1" || e.Timestamp != start + 1 {
+		t.Fatalf("purchase entry = %+v", e)
+	}
+	if e := statement.Entries[5]; e.PayoutID != 1 {
+		t.Fatalf("payout entry = %+v", e)
+	}
+
+	// Sellers are paid and pay refunds back
+	s.query(t, &statement, "getCustomerStatement", "ross")
+	expectStatement("ross", statement, "1500", "0", "1500",
+		line{entryDeposit, "1000", "1000"},
+		line{entrySale, "300", "1300"},
+		line{entryRefund, "-300", "1000"},
+		line{entryTransfer, "500", "1500"})
+	if e := statement.Entries[1]; e.Counterparty != "james" || e.Charger != "charger1" {
+		t.Fatalf("sale entry = %+v", e)
+	}
+
+	// Only the entries in the range, with the balances around it
+	s.query(t, &statement, "getCustomerStatement", "james", strconv.FormatInt(start + 2, 10), strconv.FormatInt(start + 3, 10))
+	expectStatement("james in range", statement, "9050", "9200", "9050", line{entryRefund, "350", "9550"}, line{entryTransfer, "-500", "9050"})
+	s.query(t, &statement, "getCustomerStatement", "james", strconv.FormatInt(end + 1, 10))
+	expectStatement("james after the last entry", statement, "9050", "9050", "9050")
+	s.query(t, &statement, "getCustomerStatement", "james", "", "1")
+	expectStatement("james before the first entry", statement, "9050", "0", "0")
+
+	s.queryFailsWith(t, codeUnknownCustomer, "getCustomerStatement", "nobody")
+	s.queryFailsWith(t, codeBadArgument, "getCustomerStatement", "james", "yesterday")
+}
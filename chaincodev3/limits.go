@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var limitsKey = "_limits" // key for the maximums set with setLimits
+
+// Names of the limits, as reported in LIMIT_EXCEEDED errors
+var limitQuantity = "quantity"
+var limitPrice = "price"
+var limitBalance = "balance"
+
+// Maximums of the amounts in the market
+// MaxQuantity bounds the units of an order and the units a seller offers in a tier, MaxPrice the price per unit of offers and bids
+// MaxBalance bounds what a balance can grow to through deposits, sales and transfers, refunds always go through
+type Limits struct {
+	MaxQuantity	Amount	`json:"maxquantity"`
+	MaxPrice	Amount	`json:"maxprice"`
+	MaxBalance	Amount	`json:"maxbalance"`
+}
+
+// Used until setLimits is invoked
+var defaultLimits = Limits{MaxQuantity: wholeAmount(1000000), MaxPrice: wholeAmount(1000000), MaxBalance: wholeAmount(1000000000000)}
+
+type QueryResponseLimits struct {
+	Success	bool	`json:"success"`
+	Data	Limits	`json:"data"`
+}
+
+//////////////////////////////////////// QUERY FUNCTIONS ////////////////////////////////////////
+
+// Get the maximums of quantities, prices and balances
+func getLimits(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	fmt.Println("Trying to get the limits")
+
+	limits, err := getCurrentLimits(stub)
+	if err != nil {
+		return createQueryError(codeStateError, "Failed to get limits")
+	}
+
+	return createQueryResponseLimits(true, limits)
+
+}
+
+//////////////////////////////////////// INVOKE FUNCTIONS ////////////////////////////////////////
+
+// Set the maximums of quantities, prices and balances, limits that are left out keep their current value
+// Amounts already above a lowered maximum are kept, they just can't grow
+func setLimits(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	var retStr string
+
+	// Debug message
+	fmt.Println("Trying to set the limits")
+
+	limits, err := getCurrentLimits(stub)
+	if err != nil {
+		retStr = "Could not get limits from chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+	for i, limit := range []*Amount{&limits.MaxQuantity, &limits.MaxPrice, &limits.MaxBalance} {
+		if len(args) > i && len(args[i]) > 0 {
+			*limit, _ = parseAmount(args[i])
+		}
+	}
+
+	err = marshalAndPut(stub, limitsKey, limits)
+	if err != nil {
+		retStr = "Could not write limits to chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+
+	// Successful return
+	retStr = "Successfully set the limits"
+	return createInvokeResponse(retStr, limits)
+
+}
+
+//////////////////////////////////////// UTILITY FUNCTIONS ////////////////////////////////////////
+
+// Get the maximums of quantities, prices and balances
+func getCurrentLimits(stub shim.ChaincodeStubInterface) (Limits, error) {
+
+	var limits Limits
+
+	limitsBytes, err := stub.GetState(limitsKey)
+	if err != nil {
+		return Limits{}, err
+	}
+	if len(limitsBytes) == 0 {
+		return defaultLimits, nil
+	}
+	json.Unmarshal(limitsBytes, &limits)
+	return limits, nil
+
+}
+
+// Returns a LIMIT_EXCEEDED error if value is above max
+func checkLimit(limit string, value Amount, max Amount) (error) {
+	if value > max {
+		return newChaincodeError(codeLimitExceeded, "The " + limit + " " + value.String() + " is above the maximum of " + max.String(), ErrorDetails{"limit": limit, "value": value, "max": max})
+	}
+	return nil
+}
+
+func createQueryResponseLimits(success bool, data Limits) ([]byte, error) {
+	var response QueryResponseLimits
+	response.Success = success
+	response.Data = data
+	r, _ := json.Marshal(response)
+	return r, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSetLimits(t *testing.T) {
+	s := newMarket(t)
+
+	var limits Limits
+	s.query(t, &limits, "getLimits")
+	if limits != defaultLimits {
+		t.Fatalf("getLimits returned %+v, want %+v", limits, defaultLimits)
+	}
+
+	// Limits that are left out keep their value
+	s.invokeData(t, &limits, "admin", "setLimits", "500", "", "20000")
+	if limits.MaxQuantity != wholeAmount(500) || limits.MaxPrice != defaultLimits.MaxPrice || limits.MaxBalance != wholeAmount(20000) {
+		t.Fatalf("setLimits returned %+v", limits)
+	}
+	s.invokeData(t, &limits, "admin", "setLimits", `{"maxPrice": "2.5"}`)
+	if limits.MaxQuantity != wholeAmount(500) || limits.MaxPrice != 25000 || limits.MaxBalance != wholeAmount(20000) {
+		t.Fatalf("setLimits returned %+v", limits)
+	}
+
+	s.mustFailWith(t, codeNotAllowed, "james", "setLimits", "1000000")
+	s.mustFailWith(t, codeBadArgument, "admin", "setLimits", "0")
+	s.mustFailWith(t, codeBadArgument, "admin", "setLimits", "", "-1")
+
+	// Init goes back to the defaults
+	s.mustInvoke(t, "admin", "init", "1")
+	s.query(t, &limits, "getLimits")
+	if limits != defaultLimits {
+		t.Fatalf("getLimits after init returned %+v", limits)
+	}
+}
+
+func TestQuantityAndPriceLimits(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "admin", "setLimits", "100", "10")
+
+	details := s.mustFailDetails(t, codeLimitExceeded, "sam", "addOfferQuantity", "charger1", "10.5", "1")
+	expectDetails(t, "addOfferQuantity", details, ErrorDetails{"limit": limitPrice, "value": Amount(105000), "max": wholeAmount(10)})
+
+	// The limit is on the units a seller has in a tier, however many times quantity is added
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "10", "60")
+	details = s.mustFailDetails(t, codeLimitExceeded, "sam", "addOfferQuantity", "charger1", "10", "40.0001")
+	expectDetails(t, "addOfferQuantity", details, ErrorDetails{"limit": limitQuantity, "value": Amount(1000001), "max": wholeAmount(100)})
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "10", "40")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+	expectTiers(t, "offer tiers", s.offerTiers(t, "charger1"), map[string]map[string]int{"5": {"sam": 100}, "10": {"sam": 100}})
+
+	s.mustFailWith(t, codeLimitExceeded, "james", "acceptOffer", "charger1", "james", "150")
+	s.mustFailWith(t, codeLimitExceeded, "james", "placeBid", "charger1", "james", "150", "10", "2000000000")
+	s.mustFailWith(t, codeLimitExceeded, "james", "placeBid", "charger1", "james", "10", "11", "2000000000")
+
+	// Refunded units go back to the tier even if it is full again
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "100")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+	s.mustInvoke(t, "charger1", "cancelTransaction", "charger1", "100")
+	expectTiers(t, "offer tiers", s.offerTiers(t, "charger1"), map[string]map[string]int{"5": {"sam": 200}, "10": {"sam": 100}})
+}
+
+func TestBalanceLimit(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "admin", "addCustomer", "ross")
+	s.mustInvoke(t, "admin", "setLimits", "", "", "10000")
+
+	details := s.mustFailDetails(t, codeLimitExceeded, "admin", "addCustomerFunds", "james", "0.0001")
+	expectDetails(t, "addCustomerFunds", details, ErrorDetails{"limit": limitBalance, "value": Amount(100000001), "max": wholeAmount(10000), "customer": "james"})
+
+	// Sales and transfers are credits like deposits
+	s.mustInvoke(t, "admin", "addCustomerFunds", "sam", "9950")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "10", "100")
+	details = s.mustFailDetails(t, codeLimitExceeded, "james", "acceptOffer", "charger1", "james", "6")
+	expectDetails(t, "acceptOffer", details, ErrorDetails{"limit": limitBalance, "value": wholeAmount(10010), "max": wholeAmount(10000), "customer": "sam"})
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "5")
+	s.mustFailWith(t, codeLimitExceeded, "james", "transferFunds", "james", "sam", "1")
+	s.mustInvoke(t, "james", "transferFunds", "james", "ross", "1")
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 10000, "james": 9949, "ross": 1})
+
+	// Refunds and rejected payouts always go through
+	s.mustInvoke(t, "admin", "addCustomerFunds", "james", "51")
+	s.mustInvoke(t, "charger1", "cancelTransaction", "charger1", "5")
+	s.mustInvoke(t, "ross", "withdrawFunds", "ross", "1")
+	s.mustInvoke(t, "admin", "addCustomerFunds", "ross", "10000")
+	s.mustInvoke(t, "admin", "rejectPayout", "1")
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 9950, "james": 10050, "ross": 10001})
+
+	// Nothing was written for the failed credits
+	var statement Statement
+	s.query(t, &statement, "getCustomerStatement", "sam")
+	if len(statement.Entries) != 3 {
+		t.Fatalf("statement of sam has %d entries, want 3", len(statement.Entries))
+	}
+}
+
+func TestAmountOverflow(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "admin", "setLimits", "922337203685477", "922337203685477", "922337203685477.5807")
+
+	// Costs that don't fit an amount are an error, not a wrapped around number
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "100000000", "100000000")
+	details := s.mustFailDetails(t, codeAmountOverflow, "james", "acceptOffer", "charger1", "james", "100000000")
+	expectDetails(t, "acceptOffer", details, ErrorDetails{"operation": "100000000 * 100000000"})
+
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "100000000", "922337103685477")
+	s.mustFailWith(t, codeAmountOverflow, "sam", "addOfferQuantity", "charger1", "100000000", "1")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "1", "922337203685477")
+	s.queryFailsWith(t, codeAmountOverflow, "getTotalEnergyForSale", "charger1")
+
+	s.mustInvoke(t, "admin", "addCustomerFunds", "sam", "922337203685477.5807")
+	s.mustFailWith(t, codeAmountOverflow, "james", "transferFunds", "james", "sam", "0.0001")
+	var balances map[string]Amount
+	s.query(t, &balances, "getCustomers")
+	if balances["sam"].String() != "922337203685477.5807" || balances["james"] != wholeAmount(10000) {
+		t.Fatalf("customers = %v", balances)
+	}
+}
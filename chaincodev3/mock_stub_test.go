@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// In-memory chaincode stub
+// Methods the chaincode does not use are left to the embedded interface and panic if called
+type mockStub struct {
+	shim.ChaincodeStubInterface
+	state	map[string][]byte
+	caller	string			// enrollmentId attribute of the caller's certificate
+	now		int64			// timestamp of the current transaction proposal
+	events	[]mockEvent		// chaincode events set by the last invocation
+	failPut	string			// PutState fails for keys that start with it, if set
+}
+
+type mockEvent struct {
+	name	string
+	payload	[]byte
+}
+
+type mockIterator struct {
+	keys	[]string
+	values	[][]byte
+}
+
+var testChaincode = new(SimpleChaincode)
+
+func newMockStub() *mockStub {
+	return &mockStub{state: make(map[string][]byte), now: 1490000000}
+}
+
+func (s *mockStub) GetState(key string) ([]byte, error) {
+	return s.state[key], nil
+}
+
+func (s *mockStub) PutState(key string, value []byte) error {
+	if len(key) == 0 {
+		return errors.New("key cannot be empty")
+	}
+	if len(s.failPut) > 0 && strings.HasPrefix(key, s.failPut) {
+		return errors.New("cannot write " + key)
+	}
+	s.state[key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (s *mockStub) DelState(key string) error {
+	delete(s.state, key)
+	return nil
+}
+
+// Both ends are inclusive, like the v0.6 peer
+func (s *mockStub) RangeQueryState(startKey, endKey string) (shim.StateRangeQueryIteratorInterface, error) {
+	it := &mockIterator{}
+	for key := range s.state {
+		if key >= startKey && key <= endKey {
+			it.keys = append(it.keys, key)
+		}
+	}
+	sort.Strings(it.keys)
+	for _, key := range it.keys {
+		it.values = append(it.values, s.state[key])
+	}
+	return it, nil
+}
+
+func (s *mockStub) ReadCertAttribute(attributeName string) ([]byte, error) {
+	if attributeName != enrollmentIDAttribute || len(s.caller) == 0 {
+		return nil, errors.New("attribute " + attributeName + " not found")
+	}
+	return []byte(s.caller), nil
+}
+
+func (s *mockStub) GetTxTimestamp() (*timestamp.Timestamp, error) {
+	return &timestamp.Timestamp{Seconds: s.now}, nil
+}
+
+func (s *mockStub) SetEvent(name string, payload []byte) error {
+	s.events = append(s.events, mockEvent{name, payload})
+	return nil
+}
+
+func (it *mockIterator) HasNext() bool {
+	return len(it.keys) > 0
+}
+
+func (it *mockIterator) Next() (string, []byte, error) {
+	if len(it.keys) == 0 {
+		return "", nil, errors.New("no more keys")
+	}
+	key, value := it.keys[0], it.values[0]
+	it.keys, it.values = it.keys[1:], it.values[1:]
+	return key, value, nil
+}
+
+func (it *mockIterator) Close() error {
+	return nil
+}
+
+//////////////////////////////////////// TEST HELPERS ////////////////////////////////////////
+
+// Invoke a function as caller in its own transaction, one second after the previous one
+// Like the ledger, nothing the invocation wrote is kept if it returns an error
+func (s *mockStub) invoke(caller string, function string, args ...string) ([]byte, error) {
+	snapshot := make(map[string][]byte, len(s.state))
+	for key, value := range s.state {
+		snapshot[key] = value
+	}
+	s.now++
+	s.caller = caller
+	s.events = nil
+	retBytes, err := testChaincode.Invoke(s, function, args)
+	if err != nil {
+		// Like the peer, only pass the error on
+		s.state = snapshot
+		s.events = nil
+		retBytes = nil
+	}
+	return retBytes, err
+}
+
+// Invoke a function that must succeed and return the message of its response
+func (s *mockStub) mustInvoke(t *testing.T, caller string, function string, args ...string) string {
+	return s.invokeData(t, nil, caller, function, args...)
+}
+
+// Invoke a function that must succeed and decode the entity of its response into v
+func (s *mockStub) invokeData(t *testing.T, v interface{}, caller string, function string, args ...string) string {
+	var response struct {
+		Success	bool			`json:"success"`
+		Code	string			`json:"code"`
+		Message	string			`json:"message"`
+		Data	json.RawMessage	`json:"data"`
+	}
+	retBytes, err := s.invoke(caller, function, args...)
+	if err != nil {
+		t.Fatalf("%s %v as %s: unexpected error: %v", function, args, caller, err)
+	}
+	err = json.Unmarshal(retBytes, &response)
+	if err != nil || !response.Success || len(response.Code) > 0 {
+		t.Fatalf("%s %v as %s: bad response %s", function, args, caller, retBytes)
+	}
+	if v != nil {
+		err = json.Unmarshal(response.Data, v)
+		if err != nil {
+			t.Fatalf("%s %v as %s: could not decode %s: %v", function, args, caller, response.Data, err)
+		}
+	}
+	return response.Message
+}
+
+// Invoke a function that must fail and return the message of its response
+func (s *mockStub) mustFail(t *testing.T, caller string, function string, args ...string) string {
+	return s.failure(t, caller, function, args...).Message
+}
+
+// Invoke a function that must fail with an error code and return the message of its response
+func (s *mockStub) mustFailWith(t *testing.T, code string, caller string, function string, args ...string) string {
+	return s.failureWith(t, code, caller, function, args...).Message
+}
+
+// Invoke a function that must fail with an error code and return the details of its response
+func (s *mockStub) mustFailDetails(t *testing.T, code string, caller string, function string, args ...string) ErrorDetails {
+	return s.failureWith(t, code, caller, function, args...).Details
+}
+
+func (s *mockStub) failureWith(t *testing.T, code string, caller string, function string, args ...string) InvokeResponse {
+	response := s.failure(t, caller, function, args...)
+	if response.Code != code {
+		t.Fatalf("%s %v as %s: got code %s, want %s: %s", function, args, caller, response.Code, code, response.Message)
+	}
+	return response
+}
+
+func (s *mockStub) failure(t *testing.T, caller string, function string, args ...string) InvokeResponse {
+	var response InvokeResponse
+	retBytes, err := s.invoke(caller, function, args...)
+	if err == nil {
+		t.Fatalf("%s %v as %s: expected an error, got %s", function, args, caller, retBytes)
+	}
+	json.Unmarshal([]byte(err.Error()), &response)
+	if response.Success || len(response.Code) == 0 || len(response.Message) == 0 || response.Data != nil {
+		t.Fatalf("%s %v as %s: bad error %q", function, args, caller, err)
+	}
+	return response
+}
+
+// Run a query that must succeed and decode its data into v
+func (s *mockStub) query(t *testing.T, v interface{}, function string, args ...string) {
+	var response struct {
+		Success	bool			`json:"success"`
+		Data	json.RawMessage	`json:"data"`
+	}
+	retBytes, err := testChaincode.Query(s, function, args)
+	if err != nil {
+		t.Fatalf("%s %v: unexpected error: %v", function, args, err)
+	}
+	json.Unmarshal(retBytes, &response)
+	if !response.Success {
+		t.Fatalf("%s %v: query failed: %s", function, args, response.Data)
+	}
+	if v != nil {
+		err = json.Unmarshal(response.Data, v)
+		if err != nil {
+			t.Fatalf("%s %v: could not decode %s: %v", function, args, response.Data, err)
+		}
+	}
+}
+
+// Run a query that must fail and return its message
+func (s *mockStub) queryFails(t *testing.T, function string, args ...string) string {
+	return s.queryFailure(t, function, args...).Data
+}
+
+// Run a query that must fail with an error code and return its message
+func (s *mockStub) queryFailsWith(t *testing.T, code string, function string, args ...string) string {
+	response := s.queryFailure(t, function, args...)
+	if response.Code != code {
+		t.Fatalf("%s %v: got code %s, want %s: %s", function, args, response.Code, code, response.Data)
+	}
+	return response.Data
+}
+
+func (s *mockStub) queryFailure(t *testing.T, function string, args ...string) QueryResponseError {
+	var response QueryResponseError
+	retBytes, err := testChaincode.Query(s, function, args)
+	if err != nil {
+		t.Fatalf("%s %v: the client only gets the error %q", function, args, err)
+	}
+	json.Unmarshal(retBytes, &response)
+	if response.Success || len(response.Code) == 0 || len(response.Data) == 0 {
+		t.Fatalf("%s %v: expected the query to fail, got %s", function, args, retBytes)
+	}
+	return response
+}
+
+// Compare error details after a round trip through JSON, where numbers lose their type
+func expectDetails(t *testing.T, name string, got ErrorDetails, want ErrorDetails) {
+	gotBytes, _ := json.Marshal(got)
+	wantBytes, _ := json.Marshal(want)
+	if string(gotBytes) != string(wantBytes) {
+		t.Fatalf("%s: got details %s, want %s", name, gotBytes, wantBytes)
+	}
+}
+
+func (s *mockStub) customers(t *testing.T) map[string]int {
+	var customers map[string]int
+	s.query(t, &customers, "getCustomers")
+	return customers
+}
+
+func (s *mockStub) offers(t *testing.T, chargerID string) map[string]int {
+	var offers map[string]int
+	s.query(t, &offers, "getOffers", chargerID)
+	return offers
+}
+
+func (s *mockStub) offerTiers(t *testing.T, chargerID string) map[string]map[string]int {
+	var tiers map[string]map[string]int
+	s.query(t, &tiers, "getOfferTiers", chargerID)
+	return tiers
+}
+
+func (s *mockStub) pending(t *testing.T, chargerID string) []Transaction {
+	var pending []Transaction
+	s.query(t, &pending, "getPendingTransaction", chargerID)
+	return pending
+}
+
+func (s *mockStub) transactions(t *testing.T) []Transaction {
+	var transactions []Transaction
+	s.query(t, &transactions, "getTransactions")
+	return transactions
+}
+
+func (s *mockStub) payouts(t *testing.T, args ...string) []Payout {
+	var payouts []Payout
+	s.query(t, &payouts, "getPayouts", args...)
+	return payouts
+}
+
+// Deploy the chaincode with admin as its admin and add the customers sam and james and sam's charger1
+// james has 10000 to spend
+func newMarket(t *testing.T) *mockStub {
+	s := newMockStub()
+	s.caller = "admin"
+	_, err := testChaincode.Init(s, "init", []string{"1"})
+	if err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	s.mustInvoke(t, "admin", "addCustomer", "sam")
+	s.mustInvoke(t, "admin", "addCustomer", "james")
+	s.mustInvoke(t, "admin", "addCustomerFunds", "james", "10000")
+	s.mustInvoke(t, "admin", "addCharger", "charger1", "sam")
+	return s
+}
+
+// Compare maps of whole amounts, got may hold ints or amounts
+// Both are compared in their JSON form, where whole amounts look like ints
+func expectInts(t *testing.T, what string, got interface{}, want map[string]int) {
+	gotBytes, _ := json.Marshal(got)
+	wantBytes, _ := json.Marshal(want)
+	if string(gotBytes) != string(wantBytes) {
+		t.Fatalf("%s: got %s, want %s", what, gotBytes, wantBytes)
+	}
+}
+
+func expectTiers(t *testing.T, what string, got interface{}, want map[string]map[string]int) {
+	gotBytes, _ := json.Marshal(got)
+	wantBytes, _ := json.Marshal(want)
+	if string(gotBytes) != string(wantBytes) {
+		t.Fatalf("%s: got %s, want %s", what, gotBytes, wantBytes)
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var bidObjectType = "bid"     // bid~chargerID~bidID -> resting Bid
+var lastBidIDKey = "_lastbidid" // key for the ID given to the most recent bid
+
+// Bid structure
+// A resting buy order at a charger, filled at or below MaxPrice per unit until Expiry (Unix time)
+type Bid struct {
+	BidID		int64	`json:"bidid"`
+	Charger		string	`json:"charger"`
+	Buyer		string	`json:"buyer"`
+	Quantity	Amount	`json:"quantity"`
+	MaxPrice	Amount	`json:"maxprice"`
+	Placed		int64	`json:"placed"`
+	Expiry		int64	`json:"expiry"`
+}
+
+type QueryResponseBids struct {
+	Success	bool	`json:"success"`
+	Data	[]Bid	`json:"data"`
+}
+
+//////////////////////////////////////// QUERY FUNCTIONS ////////////////////////////////////////
+
+// Get the resting bids of a charger in the order they will be matched
+func getOrderBook(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	// Convert charger ID argument to lowercase
+	chargerID := strings.ToLower(args[0])
+	fmt.Println("Trying to get the order book of charger " + chargerID)
+
+	// Make sure the charger exists
+	_, err := getCharger(stub, chargerID)
+	if err != nil {
+		return createQueryErrorFrom(err, err.Error())
+	}
+
+	// Get the bids from the chaincode state
+	bids, err := getChargerBids(stub, chargerID)
+	if err != nil {
+		return createQueryError(codeStateError, "Failed to get order book")
+	}
+
+	return createQueryResponseBids(true, bids)
+
+}
+
+//////////////////////////////////////// INVOKE FUNCTIONS ////////////////////////////////////////
+
+// Rest a buy order in a charger's order book
+// The bid is matched right away if there is supply at or below its max price
+func placeBid(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	var retStr string
+	var newBid Bid
+
+	// Debug message
+	fmt.Println(args[1] + " is trying to bid for " + args[2] + " units of energy at charger " + args[0])
+
+	// Make sure the charger exists
+	newBid.Charger = strings.ToLower(args[0])
+	_, err := getCharger(stub, newBid.Charger)
+	if err != nil {
+		retStr = err.Error()
+		return createInvokeErrorFrom(err, retStr)
+	}
+
+	// Make sure the buyer is a valid customer
+	newBid.Buyer = strings.ToLower(args[1])
+	customers, err := getCustomerBalances(stub, newBid.Buyer)
+	if err != nil {
+		retStr = "Could not get customer " + newBid.Buyer + " from chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+	if _, ok := customers[newBid.Buyer]; !ok {
+		retStr = args[1] + " is not a valid buyer"
+		return createInvokeErrorDetails(codeUnknownCustomer, retStr, ErrorDetails{"customer": newBid.Buyer})
+	}
+
+	// Process numeric parameters
+	newBid.Quantity, _ = parseAmount(args[2])
+	newBid.MaxPrice, _ = parseAmount(args[3])
+	newBid.Expiry, _ = strconv.ParseInt(args[4], 10, 64)
+
+	// Keep the quantity and the price within the limits
+	limits, err := getCurrentLimits(stub)
+	if err != nil {
+		retStr = "Could not get limits from chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+	err = checkLimit(limitQuantity, newBid.Quantity, limits.MaxQuantity)
+	if err == nil {
+		err = checkLimit(limitPrice, newBid.MaxPrice, limits.MaxPrice)
+	}
+	if err != nil {
+		return createInvokeErrorFrom(err, err.Error())
+	}
+
+	// Expiry must be in the future
+	newBid.Placed, err = getTxTimestamp(stub)
+	if err != nil {
+		retStr = "Could not get transaction timestamp"
+		return createInvokeError(codeStateError, retStr)
+	}
+	if newBid.Expiry <= newBid.Placed {
+		retStr = "Fifth argument (expiry) must be later than the current time " + strconv.FormatInt(newBid.Placed, 10)
+		return createInvokeError(codeBadArgument, retStr)
+	}
+
+	// Bid IDs count up, so they also give the time priority of the bids
+	newBid.BidID, err = nextBidID(stub)
+	if err != nil {
+		retStr = "Could not get next bid ID from chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+
+	// Rest the bid in the order book
+	err = putBid(stub, newBid)
+	if err != nil {
+		retStr = "Could not write bid to chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+
+	// Match against the current supply
+	err = matchBids(stub, newBid.Charger)
+	if err != nil {
+		retStr = "Could not match bids at charger " + newBid.Charger + ": " + err.Error()
+		return createInvokeErrorFrom(err, retStr)
+	}
+
+	// Return the bid as it rests after matching, with no units left if it was filled completely
+	bidBytes, err := stub.GetState(createCompositeKey(bidObjectType, newBid.Charger, fmt.Sprintf("%020d", newBid.BidID)))
+	if err != nil {
+		retStr = "Could not get bid " + strconv.FormatInt(newBid.BidID, 10) + " from chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+	if len(bidBytes) == 0 {
+		newBid.Quantity = 0
+	} else {
+		json.Unmarshal(bidBytes, &newBid)
+	}
+
+	// Successful return
+	retStr = "Successfully placed bid " + strconv.FormatInt(newBid.BidID, 10)
+	return createInvokeResponse(retStr, newBid)
+
+}
+
+// Remove a resting bid from a charger's order book
+func cancelBid(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	var retStr string
+	var bid Bid
+
+	chargerID := strings.ToLower(args[0])
+	bidID, _ := strconv.ParseInt(args[1], 10, 64)
+
+	// Debug message
+	fmt.Println("Trying to cancel bid " + args[1] + " at charger " + chargerID)
+
+	// Make sure the bid exists
+	bidKey := createCompositeKey(bidObjectType, chargerID, fmt.Sprintf("%020d", bidID))
+	bidBytes, err := stub.GetState(bidKey)
+	if err != nil {
+		retStr = "Could not get bid " + args[1] + " from chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+	if len(bidBytes) == 0 {
+		retStr = "Bid " + args[1] + " does not exist at charger " + chargerID
+		return createInvokeErrorDetails(codeUnknownBid, retStr, ErrorDetails{"charger": chargerID, "bid": bidID})
+	}
+
+	json.Unmarshal(bidBytes, &bid)
+
+	// Remove the bid
+	err = stub.DelState(bidKey)
+	if err != nil {
+		retStr = "Could not delete bid " + args[1] + " from chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+
+	// Successful return
+	retStr = "Successfully cancelled bid " + args[1]
+	return createInvokeResponse(retStr, bid)
+
+}
+
+//////////////////////////////////////// UTILITY FUNCTIONS ////////////////////////////////////////
+
+// Match a charger's resting bids against its offers with price-time priority
+// The highest max price goes first, bids with the same max price go in the order they were placed
+// A charger only has one pending transaction, so at most one bid is filled per call
+func matchBids(stub shim.ChaincodeStubInterface, chargerID string) (error) {
+
+	var pendingTransaction []Transaction
+
+	// Nothing can be matched while the charger has a pending transaction
+	pendingTransactionBytes, err := stub.GetState(createCompositeKey(pendingTransactionObjectType, chargerID))
+	if err != nil {
+		return err
+	}
+	json.Unmarshal(pendingTransactionBytes, &pendingTransaction)
+	if len(pendingTransaction) > 0 {
+		return nil
+	}
+
+	now, err := getTxTimestamp(stub)
+	if err != nil {
+		return err
+	}
+	bids, err := getChargerBids(stub, chargerID)
+	if err != nil {
+		return err
+	}
+	offers, err := getChargerOffers(stub, chargerID)
+	if err != nil {
+		return err
+	}
+
+	for _, bid := range bids {
+		bidKey := createCompositeKey(bidObjectType, chargerID, fmt.Sprintf("%020d", bid.BidID))
+
+		// Expired bids are dropped
+		if bid.Expiry <= now {
+			fmt.Println("Bid " + strconv.FormatInt(bid.BidID, 10) + " expired, removing it")
+			err = stub.DelState(bidKey)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Bids are in descending price order
+		// If nothing is for sale at this bid's price, later bids can't be filled either
+		var available Amount
+		for i, val := range offers {
+			pricePerUnit, _ := parseAmount(i)
+			if pricePerUnit <= bid.MaxPrice {
+				available, err = addAmounts(available, val)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if available == 0 {
+			return nil
+		}
+
+		// Fill as much of the bid as possible through acceptOffer
+		fmt.Println("Matching bid " + strconv.FormatInt(bid.BidID, 10))
+		retBytes, err := acceptOffer(stub, []string{chargerID, bid.Buyer, bid.Quantity.String(), bid.MaxPrice.String(), partialFill})
+		if err != nil {
+			// Only a state error fails the invocation that matched the bids
+			// acceptOffer checks everything else before it writes, so the bid is passed over and the next one tried
+			var response InvokeResponse
+			json.Unmarshal(retBytes, &response)
+			if response.Code == codeStateError {
+				return newChaincodeError(response.Code, response.Message, response.Details)
+			}
+			err = rejectBid(stub, bid, response)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Take the filled units off the bid, keep whatever is left resting
+		pendingTransactionBytes, err = stub.GetState(createCompositeKey(pendingTransactionObjectType, chargerID))
+		if err != nil {
+			return err
+		}
+		json.Unmarshal(pendingTransactionBytes, &pendingTransaction)
+		bid.Quantity -= pendingTransaction[0].Energy
+		if bid.Quantity > 0 {
+			return putBid(stub, bid)
+		}
+		return stub.DelState(bidKey)
+	}
+
+	return nil
+
+}
+
+// Record why acceptOffer could not fill a bid
+// A bid that can never be filled is removed, any other bid keeps resting and is tried again the next time bids are matched
+func rejectBid(stub shim.ChaincodeStubInterface, bid Bid, response InvokeResponse) (error) {
+
+	removed := isUnfillableBid(bid, response)
+	if removed {
+		fmt.Println("Could not fill bid " + strconv.FormatInt(bid.BidID, 10) + ", removing it: " + response.Message)
+		err := stub.DelState(createCompositeKey(bidObjectType, bid.Charger, fmt.Sprintf("%020d", bid.BidID)))
+		if err != nil {
+			return err
+		}
+	} else {
+		fmt.Println("Could not fill bid " + strconv.FormatInt(bid.BidID, 10) + ", passing it over: " + response.Message)
+	}
+	return emitEvent(stub, eventBidRejected, BidRejectedEvent{Bid: bid, Removed: removed, Code: response.Code, Message: response.Message, Details: response.Details})
+
+}
+
+// A bid that acceptOffer refused because of its buyer or its own quantity can never be filled
+// A buyer that ran out of funds or no longer exists, or a quantity above a lowered limit
+func isUnfillableBid(bid Bid, response InvokeResponse) (bool) {
+	switch response.Code {
+	case codeInsufficientFunds, codeUnknownCustomer:
+		return response.Details["customer"] == bid.Buyer
+	case codeLimitExceeded:
+		return response.Details["limit"] == limitQuantity
+	}
+	return false
+}
+
+// Get the resting bids of a charger in price-time priority
+func getChargerBids(stub shim.ChaincodeStubInterface, chargerID string) ([]Bid, error) {
+
+	var bids []Bid
+	err := getStateByPartialCompositeKey(stub, bidObjectType, []string{chargerID}, func(key string, valAsBytes []byte) error {
+		var bid Bid
+		json.Unmarshal(valAsBytes, &bid)
+		bids = append(bids, bid)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Highest max price first, then lowest bid ID
+	sort.Sort(bidsByPriority(bids))
+	return bids, nil
+
+}
+
+// Sorts bids in price-time priority
+type bidsByPriority []Bid
+
+func (b bidsByPriority) Len() int {
+	return len(b)
+}
+
+func (b bidsByPriority) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
+
+func (b bidsByPriority) Less(i, j int) bool {
+	if b[i].MaxPrice != b[j].MaxPrice {
+		return b[i].MaxPrice > b[j].MaxPrice
+	}
+	return b[i].BidID < b[j].BidID
+}
+
+// Write a bid to its own key, bid~chargerID~bidID
+func putBid(stub shim.ChaincodeStubInterface, bid Bid) (error) {
+	return marshalAndPut(stub, createCompositeKey(bidObjectType, bid.Charger, fmt.Sprintf("%020d", bid.BidID)), bid)
+}
+
+// Get the next bid ID from the counter in the chaincode state
+func nextBidID(stub shim.ChaincodeStubInterface) (int64, error) {
+
+	var lastBidID int64
+
+	lastBidIDBytes, err := stub.GetState(lastBidIDKey)
+	if err != nil {
+		return 0, err
+	}
+	json.Unmarshal(lastBidIDBytes, &lastBidID)
+
+	lastBidID++
+	err = marshalAndPut(stub, lastBidIDKey, lastBidID)
+	if err != nil {
+		return 0, err
+	}
+	return lastBidID, nil
+
+}
+
+func createQueryResponseBids(success bool, data []Bid) ([]byte, error) {
+	var response QueryResponseBids
+	response.Success = success
+	response.Data = data
+	r, _ := json.Marshal(response)
+	return r, nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"testing"
+)
+
+func (s *mockStub) orderBook(t *testing.T, chargerID string) []Bid {
+	var bids []Bid
+	s.query(t, &bids, "getOrderBook", chargerID)
+	return bids
+}
+
+// Expiry far enough in the future for the bid to outlive the test
+func (s *mockStub) later() string {
+	return strconv.FormatInt(s.now + 1000, 10)
+}
+
+func TestPlaceBidRestsInPriceTimePriority(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "admin", "addCustomer", "ross")
+	s.mustInvoke(t, "admin", "addCustomerFunds", "ross", "1000")
+
+	s.mustInvoke(t, "james", "placeBid", "charger1", "james", "50", "6", s.later())
+	s.mustInvoke(t, "ross", "placeBid", "charger1", "ross", "10", "8", s.later())
+	s.mustInvoke(t, "james", "placeBid", "Charger1", "James", "100", "6", s.later())
+
+	bids := s.orderBook(t, "charger1")
+	if len(bids) != 3 {
+		t.Fatalf("order book = %v", bids)
+	}
+	order := []int64{2, 1, 3}
+	for i, bid := range bids {
+		if bid.BidID != order[i] {
+			t.Fatalf("bid %d is %d, want %d", i, bid.BidID, order[i])
+		}
+	}
+	if bids[1].Buyer != "james" || bids[1].Charger != "charger1" || bids[1].Quantity != wholeAmount(50) || bids[1].MaxPrice != wholeAmount(6) || bids[1].Placed != 1490000007 || bids[1].Expiry != 1490000006 + 1000 {
+		t.Fatalf("bid 1 = %+v", bids[1])
+	}
+	if len(s.pending(t, "charger1")) != 0 {
+		t.Fatal("bid was filled without offers")
+	}
+
+	expectError(t, s.queryFails(t, "getOrderBook"), "Expecting 1")
+	expectError(t, s.queryFails(t, "getOrderBook", ""), "cannot be an empty string")
+	expectError(t, s.queryFails(t, "getOrderBook", "charger9"), "Charger charger9 does not exist")
+}
+
+func TestBidsAreFilledOneAtATime(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "admin", "addCustomer", "ross")
+	s.mustInvoke(t, "admin", "addCustomerFunds", "ross", "1000")
+	s.mustInvoke(t, "james", "placeBid", "charger1", "james", "50", "6", s.later())
+	s.mustInvoke(t, "ross", "placeBid", "charger1", "ross", "10", "8", s.later())
+	s.mustInvoke(t, "james", "placeBid", "charger1", "james", "100", "6", s.later())
+
+	// New offers fill the best bid at the offer's price
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+	pt := s.pending(t, "charger1")[0]
+	if pt.Buyer != "ross" || pt.Energy != wholeAmount(10) || pt.Cost != wholeAmount(50) {
+		t.Fatalf("first fill = %+v", pt)
+	}
+	if n := len(s.orderBook(t, "charger1")); n != 2 {
+		t.Fatalf("%d bids left, want 2", n)
+	}
+
+	// Completing frees the charger for the next bid
+	s.mustInvoke(t, "charger1", "completeTransaction", "charger1")
+	pt = s.pending(t, "charger1")[0]
+	if pt.Buyer != "james" || pt.Energy != wholeAmount(50) || pt.Cost != wholeAmount(250) {
+		t.Fatalf("second fill = %+v", pt)
+	}
+
+	// Only 40 units are left, the rest of the bid keeps resting
+	s.mustInvoke(t, "charger1", "completeTransaction", "charger1")
+	pt = s.pending(t, "charger1")[0]
+	if pt.Buyer != "james" || pt.Energy != wholeAmount(40) || pt.Cost != wholeAmount(200) {
+		t.Fatalf("third fill = %+v", pt)
+	}
+	bids := s.orderBook(t, "charger1")
+	if len(bids) != 1 || bids[0].BidID != 3 || bids[0].Quantity != wholeAmount(60) {
+		t.Fatalf("order book = %v", bids)
+	}
+	expectInts(t, "offers", s.offers(t, "charger1"), map[string]int{})
+
+	// Offers above the max price are left alone
+	s.mustInvoke(t, "charger1", "completeTransaction", "charger1")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "7", "100")
+	if len(s.pending(t, "charger1")) != 0 {
+		t.Fatal("bid was filled above its max price")
+	}
+
+	// A cancellation puts units back that the bid can take
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "6", "20")
+	pt = s.pending(t, "charger1")[0]
+	if pt.Energy != wholeAmount(20) || pt.Cost != wholeAmount(120) {
+		t.Fatalf("fourth fill = %+v", pt)
+	}
+	s.mustInvoke(t, "charger1", "cancelTransaction", "charger1", "15")
+	pt = s.pending(t, "charger1")[0]
+	if pt.Energy != wholeAmount(15) || pt.Cost != wholeAmount(90) {
+		t.Fatalf("refill = %+v", pt)
+	}
+	if bids = s.orderBook(t, "charger1"); len(bids) != 1 || bids[0].Quantity != wholeAmount(25) {
+		t.Fatalf("order book = %v", bids)
+	}
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 50 + 250 + 200 + 120 - 90 + 90, "james": 10000 - 250 - 200 - 120 + 90 - 90, "ross": 950})
+}
+
+func TestBidsAreDroppedWhenExpiredOrUnpaid(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "admin", "addCustomer", "ross")
+	s.mustInvoke(t, "admin", "addCustomerFunds", "ross", "100")
+
+	// Expires before the offers come in
+	s.mustInvoke(t, "james", "placeBid", "charger1", "james", "10", "9", strconv.FormatInt(s.now + 3, 10))
+	// ross can't pay for 30 units at 5
+	s.mustInvoke(t, "ross", "placeBid", "charger1", "ross", "30", "8", s.later())
+	s.mustInvoke(t, "james", "placeBid", "charger1", "james", "5", "5", s.later())
+
+	s.mustInvoke(t, "admin", "addCustomerFunds", "ross", "1")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+
+	pt := s.pending(t, "charger1")[0]
+	if pt.Buyer != "james" || pt.Energy != wholeAmount(5) {
+		t.Fatalf("fill = %+v", pt)
+	}
+	if n := len(s.orderBook(t, "charger1")); n != 0 {
+		t.Fatalf("%d bids left, want 0", n)
+	}
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 25, "james": 9975, "ross": 101})
+}
+
+func TestBidsAreKeptWhenTheFillFailsForOtherReasons(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "james", "placeBid", "charger1", "james", "10", "9", s.later())
+	s.mustInvoke(t, "james", "placeBid", "charger1", "james", "150", "8", s.later())
+
+	// A failure that isn't about the bid fails the invocation instead of emptying the book
+	s.failPut = pendingTransactionObjectType + compositeKeySeparator
+	s.mustFailWith(t, codeStateError, "sam", "addOfferQuantity", "charger1", "5", "100")
+	s.failPut = ""
+	if n := len(s.orderBook(t, "charger1")); n != 2 {
+		t.Fatalf("%d bids left, want 2", n)
+	}
+
+	// A bid above a lowered quantity limit can't be filled anymore
+	s.mustInvoke(t, "admin", "setLimits", "100")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+	s.mustInvoke(t, "charger1", "completeTransaction", "charger1")
+	if bids := s.orderBook(t, "charger1"); len(bids) != 0 {
+		t.Fatalf("order book = %v", bids)
+	}
+	expectInts(t, "offers", s.offers(t, "charger1"), map[string]int{"5": 90})
+}
+
+func TestBidsArePassedOverWhenASellerCannotBePaid(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "admin", "setLimits", "", "", "10000")
+	s.mustInvoke(t, "admin", "addCustomerFunds", "sam", "9990")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "1")
+	s.mustInvoke(t, "james", "placeBid", "charger1", "james", "10", "5", s.later())
+
+	// sam can't be paid for the bid, completing the transaction still succeeds and the bid keeps resting
+	s.mustInvoke(t, "charger1", "completeTransaction", "charger1")
+	payload := s.lastEvent(t, eventTransactionCompleted, eventBidRejected)
+	var rejected BidRejectedEvent
+	json.Unmarshal(payload.Events[1].Data, &rejected)
+	if rejected.Bid.BidID != 1 || rejected.Removed || rejected.Code != codeLimitExceeded {
+		t.Fatalf("bidRejected = %+v", rejected)
+	}
+	expectDetails(t, "bidRejected", rejected.Details, ErrorDetails{"customer": "sam", "limit": limitBalance, "max": 10000, "value": 10045})
+	if len(s.pending(t, "charger1")) != 0 || len(s.orderBook(t, "charger1")) != 1 {
+		t.Fatalf("order book = %v", s.orderBook(t, "charger1"))
+	}
+
+	// It is filled once sam can be paid
+	s.mustInvoke(t, "admin", "setLimits", "", "", "20000")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "1")
+	if pt := s.pending(t, "charger1"); len(pt) != 1 || pt[0].Buyer != "james" || pt[0].Energy != wholeAmount(10) {
+		t.Fatalf("pending = %+v", pt)
+	}
+	if n := len(s.orderBook(t, "charger1")); n != 0 {
+		t.Fatalf("%d bids left, want 0", n)
+	}
+}
+
+func TestPlaceBidValidation(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "admin", "addRole", "ghost", "customer")
+	later := s.later()
+
+	expectError(t, s.mustFail(t, "james", "placeBid", "charger1", "james", "10", "5"), "Expecting 5")
+	expectError(t, s.mustFail(t, "james", "placeBid", "charger1", "james", "", "5", later), "Third argument (units of energy to buy) cannot be an empty string")
+	expectError(t, s.mustFail(t, "james", "placeBid", "charger9", "james", "10", "5", later), "Charger charger9 does not exist")
+	expectError(t, s.mustFail(t, "ghost", "placeBid", "charger1", "ghost", "10", "5", later), "ghost is not a valid buyer")
+	expectError(t, s.mustFail(t, "james", "placeBid", "charger1", "james", "0", "5", later), "Third argument (units of energy to buy) must be a decimal string greater than 0")
+	expectError(t, s.mustFail(t, "james", "placeBid", "charger1", "james", "10", "x", later), "Fourth argument (max price per unit) must be a decimal string")
+	expectError(t, s.mustFail(t, "james", "placeBid", "charger1", "james", "10", "0", later), "Fourth argument (max price per unit) must be a decimal string greater than 0")
+	expectError(t, s.mustFail(t, "james", "placeBid", "charger1", "james", "10", "5", "soon"), "Fifth argument (expiry) must be an integer string")
+	expectError(t, s.mustFail(t, "james", "placeBid", "charger1", "james", "10", "5", "1490000000"), "Fifth argument (expiry) must be later than the current time")
+	expectError(t, s.mustFail(t, "james", "placeBid", "charger1", "sam", "10", "5", later), "james is not allowed to call placeBid for sam")
+	expectError(t, s.mustFail(t, "charger1", "placeBid", "charger1", "charger1", "10", "5", later), "requires role customer")
+	if n := len(s.orderBook(t, "charger1")); n != 0 {
+		t.Fatalf("%d bids placed, want 0", n)
+	}
+}
+
+func TestCancelBid(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "admin", "addCustomer", "ross")
+	s.mustInvoke(t, "james", "placeBid", "charger1", "james", "10", "5", s.later())
+	s.mustInvoke(t, "ross", "placeBid", "charger1", "ross", "10", "5", s.later())
+
+	expectError(t, s.mustFail(t, "ross", "cancelBid", "charger1", "1"), "ross is not allowed to call cancelBid for james")
+	expectError(t, s.mustFail(t, "james", "cancelBid", "charger1"), "Expecting 2")
+	expectError(t, s.mustFail(t, "james", "cancelBid", "", "1"), "First argument (charger ID) cannot be an empty string")
+	expectError(t, s.mustFail(t, "james", "cancelBid", "charger1", ""), "Second argument (bid ID) cannot be an empty string")
+	expectError(t, s.mustFail(t, "james", "cancelBid", "charger1", "one"), "Second argument (bid ID) must be an integer string")
+	expectError(t, s.mustFail(t, "james", "cancelBid", "charger1", "9"), "Bid 9 does not exist at charger charger1")
+
+	s.mustInvoke(t, "james", "cancelBid", "Charger1", "1")
+	bids := s.orderBook(t, "charger1")
+	if len(bids) != 1 || bids[0].Buyer != "ross" {
+		t.Fatalf("order book = %v", bids)
+	}
+	expectError(t, s.mustFail(t, "james", "cancelBid", "charger1", "1"), "Bid 1 does not exist at charger charger1")
+}
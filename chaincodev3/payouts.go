@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var payoutObjectType = "payout"      // payout~payoutID -> Payout
+var lastPayoutIDKey = "_lastpayoutid" // key for the ID given to the most recent payout
+
+// Statuses of a payout, only pending payouts can be settled
+var payoutPending = "Pending"
+var payoutConfirmed = "Confirmed"
+var payoutRejected = "Rejected"
+
+// Payout structure
+// A withdrawal from a customer's balance, paid out by an off-chain settlement process
+// The amount is taken from the balance when the payout is requested and given back if it is rejected
+type Payout struct {
+	PayoutID	int64	`json:"payoutid"`
+	Customer	string	`json:"customer"`
+	Amount		Amount	`json:"amount"`
+	Status		string	`json:"status"`
+	Requested	int64	`json:"requested"`
+	Settled		int64	`json:"settled,omitempty"`
+	Reference	string	`json:"reference,omitempty"`
+}
+
+type QueryResponsePayouts struct {
+	Success	bool		`json:"success"`
+	Data	[]Payout	`json:"data"`
+}
+
+//////////////////////////////////////// QUERY FUNCTIONS ////////////////////////////////////////
+
+// Get payouts in the order they were requested
+// Optionally only those of one customer and with one status
+func getPayouts(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	var customerID, status string
+	if len(args) > 0 {
+		customerID = strings.ToLower(args[0])
+	}
+	if len(args) > 1 {
+		status = strings.ToLower(args[1])
+	}
+	fmt.Println("Trying to get payouts")
+
+	// Payout IDs are zero padded, so the payouts come back in the order they were requested
+	payouts := []Payout{}
+	err := getStateByPartialCompositeKey(stub, payoutObjectType, []string{}, func(key string, valAsBytes []byte) error {
+		var payout Payout
+		json.Unmarshal(valAsBytes, &payout)
+		if len(customerID) > 0 && payout.Customer != customerID {
+			return nil
+		}
+		if len(status) > 0 && strings.ToLower(payout.Status) != status {
+			return nil
+		}
+		payouts = append(payouts, payout)
+		return nil
+	})
+	if err != nil {
+		return createQueryError(codeStateError, "Failed to get payouts")
+	}
+
+	return createQueryResponsePayouts(true, payouts)
+
+}
+
+//////////////////////////////////////// INVOKE FUNCTIONS ////////////////////////////////////////
+
+// Take funds out of a customer's balance and hold them in a pending payout
+func withdrawFunds(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	var retStr string
+	var payout Payout
+
+	customerID := strings.ToLower(args[0])
+	amount, _ := parseAmount(args[1])
+
+	// Debug message
+	fmt.Println("Trying to withdraw " + args[1] + " from " + customerID + "'s balance")
+
+	// Make sure the customer exists and can cover the payout
+	customers, err := getCustomerBalances(stub, customerID)
+	if err != nil {
+		retStr = "Could not get customer " + customerID + " from chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+	if _, ok := customers[customerID]; !ok {
+		retStr = "Could not find customer " + customerID + " to withdraw funds"
+		return createInvokeErrorDetails(codeUnknownCustomer, retStr, ErrorDetails{"customer": customerID})
+	}
+	if customers[customerID] < amount {
+		retStr = "Customer does not have enough funds: amount = " + amount.String() + ", available funds = " + customers[customerID].String()
+		return createInvokeErrorDetails(codeInsufficientFunds, retStr, ErrorDetails{"customer": customerID, "required": amount, "available": customers[customerID]})
+	}
+
+	payout.Customer = customerID
+	payout.Amount = amount
+	payout.Status = payoutPending
+	payout.Requested, err = getTxTimestamp(stub)
+	if err != nil {
+		retStr = "Could not get transaction timestamp"
+		return createInvokeError(codeStateError, retStr)
+	}
+	payout.PayoutID, err = nextPayoutID(stub)
+	if err != nil {
+		retStr = "Could not get next payout ID from chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+
+	// Hold the amount until the payout is settled
+	err = applyLedgerEntries(stub, customers, []LedgerEntry{{Customer: customerID, Type: entryWithdrawal, Amount: -amount, PayoutID: payout.PayoutID}})
+	if err != nil {
+		retStr = "Could not withdraw funds: " + err.Error()
+		return createInvokeErrorFrom(err, retStr)
+	}
+	err = putCustomerBalances(stub, customers)
+	if err != nil {
+		retStr = "Could not write customer " + customerID + " to chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+	err = putPayout(stub, payout)
+	if err != nil {
+		retStr = "Could not write payout to chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+
+	// Tell the settlement process about the payout
+	err = emitEvent(stub, eventPayoutRequested, PayoutEvent{Payout: payout, Balance: customers[customerID]})
+	if err != nil {
+		retStr = "Could not emit event: " + err.Error()
+		return createInvokeErrorFrom(err, retStr)
+	}
+
+	// Successful return
+	retStr = "Successfully requested payout " + strconv.FormatInt(payout.PayoutID, 10) + " of " + amount.String() + " to " + customerID
+	return createInvokeResponse(retStr, payout)
+
+}
+
+// Record that the settlement process paid out a pending payout
+func confirmPayout(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	return settlePayout(stub, args, payoutConfirmed)
+}
+
+// Record that the settlement process could not pay out a pending payout
+// The amount goes back to the customer's balance
+func rejectPayout(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	return settlePayout(stub, args, payoutRejected)
+}
+
+//////////////////////////////////////// UTILITY FUNCTIONS ////////////////////////////////////////
+
+// Confirm or reject a pending payout, with an optional settlement reference or reason
+func settlePayout(stub shim.ChaincodeStubInterface, args []string, status string) ([]byte, error) {
+
+	var retStr string
+	var payout Payout
+
+	payoutID, _ := strconv.ParseInt(args[0], 10, 64)
+
+	// Debug message
+	fmt.Println("Trying to set payout " + args[0] + " to " + status)
+
+	// Make sure the payout exists and has not been settled yet
+	payoutBytes, err := stub.GetState(createCompositeKey(payoutObjectType, fmt.Sprintf("%020d", payoutID)))
+	if err != nil {
+		retStr = "Could not get payout " + args[0] + " from chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+	if len(payoutBytes) == 0 {
+		retStr = "Payout " + args[0] + " does not exist"
+		return createInvokeErrorDetails(codeUnknownPayout, retStr, ErrorDetails{"payout": payoutID})
+	}
+	json.Unmarshal(payoutBytes, &payout)
+	if payout.Status != payoutPending {
+		retStr = "Payout " + args[0] + " was already settled: " + payout.Status
+		return createInvokeErrorDetails(codePayoutSettled, retStr, ErrorDetails{"payout": payoutID, "status": payout.Status})
+	}
+
+	// A rejected payout gives the held amount back
+	customers, err := getCustomerBalances(stub, payout.Customer)
+	if err != nil {
+		retStr = "Could not get customer " + payout.Customer + " from chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+	eventType := eventPayoutConfirmed
+	if status == payoutRejected {
+		eventType = eventPayoutRejected
+		err = applyLedgerEntries(stub, customers, []LedgerEntry{{Customer: payout.Customer, Type: entryPayoutReturned, Amount: payout.Amount, PayoutID: payout.PayoutID}})
+		if err != nil {
+			retStr = "Could not return payout: " + err.Error()
+			return createInvokeErrorFrom(err, retStr)
+		}
+		err = putCustomerBalances(stub, customers)
+		if err != nil {
+			retStr = "Could not write customer " + payout.Customer + " to chaincode state"
+			return createInvokeError(codeStateError, retStr)
+		}
+	}
+
+	payout.Status = status
+	payout.Settled, err = getTxTimestamp(stub)
+	if err != nil {
+		retStr = "Could not get transaction timestamp"
+		return createInvokeError(codeStateError, retStr)
+	}
+	if len(args) > 1 {
+		payout.Reference = args[1]
+	}
+	err = putPayout(stub, payout)
+	if err != nil {
+		retStr = "Could not write payout to chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+
+	// Tell subscribers about the settlement
+	err = emitEvent(stub, eventType, PayoutEvent{Payout: payout, Balance: customers[payout.Customer]})
+	if err != nil {
+		retStr = "Could not emit event: " + err.Error()
+		return createInvokeErrorFrom(err, retStr)
+	}
+
+	// Successful return
+	retStr = "Successfully set payout " + args[0] + " to " + status
+	return createInvokeResponse(retStr, payout)
+
+}
+
+// Write a payout to its own key, payout~payoutID
+func putPayout(stub shim.ChaincodeStubInterface, payout Payout) (error) {
+	return marshalAndPut(stub, createCompositeKey(payoutObjectType, fmt.Sprintf("%020d", payout.PayoutID)), payout)
+}
+
+// Get the next payout ID from the counter in the chaincode state
+func nextPayoutID(stub shim.ChaincodeStubInterface) (int64, error) {
+
+	var lastPayoutID int64
+
+	lastPayoutIDBytes, err := stub.GetState(lastPayoutIDKey)
+	if err != nil {
+		return 0, err
+	}
+	json.Unmarshal(lastPayoutIDBytes, &lastPayoutID)
+
+	lastPayoutID++
+	err = marshalAndPut(stub, lastPayoutIDKey, lastPayoutID)
+	if err != nil {
+		return 0, err
+	}
+	return lastPayoutID, nil
+
+}
+
+func createQueryResponsePayouts(success bool, data []Payout) ([]byte, error) {
+	var response QueryResponsePayouts
+	response.Success = success
+	response.Data = data
+	r, _ := json.Marshal(response)
+	return r, nil
+}
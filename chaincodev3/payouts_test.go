@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestWithdrawFunds(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "100")
+
+	// The amount is held as soon as the payout is requested
+	var payout Payout
+	s.invokeData(t, &payout, "james", "withdrawFunds", "James", "2000")
+	if payout != (Payout{PayoutID: 1, Customer: "james", Amount: wholeAmount(2000), Status: payoutPending, Requested: s.now}) {
+		t.Fatalf("withdrawFunds returned %+v", payout)
+	}
+	var data PayoutEvent
+	json.Unmarshal(s.lastEvent(t, eventPayoutRequested).Events[0].Data, &data)
+	if data.Payout != payout || data.Balance != wholeAmount(7500) {
+		t.Fatalf("payoutRequested event = %+v", data)
+	}
+
+	// The charger's owner takes out what it was paid
+	s.mustInvoke(t, "sam", "withdrawFunds", "sam", "500")
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 0, "james": 7500})
+
+	details := s.mustFailDetails(t, codeInsufficientFunds, "james", "withdrawFunds", "james", "7501")
+	expectDetails(t, "withdrawFunds", details, ErrorDetails{"customer": "james", "required": 7501, "available": 7500})
+	s.mustFailWith(t, codeInsufficientFunds, "sam", "withdrawFunds", "sam", "1")
+	s.mustFailWith(t, codeNotAllowed, "sam", "withdrawFunds", "james", "1")
+	s.mustFailWith(t, codeNotAllowed, "admin", "withdrawFunds", "james", "1")
+	s.mustFailWith(t, codeBadArgument, "james", "withdrawFunds", "james", "0")
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 0, "james": 7500})
+	if n := len(s.payouts(t)); n != 2 {
+		t.Fatalf("%d payouts, want 2", n)
+	}
+
+	// A retried withdrawal is only requested once
+	s.mustInvoke(t, "james", "withdrawFunds", "james", "100", "withdrawal-1")
+	s.mustInvoke(t, "james", "withdrawFunds", "james", "100", "withdrawal-1")
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 0, "james": 7400})
+}
+
+func TestSettlePayouts(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "james", "withdrawFunds", "james", "1000")
+	s.mustInvoke(t, "james", "withdrawFunds", "james", "2000")
+
+	var payout Payout
+	s.invokeData(t, &payout, "admin", "confirmPayout", "1", "wire-0042")
+	if payout.Status != payoutConfirmed || payout.Settled != s.now || payout.Reference != "wire-0042" {
+		t.Fatalf("confirmPayout returned %+v", payout)
+	}
+	s.lastEvent(t, eventPayoutConfirmed)
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 0, "james": 7000})
+
+	// A rejected payout goes back to the balance
+	s.invokeData(t, &payout, "admin", "rejectPayout", "2", "account closed")
+	if payout.Status != payoutRejected || payout.Reference != "account closed" {
+		t.Fatalf("rejectPayout returned %+v", payout)
+	}
+	var data PayoutEvent
+	json.Unmarshal(s.lastEvent(t, eventPayoutRejected).Events[0].Data, &data)
+	if data.Balance != wholeAmount(9000) {
+		t.Fatalf("payoutRejected event = %+v", data)
+	}
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 0, "james": 9000})
+
+	details := s.mustFailDetails(t, codePayoutSettled, "admin", "rejectPayout", "1")
+	expectDetails(t, "rejectPayout", details, ErrorDetails{"payout": 1, "status": payoutConfirmed})
+	s.mustFailWith(t, codePayoutSettled, "admin", "confirmPayout", "2")
+	details = s.mustFailDetails(t, codeUnknownPayout, "admin", "confirmPayout", "3")
+	expectDetails(t, "confirmPayout", details, ErrorDetails{"payout": 3})
+	s.mustFailWith(t, codeNotAllowed, "james", "confirmPayout", "1")
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 0, "james": 9000})
+}
+
+func TestGetPayouts(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "admin", "addCustomerFunds", "sam", "100")
+	s.mustInvoke(t, "james", "withdrawFunds", "james", "1000")
+	s.mustInvoke(t, "sam", "withdrawFunds", "sam", "10")
+	s.mustInvoke(t, "james", "withdrawFunds", "james", "20")
+	s.mustInvoke(t, "admin", "confirmPayout", "1")
+
+	expectIDs := func(what string, payouts []Payout, want ...int64) {
+		if len(payouts) != len(want) {
+			t.Fatalf("%s: got %+v, want payouts %v", what, payouts, want)
+		}
+		for i, payout := range payouts {
+			if payout.PayoutID != want[i] {
+				t.Fatalf("%s: got %+v, want payouts %v", what, payouts, want)
+			}
+		}
+	}
+	expectIDs("all payouts", s.payouts(t), 1, 2, 3)
+	expectIDs("james's payouts", s.payouts(t, "James"), 1, 3)
+	expectIDs("pending payouts", s.payouts(t, "", "pending"), 2, 3)
+	expectIDs("james's pending payouts", s.payouts(t, "james", "Pending"), 3)
+	expectIDs("ross's payouts", s.payouts(t, "ross"))
+	s.queryFailsWith(t, codeBadArgument, "getPayouts", "james", "paid")
+}
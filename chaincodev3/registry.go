@@ -0,0 +1,485 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Kinds of chaincode functions
+var kindInvoke = "invoke"
+var kindQuery = "query"
+
+// Types of arguments, every argument is passed as a string
+var argString = "string"   // any non-empty string
+var argInteger = "integer" // base 10 integer string, between min and max if they are set
+var argDecimal = "decimal" // amount of money or energy, a decimal string with at most amountScale decimal places
+var argEnum = "enum"       // one of values, case insensitive
+var argJSON = "json"       // JSON text, passed as JSON rather than as a string in an object argument
+
+// Argument of a chaincode function
+// Name is the argument's field in a schema, description is used in error messages
+// Optional arguments may be left out or passed as empty strings
+type ArgSpec struct {
+	Name		string		`json:"name"`
+	Description	string		`json:"description"`
+	Type		string		`json:"type"`
+	Optional	bool		`json:"optional"`
+	Min			*int64		`json:"min,omitempty"`
+	Max			*int64		`json:"max,omitempty"`
+	Positive	bool		`json:"positive,omitempty"`
+	Values		[]string	`json:"values,omitempty"`
+}
+
+// Chaincode function
+// Repeated is a group of arguments that follows args one or more times, like the offers of addTransaction
+// Group is the array field holding the repeated groups when the arguments are passed as a JSON object
+// Paged functions return a page of results when called with any argument, so a JSON object passes every argument even if all are left out
+type FunctionSpec struct {
+	Name		string		`json:"name"`
+	Kind		string		`json:"kind"`
+	Args		[]ArgSpec	`json:"args"`
+	Repeated	[]ArgSpec	`json:"repeated,omitempty"`
+	Group		string		`json:"group,omitempty"`
+	Paged		bool		`json:"paged,omitempty"`
+	handler		func(stub shim.ChaincodeStubInterface, args []string) ([]byte, error)
+}
+
+type QueryResponseFunctions struct {
+	Success	bool			`json:"success"`
+	Data	[]FunctionSpec	`json:"data"`
+}
+
+// Every invoke and query function, by kind and name
+// Invoke and Query only dispatch functions of their own kind
+var functionRegistry = map[string]map[string]FunctionSpec{}
+
+func init() {
+	chargerID := stringArg("charger", "charger ID")
+	idempotencyKey := stringArg("idempotencyKey", "idempotency key").optional()
+
+	registerFunctions(kindQuery, []FunctionSpec{
+		{Name: "read", Args: []ArgSpec{stringArg("name", "variable name")}, handler: read},
+		{Name: "getPendingTransaction", Args: []ArgSpec{chargerID}, handler: getPendingTransaction},
+		{Name: "getOffers", Args: []ArgSpec{chargerID}, handler: getOffers},
+		{Name: "getOfferTiers", Args: []ArgSpec{chargerID}, handler: getOfferTiers},
+		{Name: "getChargers", handler: getChargers},
+		{Name: "getTransactions", Args: []ArgSpec{
+			intArg("pageSize", "page size").between(1, int64(maxTransactionsPageSize)).optional(),
+			stringArg("bookmark", "bookmark").optional(),
+			stringArg("buyer", "buyer").optional(),
+			stringArg("status", "status").optional(),
+			intArg("firstTXID", "first TXID").optional(),
+			intArg("lastTXID", "last TXID").optional(),
+			intArg("firstTimestamp", "first timestamp").optional(),
+			intArg("lastTimestamp", "last timestamp").optional(),
+			enumArg("synthetic", "injected transactions", syntheticInclude, syntheticOnly).optional(),
+		}, Paged: true, handler: getTransactions},
+		{Name: "getCustomers", handler: getCustomers},
+		{Name: "getCustomer", Args: []ArgSpec{stringArg("customer", "customer ID")}, handler: getCustomer},
+		{Name: "getTotalEnergyForSale", Args: []ArgSpec{chargerID}, handler: getTotalEnergyForSale},
+		{Name: "getOrderBook", Args: []ArgSpec{chargerID}, handler: getOrderBook},
+		{Name: "getCustomerStatement", Args: []ArgSpec{
+			stringArg("customer", "customer ID"),
+			intArg("firstTimestamp", "first timestamp").optional(),
+			intArg("lastTimestamp", "last timestamp").optional(),
+		}, handler: getCustomerStatement},
+		{Name: "getPayouts", Args: []ArgSpec{
+			stringArg("customer", "customer ID").optional(),
+			enumArg("status", "status", "pending", "confirmed", "rejected").optional(),
+		}, handler: getPayouts},
+		{Name: "getLimits", handler: getLimits},
+		{Name: "auditLedger", handler: auditLedger},
+		{Name: "getRoles", Args: []ArgSpec{stringArg("enrollmentID", "enrollment ID")}, handler: getRoles},
+		{Name: "listFunctions", handler: listFunctions},
+	})
+
+	registerFunctions(kindInvoke, []FunctionSpec{
+		{Name: "addOfferQuantity", Args: []ArgSpec{
+			chargerID,
+			decimalArg("offer", "offer ID").positive(),
+			decimalArg("quantity", "quantity to add").positive(),
+			stringArg("seller", "seller's customer ID").optional(),
+		}, handler: addOfferQuantity},
+		{Name: "subtractOfferQuantity", Args: []ArgSpec{
+			chargerID,
+			decimalArg("offer", "offer ID").positive(),
+			decimalArg("quantity", "quantity to subtract").positive(),
+			stringArg("seller", "seller's customer ID").optional(),
+		}, handler: subtractOfferQuantity},
+		{Name: "addCustomer", Args: []ArgSpec{stringArg("customer", "customer ID")}, handler: addCustomer},
+		{Name: "addCustomerFunds", Args: []ArgSpec{
+			stringArg("customer", "customer ID"),
+			decimalArg("amount", "amount to add").positive(),
+			idempotencyKey,
+		}, handler: idempotent("addCustomerFunds", 2, addCustomerFunds)},
+		{Name: "addCharger", Args: []ArgSpec{chargerID, stringArg("owner", "owner's customer ID")}, handler: addCharger},
+		{Name: "acceptOffer", Args: []ArgSpec{
+			chargerID,
+			stringArg("customer", "customer ID"),
+			decimalArg("quantity", "units of energy to buy").positive(),
+			decimalArg("maxPrice", "max price per unit").positive().optional(),
+			enumArg("fillMode", "fill mode", fillOrKill, partialFill).optional(),
+			idempotencyKey,
+		}, handler: idempotent("acceptOffer", 5, acceptOffer)},
+		{Name: "completeTransaction", Args: []ArgSpec{chargerID}, handler: completeTransaction},
+		{Name: "cancelTransaction", Args: []ArgSpec{chargerID, decimalArg("quantity", "units to refund").positive()}, handler: cancelTransaction},
+		{Name: "addTransaction", Args: []ArgSpec{
+			enumArg("version", "argument version", addTransactionVersion),
+			intArg("timestamp", "timestamp"),
+			stringArg("buyer", "buyer"),
+			decimalArg("energy", "units of energy"),
+			decimalArg("cost", "cost"),
+		}, Repeated: []ArgSpec{
+			decimalArg("tier", "price tier"),
+			decimalArg("quantity", "units bought at the price tier"),
+		}, Group: "offers", handler: addTransaction},
+		{Name: "placeBid", Args: []ArgSpec{
+			chargerID,
+			stringArg("customer", "customer ID"),
+			decimalArg("quantity", "units of energy to buy").positive(),
+			decimalArg("maxPrice", "max price per unit").positive(),
+			intArg("expiry", "expiry"),
+		}, handler: placeBid},
+		{Name: "cancelBid", Args: []ArgSpec{chargerID, intArg("bid", "bid ID")}, handler: cancelBid},
+		{Name: "migrateState", Args: []ArgSpec{stringArg("charger", "charger ID for offers and pending transaction that predate chargers").optional()}, handler: migrateState},
+		{Name: "addRole", Args: []ArgSpec{stringArg("enrollmentID", "enrollment ID"), enumArg("role", "role", allRoles()...)}, handler: addRole},
+		{Name: "removeRole", Args: []ArgSpec{stringArg("enrollmentID", "enrollment ID"), stringArg("role", "role")}, handler: removeRole},
+		{Name: "setPendingTimeout", Args: []ArgSpec{intArg("timeout", "timeout in seconds").atLeast(1)}, handler: setPendingTimeout},
+		{Name: "expirePendingTransactions", Args: []ArgSpec{chargerID.optional()}, handler: expirePendingTransactions},
+		{Name: "withdrawFunds", Args: []ArgSpec{
+			stringArg("customer", "customer ID"),
+			decimalArg("amount", "amount to withdraw").positive(),
+			idempotencyKey,
+		}, handler: idempotent("withdrawFunds", 2, withdrawFunds)},
+		{Name: "transferFunds", Args: []ArgSpec{
+			stringArg("sender", "sender's customer ID"),
+			stringArg("receiver", "receiver's customer ID"),
+			decimalArg("amount", "amount to transfer").positive(),
+			stringArg("memo", "memo").optional(),
+			idempotencyKey,
+		}, handler: idempotent("transferFunds", 4, transferFunds)},
+		{Name: "confirmPayout", Args: []ArgSpec{intArg("payout", "payout ID"), stringArg("reference", "settlement reference").optional()}, handler: confirmPayout},
+		{Name: "rejectPayout", Args: []ArgSpec{intArg("payout", "payout ID"), stringArg("reason", "reason").optional()}, handler: rejectPayout},
+		{Name: "setIdempotencyWindow", Args: []ArgSpec{intArg("window", "window in seconds").atLeast(1)}, handler: setIdempotencyWindow},
+		{Name: "purgeIdempotencyKeys", handler: purgeIdempotencyKeys},
+		{Name: "purgeSyntheticTransactions", handler: purgeSyntheticTransactions},
+		{Name: "setLimits", Args: []ArgSpec{
+			decimalArg("maxQuantity", "max quantity").positive().optional(),
+			decimalArg("maxPrice", "max price per unit").positive().optional(),
+			decimalArg("maxBalance", "max balance").positive().optional(),
+		}, handler: setLimits},
+		{Name: "batch", Args: []ArgSpec{jsonArg("operations", "array of operations")}, handler: batch},
+		{Name: "init", Args: []ArgSpec{
+			intArg("value", "initial value"),
+			stringArg("admin", "admin's enrollment ID").optional(),
+		}, handler: func(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+			return new(SimpleChaincode).Init(stub, "init", args)
+		}},
+	})
+}
+
+func registerFunctions(kind string, specs []FunctionSpec) {
+	functionRegistry[kind] = make(map[string]FunctionSpec)
+	for _, spec := range specs {
+		spec.Kind = kind
+		functionRegistry[kind][spec.Name] = spec
+	}
+}
+
+func stringArg(name string, description string) ArgSpec {
+	return ArgSpec{Name: name, Description: description, Type: argString}
+}
+
+func intArg(name string, description string) ArgSpec {
+	return ArgSpec{Name: name, Description: description, Type: argInteger}
+}
+
+func decimalArg(name string, description string) ArgSpec {
+	return ArgSpec{Name: name, Description: description, Type: argDecimal}
+}
+
+func jsonArg(name string, description string) ArgSpec {
+	return ArgSpec{Name: name, Description: description, Type: argJSON}
+}
+
+func enumArg(name string, description string, values ...string) ArgSpec {
+	return ArgSpec{Name: name, Description: description, Type: argEnum, Values: values}
+}
+
+func (a ArgSpec) optional() ArgSpec {
+	a.Optional = true
+	return a
+}
+
+func (a ArgSpec) atLeast(min int64) ArgSpec {
+	a.Min = &min
+	return a
+}
+
+// Decimal arguments that must be greater than 0
+func (a ArgSpec) positive() ArgSpec {
+	a.Positive = true
+	return a
+}
+
+func (a ArgSpec) between(min int64, max int64) ArgSpec {
+	a.Min = &min
+	a.Max = &max
+	return a
+}
+
+//////////////////////////////////////// QUERY FUNCTIONS ////////////////////////////////////////
+
+// List the invoke and query functions with their arguments, sorted by kind and name
+func listFunctions(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	var specs []FunctionSpec
+	for _, kind := range []string{kindInvoke, kindQuery} {
+		var names []string
+		for name := range functionRegistry[kind] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			specs = append(specs, functionRegistry[kind][name])
+		}
+	}
+
+	return createQueryResponseFunctions(true, specs)
+
+}
+
+//////////////////////////////////////// UTILITY FUNCTIONS ////////////////////////////////////////
+
+// Look up a function of a kind, returns false if there is none
+func lookupFunction(kind string, name string) (FunctionSpec, bool) {
+	spec, ok := functionRegistry[kind][name]
+	return spec, ok
+}
+
+// Check the number, presence and types of the arguments of a function
+// Returns a BAD_ARGUMENT error describing the first problem, so functions only check what depends on the chaincode state
+func (spec FunctionSpec) validate(args []string) (error) {
+
+	minArgs := 0
+	for i, arg := range spec.Args {
+		if !arg.Optional {
+			minArgs = i + 1
+		}
+	}
+	if len(spec.Repeated) > 0 {
+		// Every argument before the repeated group is required
+		extra := len(args) - len(spec.Args)
+		if extra < len(spec.Repeated) || extra % len(spec.Repeated) != 0 {
+			return newChaincodeError(codeBadArgument, "Incorrect number of arguments. Expecting " + strconv.Itoa(len(spec.Args)) + " followed by one or more groups of " + strconv.Itoa(len(spec.Repeated)) + ": " + describeArgs(spec.Args) + ", then groups of " + describeArgs(spec.Repeated) + ", received " + strconv.Itoa(len(args)), nil)
+		}
+	} else if len(args) < minArgs || len(args) > len(spec.Args) {
+		return newChaincodeError(codeBadArgument, "Incorrect number of arguments. Expecting " + describeCount(minArgs, len(spec.Args)) + describeArgs(spec.Args), nil)
+	}
+
+	for i, value := range args {
+		var arg ArgSpec
+		if i < len(spec.Args) {
+			arg = spec.Args[i]
+		} else {
+			arg = spec.Repeated[(i - len(spec.Args)) % len(spec.Repeated)]
+		}
+		err := arg.validate(argumentName(i) + " (" + arg.Description + ")", value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+
+}
+
+// Turn a single JSON object argument into positional arguments, checking its fields against the function's arguments
+// Other arguments are positional and returned as they are, validate checks them
+func (spec FunctionSpec) arguments(args []string) ([]string, error) {
+
+	if len(args) != 1 || !strings.HasPrefix(strings.TrimSpace(args[0]), "{") {
+		return args, nil
+	}
+	var object map[string]json.RawMessage
+	err := json.Unmarshal([]byte(args[0]), &object)
+	if err != nil {
+		return nil, newChaincodeError(codeBadArgument, "Argument object is not a valid JSON object: " + err.Error(), nil)
+	}
+
+	positional, err := objectArguments(spec.Args, object, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(spec.Repeated) > 0 {
+		var groups []map[string]json.RawMessage
+		raw, ok := object[spec.Group]
+		delete(object, spec.Group)
+		if !ok || json.Unmarshal(raw, &groups) != nil || len(groups) == 0 {
+			return nil, newChaincodeError(codeBadArgument, "Field \"" + spec.Group + "\" must be an array of one or more objects with fields " + describeFields(spec.Repeated), nil)
+		}
+		for i, group := range groups {
+			values, err := objectArguments(spec.Repeated, group, spec.Group + "[" + strconv.Itoa(i) + "].")
+			if err != nil {
+				return nil, err
+			}
+			for name := range group {
+				return nil, newChaincodeError(codeBadArgument, "Unknown field \"" + spec.Group + "[" + strconv.Itoa(i) + "]." + name + "\"", nil)
+			}
+			positional = append(positional, values...)
+		}
+	} else if !spec.Paged {
+		// Optional arguments that were left out are dropped, as if they were not passed
+		for len(positional) > 0 && len(positional[len(positional) - 1]) == 0 {
+			positional = positional[:len(positional) - 1]
+		}
+	}
+
+	if len(object) > 0 {
+		var names []string
+		for name := range object {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, newChaincodeError(codeBadArgument, "Unknown field \"" + names[0] + "\", expecting " + describeFields(spec.Args), nil)
+	}
+	return positional, nil
+
+}
+
+// Take the fields of the arguments out of an object and check them, in the order of the arguments
+// Fields are strings or numbers, a missing or null field is an empty string
+func objectArguments(args []ArgSpec, object map[string]json.RawMessage, prefix string) ([]string, error) {
+
+	values := make([]string, len(args))
+	for i, arg := range args {
+		name := "Field \"" + prefix + arg.Name + "\" (" + arg.Description + ")"
+		raw, ok := object[arg.Name]
+		delete(object, arg.Name)
+		if !ok || string(raw) == "null" {
+			if !arg.Optional {
+				return nil, newChaincodeError(codeBadArgument, name + " is missing", nil)
+			}
+			continue
+		}
+
+		var number json.Number
+		if arg.Type == argJSON {
+			values[i] = string(raw)
+		} else if json.Unmarshal(raw, &values[i]) != nil {
+			if json.Unmarshal(raw, &number) != nil {
+				return nil, newChaincodeError(codeBadArgument, name + " must be a string or a number", nil)
+			}
+			values[i] = number.String()
+		}
+		err := arg.validate(name, values[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+
+}
+
+// Check a single argument, name tells the caller which one it is
+func (arg ArgSpec) validate(name string, value string) (error) {
+
+	if len(value) == 0 {
+		if arg.Optional {
+			return nil
+		}
+		return newChaincodeError(codeBadArgument, name + " cannot be an empty string", nil)
+	}
+
+	switch arg.Type {
+	case argInteger:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return newChaincodeError(codeBadArgument, name + " must be an integer string", nil)
+		}
+		if arg.Min != nil && arg.Max != nil && (n < *arg.Min || n > *arg.Max) {
+			return newChaincodeError(codeBadArgument, name + " must be between " + strconv.FormatInt(*arg.Min, 10) + " and " + strconv.FormatInt(*arg.Max, 10), nil)
+		}
+		if arg.Min != nil && n < *arg.Min {
+			if *arg.Min == 0 {
+				return newChaincodeError(codeBadArgument, name + " must not be negative", nil)
+			}
+			return newChaincodeError(codeBadArgument, name + " must be an integer string greater than " + strconv.FormatInt(*arg.Min - 1, 10), nil)
+		}
+	case argDecimal:
+		amount, err := parseAmount(value)
+		if err != nil {
+			return newChaincodeError(codeBadArgument, name + " must be a decimal string with at most " + strconv.Itoa(amountScale) + " decimal places", nil)
+		}
+		if arg.Positive && amount <= 0 {
+			return newChaincodeError(codeBadArgument, name + " must be a decimal string greater than 0", nil)
+		}
+	case argEnum:
+		for _, v := range arg.Values {
+			if strings.ToLower(value) == v {
+				return nil
+			}
+		}
+		return newChaincodeError(codeBadArgument, name + " must be one of \"" + strings.Join(arg.Values, "\", \"") + "\"", nil)
+	case argJSON:
+		var v interface{}
+		err := json.Unmarshal([]byte(value), &v)
+		if err != nil {
+			return newChaincodeError(codeBadArgument, name + " must be valid JSON: " + err.Error(), nil)
+		}
+	}
+	return nil
+
+}
+
+// Describe how many arguments a function takes: "2", "3 or 4", "3 to 5" or "up to 8"
+func describeCount(min int, max int) string {
+	if min == max {
+		return strconv.Itoa(min) + ": "
+	} else if min + 1 == max {
+		return strconv.Itoa(min) + " or " + strconv.Itoa(max) + ": "
+	} else if min == 0 {
+		return "up to " + strconv.Itoa(max) + ": "
+	}
+	return strconv.Itoa(min) + " to " + strconv.Itoa(max) + ": "
+}
+
+func describeArgs(args []ArgSpec) string {
+	descriptions := make([]string, len(args))
+	for i, arg := range args {
+		descriptions[i] = arg.Description
+		if arg.Optional {
+			descriptions[i] = "(optional) " + arg.Description
+		}
+	}
+	return strings.Join(descriptions, ", ")
+}
+
+func describeFields(args []ArgSpec) string {
+	names := make([]string, len(args))
+	for i, arg := range args {
+		names[i] = arg.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+// Position of an argument in words, as used in error messages
+func argumentName(i int) string {
+	ordinals := []string{"First", "Second", "Third", "Fourth", "Fifth", "Sixth", "Seventh", "Eighth", "Ninth", "Tenth"}
+	if i < len(ordinals) {
+		return ordinals[i] + " argument"
+	}
+	return "Argument " + strconv.Itoa(i + 1)
+}
+
+func createQueryResponseFunctions(success bool, data []FunctionSpec) ([]byte, error) {
+	var response QueryResponseFunctions
+	response.Success = success
+	response.Data = data
+	r, _ := json.Marshal(response)
+	return r, nil
+}
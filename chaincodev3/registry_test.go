@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestListFunctions(t *testing.T) {
+	s := newMarket(t)
+	var specs []FunctionSpec
+	s.query(t, &specs, "listFunctions")
+
+	byName := make(map[string]FunctionSpec)
+	invokes, queries := 0, 0
+	for i, spec := range specs {
+		byName[spec.Kind + " " + spec.Name] = spec
+		if spec.Kind == kindInvoke {
+			invokes++
+			if i >= invokes {
+				t.Fatalf("invoke function %s is listed after a query function", spec.Name)
+			}
+		} else {
+			queries++
+		}
+	}
+	if invokes != len(functionRegistry[kindInvoke]) || queries != len(functionRegistry[kindQuery]) {
+		t.Fatalf("listed %d invoke and %d query functions", invokes, queries)
+	}
+
+	acceptOffer := byName["invoke acceptOffer"]
+	if len(acceptOffer.Args) != 6 || acceptOffer.Args[2].Name != "quantity" || acceptOffer.Args[2].Type != argDecimal || !acceptOffer.Args[2].Positive || acceptOffer.Args[2].Optional {
+		t.Fatalf("acceptOffer is listed as %+v", acceptOffer)
+	}
+	if fillMode := acceptOffer.Args[4]; !fillMode.Optional || fillMode.Type != argEnum || len(fillMode.Values) != 2 {
+		t.Fatalf("acceptOffer fill mode is listed as %+v", fillMode)
+	}
+	if addTransaction := byName["invoke addTransaction"]; len(addTransaction.Repeated) != 2 {
+		t.Fatalf("addTransaction is listed as %+v", addTransaction)
+	}
+	if getTransactions := byName["query getTransactions"]; len(getTransactions.Args) != 9 || *getTransactions.Args[0].Max != int64(maxTransactionsPageSize) {
+		t.Fatalf("getTransactions is listed as %+v", getTransactions)
+	}
+	if _, ok := byName["query listFunctions"]; !ok {
+		t.Fatal("listFunctions does not list itself")
+	}
+}
+
+// Every invoke function needs permissions, and every permission a function
+func TestInvokeFunctionsHavePermissions(t *testing.T) {
+	for name := range functionRegistry[kindInvoke] {
+		if _, ok := invokePermissions[name]; !ok {
+			t.Errorf("invoke function %s has no permissions", name)
+		}
+	}
+	for name := range invokePermissions {
+		if _, ok := functionRegistry[kindInvoke][name]; !ok {
+			t.Errorf("permissions are defined for unknown function %s", name)
+		}
+	}
+}
+
+func TestValidateArguments(t *testing.T) {
+	spec := FunctionSpec{Name: "test", Args: []ArgSpec{
+		stringArg("id", "ID"),
+		intArg("units", "units").atLeast(1),
+		intArg("size", "size").between(1, 10).optional(),
+		enumArg("mode", "mode", "fast", "slow").optional(),
+	}}
+
+	valid := [][]string{
+		{"a", "1"},
+		{"a", "1", ""},
+		{"a", "5", "10", "FAST"},
+		{"a", "5", "", "slow"},
+	}
+	for _, args := range valid {
+		if err := spec.validate(args); err != nil {
+			t.Errorf("%v: unexpected error %v", args, err)
+		}
+	}
+
+	invalid := []struct {
+		args	[]string
+		want	string
+	}{
+		{[]string{"a"}, "Incorrect number of arguments. Expecting 2 to 4: ID, units, (optional) size, (optional) mode"},
+		{[]string{"a", "1", "1", "fast", "x"}, "Expecting 2 to 4"},
+		{[]string{"", "1"}, "First argument (ID) cannot be an empty string"},
+		{[]string{"a", ""}, "Second argument (units) cannot be an empty string"},
+		{[]string{"a", "1.5"}, "Second argument (units) must be an integer string"},
+		{[]string{"a", "0"}, "Second argument (units) must be an integer string greater than 0"},
+		{[]string{"a", "1", "11"}, "Third argument (size) must be between 1 and 10"},
+		{[]string{"a", "1", "", "medium"}, "Fourth argument (mode) must be one of \"fast\", \"slow\""},
+	}
+	for _, c := range invalid {
+		err := spec.validate(c.args)
+		if err == nil || errorCode(err) != codeBadArgument {
+			t.Errorf("%v: got %v, want a %s error", c.args, err, codeBadArgument)
+			continue
+		}
+		expectError(t, err.Error(), c.want)
+	}
+}
+
+func TestValidateRepeatedArguments(t *testing.T) {
+	spec := FunctionSpec{Name: "test", Args: []ArgSpec{stringArg("id", "ID")}, Repeated: []ArgSpec{stringArg("key", "key"), intArg("value", "value")}}
+
+	for _, args := range [][]string{{"a", "k", "1"}, {"a", "k", "1", "l", "2"}} {
+		if err := spec.validate(args); err != nil {
+			t.Errorf("%v: unexpected error %v", args, err)
+		}
+	}
+	expectError(t, spec.validate([]string{"a"}).Error(), "Expecting 1 followed by one or more groups of 2: ID, then groups of key, value, received 1")
+	expectError(t, spec.validate([]string{"a", "k", "1", "l"}).Error(), "received 4")
+	expectError(t, spec.validate([]string{"a", "k", "1", "l", "x"}).Error(), "Fifth argument (value) must be an integer string")
+	expectError(t, spec.validate([]string{"a", "k", "1", "l", "2", "m", "3", "n", "4", "o", "x"}).Error(), "Argument 11 (value) must be an integer string")
+}
+
+func TestValidationBeforeDispatch(t *testing.T) {
+	s := newMarket(t)
+
+	// Checked before the state is looked at, so a missing charger is not reported
+	s.mustFailWith(t, codeBadArgument, "james", "acceptOffer", "charger9", "james", "0")
+	s.queryFailsWith(t, codeBadArgument, "getOffers", "charger1", "charger2")
+	s.queryFailsWith(t, codeBadArgument, "getChargers", "charger1")
+
+	// Permissions are checked first
+	s.mustFailWith(t, codeNotAllowed, "james", "addCustomer")
+}
+
+func TestObjectArguments(t *testing.T) {
+	s := newMarket(t)
+	var tiers map[string]map[string]int
+	var tx Transaction
+
+	s.invokeData(t, &tiers, "sam", "addOfferQuantity", `{"charger": "charger1", "offer": 5, "quantity": "100"}`)
+	expectTiers(t, "addOfferQuantity", tiers, map[string]map[string]int{"5": {"sam": 100}})
+
+	// Optional fields can be left out or null
+	s.invokeData(t, &tx, "james", "acceptOffer", `{"charger": "Charger1", "customer": "james", "quantity": 10, "maxPrice": null}`)
+	if tx.Buyer != "james" || tx.Energy != wholeAmount(10) || tx.Cost != wholeAmount(50) {
+		t.Fatalf("acceptOffer returned %+v", tx)
+	}
+	s.mustInvoke(t, "charger1", "completeTransaction", `{"charger": "charger1"}`)
+	s.invokeData(t, &tx, "james", "acceptOffer", `{"charger": "charger1", "customer": "james", "quantity": 200, "fillMode": "partial"}`)
+	if tx.Energy != wholeAmount(90) {
+		t.Fatalf("acceptOffer returned %+v", tx)
+	}
+
+	s.invokeData(t, &tx, "admin", "addTransaction", `{"version": 2, "timestamp": 1490249345, "buyer": "ross", "energy": 50, "cost": 260, "offers": [{"tier": 5, "quantity": 40}, {"tier": "6", "quantity": 10}]}`)
+	if tx.Timestamp != 1490249345 || tx.Buyer != "ross" || tx.Energy != wholeAmount(50) || tx.Cost != wholeAmount(260) {
+		t.Fatalf("addTransaction returned %+v", tx)
+	}
+	expectInts(t, "addTransaction offers", tx.Offers, map[string]int{"5": 40, "6": 10})
+
+	var page []Transaction
+	s.query(t, &page, "getTransactions", `{"pageSize": 1, "buyer": "ross", "synthetic": "include"}`)
+	if len(page) != 1 || page[0].Buyer != "ross" {
+		t.Fatalf("getTransactions returned %+v", page)
+	}
+	// An object is always a page, even with every field left out
+	var response QueryResponseTransactionsPage
+	retBytes, _ := testChaincode.Query(s, "getTransactions", []string{`{}`})
+	json.Unmarshal(retBytes, &response)
+	if !response.Success || !strings.Contains(string(retBytes), `"bookmark":""`) || len(response.Data) != 1 {
+		t.Fatalf("getTransactions {} returned %s", retBytes)
+	}
+	var balance int
+	s.query(t, &balance, "getCustomer", `{"customer": "james"}`)
+	if balance != 10000 - 500 {
+		t.Fatalf("getCustomer returned %d", balance)
+	}
+}
+
+func TestObjectArgumentsValidation(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+
+	expectError(t, s.mustFailWith(t, codeBadArgument, "james", "acceptOffer", `{"charger": "charger1", "customer": "james"`), "Argument object is not a valid JSON object")
+	expectError(t, s.mustFailWith(t, codeBadArgument, "james", "acceptOffer", `{"charger": "charger1", "customer": "james"}`), "Field \"quantity\" (units of energy to buy) is missing")
+	expectError(t, s.mustFailWith(t, codeBadArgument, "james", "acceptOffer", `{"charger": "charger1", "customer": "james", "quantity": 0}`), "Field \"quantity\" (units of energy to buy) must be a decimal string greater than 0")
+	expectError(t, s.mustFailWith(t, codeBadArgument, "james", "acceptOffer", `{"charger": "charger1", "customer": "james", "quantity": 1.23456}`), "Field \"quantity\" (units of energy to buy) must be a decimal string with at most 4 decimal places")
+	expectError(t, s.mustFailWith(t, codeBadArgument, "james", "acceptOffer", `{"charger": "charger1", "customer": "james", "quantity": true}`), "Field \"quantity\" (units of energy to buy) must be a string or a number")
+	expectError(t, s.mustFailWith(t, codeBadArgument, "james", "acceptOffer", `{"charger": "charger1", "customer": "james", "quantity": 1, "units": 1}`), "Unknown field \"units\", expecting charger, customer, quantity, maxPrice, fillMode")
+	expectError(t, s.mustFailWith(t, codeBadArgument, "admin", "addTransaction", `{"version": 2, "timestamp": 1, "buyer": "ross", "energy": 1, "cost": 1, "offers": []}`), "Field \"offers\" must be an array of one or more objects with fields tier, quantity")
+	expectError(t, s.mustFailWith(t, codeBadArgument, "admin", "addTransaction", `{"version": 2, "timestamp": 1, "buyer": "ross", "energy": 1, "cost": 1, "offers": [{"tier": 5}]}`), "Field \"offers[0].quantity\" (units bought at the price tier) is missing")
+	expectError(t, s.mustFailWith(t, codeBadArgument, "admin", "addTransaction", `{"version": 2, "timestamp": 1, "buyer": "ross", "energy": 1, "cost": 1, "offers": [{"tier": 5, "quantity": 1, "price": 5}]}`), "Unknown field \"offers[0].price\"")
+	expectError(t, s.queryFailsWith(t, codeBadArgument, "getTransactions", `{"pageSize": 1000}`), "Field \"pageSize\" (page size) must be between 1 and 100")
+
+	// The caller is checked against the fields like against positional arguments
+	s.mustFailWith(t, codeNotAllowed, "sam", "acceptOffer", `{"charger": "charger1", "customer": "james", "quantity": 1}`)
+	if n := len(s.pending(t, "charger1")); n != 0 {
+		t.Fatalf("%d pending transactions, want 0", n)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Invoke response struct, returned by every invoke function
+// Code is empty on success, Data holds the entity the invocation created or changed and is null on failure
+// Details holds the structured details of the error, see the catalogue in errors.go
+type InvokeResponse struct {
+	Success	bool			`json:"success"`
+	Code	string			`json:"code"`
+	Message	string			`json:"message"`
+	Details	ErrorDetails	`json:"details"`
+	Data	interface{}		`json:"data"`
+}
+
+// Returned by every query function that fails, Data holds the message
+type QueryResponseError struct {
+	Success	bool			`json:"success"`
+	Code	string			`json:"code"`
+	Details	ErrorDetails	`json:"details"`
+	Data	string			`json:"data"`
+}
+
+// Use the json package to marshal the entity and message of a successful invocation into a response
+func createInvokeResponse(message string, data interface{}) ([]byte, error) {
+	fmt.Println(message)
+	r, _ := json.Marshal(InvokeResponse{Success: true, Message: message, Data: data})
+	return r, nil
+}
+
+// Use the json package to marshal a failed invocation into a response
+// The response is returned as the error as well, so the transaction is rejected and the peer,
+// which drops the returned bytes of a failed invocation, still passes the code and details on
+func createInvokeError(code string, message string) ([]byte, error) {
+	return createInvokeErrorDetails(code, message, nil)
+}
+
+func createInvokeErrorDetails(code string, message string, details ErrorDetails) ([]byte, error) {
+	r, _ := json.Marshal(InvokeResponse{Success: false, Code: code, Message: message, Details: details})
+	return r, errors.New(string(r))
+}
+
+// Report an error of a utility function under its code and details
+func createInvokeErrorFrom(err error, message string) ([]byte, error) {
+	return createInvokeErrorDetails(errorCode(err), message, errorDetails(err))
+}
+
+// Use the json package to marshal a failed query into a response
+// No error is returned, the peer only passes the response of a query on to the client when there is none
+func createQueryError(code string, message string) ([]byte, error) {
+	return createQueryErrorDetails(code, message, nil)
+}
+
+func createQueryErrorDetails(code string, message string, details ErrorDetails) ([]byte, error) {
+	r, _ := json.Marshal(QueryResponseError{Success: false, Code: code, Details: details, Data: message})
+	return r, nil
+}
+
+// Report an error of a utility function under its code and details
+func createQueryErrorFrom(err error, message string) ([]byte, error) {
+	return createQueryErrorDetails(errorCode(err), message, errorDetails(err))
+}
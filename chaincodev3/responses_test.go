@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestInvokeResponseEntities(t *testing.T) {
+	s := newMarket(t)
+	var customer Customer
+	var charger Charger
+	var tiers map[string]map[string]int
+	var tx Transaction
+	var bid Bid
+	var roles []string
+
+	s.invokeData(t, &customer, "admin", "addCustomer", "Ross")
+	if customer != (Customer{ID: "ross", Balance: 0}) {
+		t.Fatalf("addCustomer returned %+v", customer)
+	}
+	s.invokeData(t, &customer, "admin", "addCustomerFunds", "ross", "300")
+	s.invokeData(t, &customer, "admin", "addCustomerFunds", "ross", "200")
+	if customer != (Customer{ID: "ross", Balance: wholeAmount(500)}) {
+		t.Fatalf("addCustomerFunds returned %+v", customer)
+	}
+	s.invokeData(t, &charger, "admin", "addCharger", "charger2", "ross")
+	if charger != (Charger{ID: "charger2", Owner: "ross"}) {
+		t.Fatalf("addCharger returned %+v", charger)
+	}
+
+	s.invokeData(t, &tiers, "sam", "addOfferQuantity", "charger1", "5", "100")
+	s.invokeData(t, &tiers, "sam", "addOfferQuantity", "charger1", "6", "100")
+	expectTiers(t, "addOfferQuantity", tiers, map[string]map[string]int{"5": {"sam": 100}, "6": {"sam": 100}})
+	tiers = nil
+	s.invokeData(t, &tiers, "sam", "subtractOfferQuantity", "charger1", "6", "40")
+	expectTiers(t, "subtractOfferQuantity", tiers, map[string]map[string]int{"5": {"sam": 100}, "6": {"sam": 60}})
+
+	s.invokeData(t, &tx, "james", "acceptOffer", "charger1", "james", "120")
+	if tx.Status != "Pending" || tx.Energy != wholeAmount(120) || tx.Cost != wholeAmount(620) || tx.Accepted != s.now {
+		t.Fatalf("acceptOffer returned %+v", tx)
+	}
+	s.invokeData(t, &tx, "charger1", "cancelTransaction", "charger1", "20")
+	if tx.Status != "Refunded 20" || tx.TXID != 1 || tx.Energy != wholeAmount(100) || tx.Cost != wholeAmount(500) {
+		t.Fatalf("cancelTransaction returned %+v", tx)
+	}
+	s.invokeData(t, &tx, "james", "acceptOffer", "charger1", "james", "10")
+	s.invokeData(t, &tx, "charger1", "completeTransaction", "charger1")
+	if tx.Status != "Completed" || tx.TXID != 2 || tx.Energy != wholeAmount(10) {
+		t.Fatalf("completeTransaction returned %+v", tx)
+	}
+	s.invokeData(t, &tx, "admin", "addTransaction", "2", "1490249345", "james", "1", "5", "5", "1")
+	if tx.TXID != 3 || tx.Timestamp != 1490249345 {
+		t.Fatalf("addTransaction returned %+v", tx)
+	}
+
+	// A bid that is filled right away has nothing left
+	s.invokeData(t, &bid, "ross", "placeBid", "charger1", "ross", "30", "6", s.later())
+	if bid.BidID != 1 || bid.Quantity != 0 {
+		t.Fatalf("placeBid returned %+v", bid)
+	}
+	s.invokeData(t, &bid, "james", "placeBid", "charger1", "james", "30", "6", s.later())
+	if bid.BidID != 2 || bid.Quantity != wholeAmount(30) {
+		t.Fatalf("placeBid returned %+v", bid)
+	}
+	bid = Bid{}
+	s.invokeData(t, &bid, "james", "cancelBid", "charger1", "2")
+	if bid.BidID != 2 || bid.Buyer != "james" || bid.Quantity != wholeAmount(30) {
+		t.Fatalf("cancelBid returned %+v", bid)
+	}
+
+	s.invokeData(t, &roles, "admin", "addRole", "ross", "admin")
+	if len(roles) != 3 || roles[2] != roleAdmin {
+		t.Fatalf("addRole returned %v", roles)
+	}
+	s.invokeData(t, &roles, "admin", "removeRole", "ross", "seller")
+	if len(roles) != 2 || roles[0] != roleCustomer || roles[1] != roleAdmin {
+		t.Fatalf("removeRole returned %v", roles)
+	}
+
+	var timeout int64
+	s.invokeData(t, &timeout, "admin", "setPendingTimeout", "10")
+	if timeout != 10 {
+		t.Fatalf("setPendingTimeout returned %d", timeout)
+	}
+	var expired ExpiryResult
+	s.now += defaultPendingTimeout
+	s.invokeData(t, &expired, "admin", "expirePendingTransactions")
+	if len(expired.Expired) != 1 || expired.Expired[0] != "charger1" || expired.Failed == nil || len(expired.Failed) != 0 {
+		t.Fatalf("expirePendingTransactions returned %+v", expired)
+	}
+}
+
+func TestInvokeErrorCodes(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+
+	s.mustFailWith(t, codeBadArgument, "admin", "addCustomerFunds", "james", "-1")
+	s.mustFailWith(t, codeBadArgument, "james", "acceptOffer", "charger1", "james")
+	s.mustFailWith(t, codeUnknownCharger, "james", "acceptOffer", "charger9", "james", "1")
+	s.mustFailWith(t, codeUnknownOffer, "sam", "subtractOfferQuantity", "charger1", "6", "1")
+	s.mustFailWith(t, codeCustomerExists, "admin", "addCustomer", "sam")
+	s.mustFailWith(t, codeInsufficientSupply, "james", "acceptOffer", "charger1", "james", "101")
+	s.mustFailWith(t, codeNotAllowed, "sam", "addCustomer", "ross")
+	s.mustFailWith(t, codeNotAllowed, "stranger", "addCustomer", "ross")
+	s.mustFailWith(t, codeUnknownFunction, "admin", "mintMoney")
+
+	// Errors of utility functions keep their code
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "100")
+	s.mustFailWith(t, codePendingTXExists, "james", "acceptOffer", "charger1", "james", "1")
+	s.mustInvoke(t, "admin", "addCharger", "charger2", "james")
+	s.mustInvoke(t, "james", "addOfferQuantity", "charger2", "10", "100")
+	s.mustInvoke(t, "sam", "acceptOffer", "charger2", "sam", "50")
+	s.mustFailWith(t, codeInsufficientFunds, "charger1", "cancelTransaction", "charger1", "100")
+
+	s.mustFailWith(t, codeNotAllowed, "", "addCustomer", "ross")
+}
+
+// The peer drops the response of a failed invocation and only passes its error on
+func TestInvokeErrorReachesClient(t *testing.T) {
+	s := newMarket(t)
+	var response InvokeResponse
+
+	s.caller = "james"
+	_, err := testChaincode.Invoke(s, "acceptOffer", []string{"charger1", "james", "1"})
+	if err == nil {
+		t.Fatalf("acceptOffer without supply succeeded")
+	}
+	json.Unmarshal([]byte(err.Error()), &response)
+	if response.Success || response.Code != codeInsufficientSupply || response.Message != "Requested 1 with only 0 available" {
+		t.Fatalf("acceptOffer returned the error %q", err)
+	}
+	expectDetails(t, "acceptOffer", response.Details, ErrorDetails{"charger": "charger1", "requested": 1, "available": 0, "maxprice": 0})
+}
+
+// The peer drops the response of a query that returns an error, so a failed query must not
+func TestQueryErrorReachesClient(t *testing.T) {
+	s := newMarket(t)
+	var response QueryResponseError
+
+	retBytes, err := testChaincode.Query(s, "getCustomer", []string{"nobody"})
+	json.Unmarshal(retBytes, &response)
+	if err != nil || response.Success || response.Code != codeUnknownCustomer || response.Data != "Failed to find customer with ID nobody" {
+		t.Fatalf("getCustomer returned %s, %v", retBytes, err)
+	}
+	expectDetails(t, "getCustomer", response.Details, ErrorDetails{"customer": "nobody"})
+}
+
+func TestInitResponse(t *testing.T) {
+	s := newMockStub()
+	var response InvokeResponse
+
+	retBytes, err := testChaincode.Init(s, "init", []string{"1", "admin"})
+	json.Unmarshal(retBytes, &response)
+	if err != nil || !response.Success || response.Message != "Chaincode state initialized successfully." {
+		t.Fatalf("init returned %s, %v", retBytes, err)
+	}
+	retBytes, err = testChaincode.Init(s, "init", []string{"one"})
+	if err == nil {
+		t.Fatalf("init returned %s", retBytes)
+	}
+	json.Unmarshal([]byte(err.Error()), &response)
+	if response.Success || response.Code != codeBadArgument {
+		t.Fatalf("init returned %s, %v", retBytes, err)
+	}
+}
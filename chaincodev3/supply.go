@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var supplyObjectType = "supply"                       // supply~chargerID~movementID -> SupplyMovement
+var lastSupplyMovementIDKey = "_lastsupplymovementid" // key for the ID given to the most recent supply movement
+
+// Types of supply movements
+var supplyOffered = "offered"     // addOfferQuantity
+var supplyWithdrawn = "withdrawn" // subtractOfferQuantity
+var supplyMigrated = "migrated"   // migrateState, what a seller had at a tier before movements were recorded
+
+// Supply movement structure
+// Units a seller put up for sale (positive quantity) or took back (negative quantity) at an offer tier of a charger
+// Units sold and refunded are in the transactions, so a tier holds its movements less what its transactions sold
+type SupplyMovement struct {
+	MovementID	int64	`json:"movementid"`
+	Charger		string	`json:"charger"`
+	Offer		string	`json:"offer"`
+	Seller		string	`json:"seller"`
+	Type		string	`json:"type"`
+	Quantity	Amount	`json:"quantity"`
+	Available	Amount	`json:"available"`
+	Timestamp	int64	`json:"timestamp"`
+}
+
+//////////////////////////////////////// UTILITY FUNCTIONS ////////////////////////////////////////
+
+// Write a supply movement to its own key with the next movement ID and the transaction timestamp
+func putSupplyMovement(stub shim.ChaincodeStubInterface, movement SupplyMovement) (error) {
+
+	var lastMovementID int64
+
+	timestamp, err := getTxTimestamp(stub)
+	if err != nil {
+		return err
+	}
+	lastMovementIDBytes, err := stub.GetState(lastSupplyMovementIDKey)
+	if err != nil {
+		return err
+	}
+	json.Unmarshal(lastMovementIDBytes, &lastMovementID)
+
+	lastMovementID++
+	err = marshalAndPut(stub, lastSupplyMovementIDKey, lastMovementID)
+	if err != nil {
+		return err
+	}
+	movement.MovementID = lastMovementID
+	movement.Timestamp = timestamp
+	return marshalAndPut(stub, createCompositeKey(supplyObjectType, movement.Charger, fmt.Sprintf("%020d", movement.MovementID)), movement)
+
+}
+
+// Add the units a transaction took from each seller at each tier to sold, keyed like the offer tiers
+// Pending transactions accepted before sellers were recorded took their units from the owner of the charger
+// Past transactions without sellers were completed before supply was recorded, and injected ones never took any units
+func addSoldUnits(sold map[string]Amount, transaction Transaction, pending bool, owner string) (error) {
+
+	var err error
+
+	if isInjectedTransaction(transaction) {
+		return nil
+	}
+	sellers := transaction.Sellers
+	if sellers == nil && pending {
+		sellers = make(map[string]map[string]Amount)
+		for offerID, units := range transaction.Offers {
+			sellers[offerID] = map[string]Amount{owner: units}
+		}
+	}
+	for offerID, tier := range sellers {
+		for seller, units := range tier {
+			key := createCompositeKey(offerObjectType, transaction.Charger, offerID, seller)
+			sold[key], err = addAmounts(sold[key], units)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+
+}
+
+// Record the supply of every charger that has no supply movements yet, one migrated movement per seller and tier
+// A tier's units are what it holds plus what the charger's transactions sold from it, so it adds up from then on
+// Returns the IDs of the chargers whose supply was recorded
+func migrateChargerSupply(stub shim.ChaincodeStubInterface) ([]string, error) {
+
+	var chargerIDs, migrated []string
+
+	// Chargers that already have movements are recorded from their first offer on
+	recorded := make(map[string]bool)
+	err := getStateByPartialCompositeKey(stub, supplyObjectType, nil, func(key string, valAsBytes []byte) error {
+		_, attributes := splitCompositeKey(key)
+		recorded[attributes[0]] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	chargers := make(map[string]Charger)
+	err = getStateByPartialCompositeKey(stub, chargerObjectType, nil, func(key string, valAsBytes []byte) error {
+		var charger Charger
+		json.Unmarshal(valAsBytes, &charger)
+		chargers[charger.ID] = charger
+		if !recorded[charger.ID] {
+			chargerIDs = append(chargerIDs, charger.ID)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(chargerIDs) == 0 {
+		return nil, nil
+	}
+
+	// Units sold by the past and pending transactions
+	sold := make(map[string]Amount)
+	err = getStateByPartialCompositeKey(stub, transactionObjectType, nil, func(key string, valAsBytes []byte) error {
+		var transaction Transaction
+		json.Unmarshal(valAsBytes, &transaction)
+		return addSoldUnits(sold, transaction, false, chargers[transaction.Charger].Owner)
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = getStateByPartialCompositeKey(stub, pendingTransactionObjectType, nil, func(key string, valAsBytes []byte) error {
+		var pendingTransaction []Transaction
+		json.Unmarshal(valAsBytes, &pendingTransaction)
+		for _, transaction := range pendingTransaction {
+			err := addSoldUnits(sold, transaction, true, chargers[transaction.Charger].Owner)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, chargerID := range chargerIDs {
+		tiers, err := getChargerOfferTiers(stub, chargerID)
+		if err != nil {
+			return nil, err
+		}
+		supply := make(map[string]Amount)
+		for pricePerUnit, tier := range tiers {
+			for seller, quantity := range tier {
+				supply[createCompositeKey(offerObjectType, chargerID, pricePerUnit, seller)] = quantity
+			}
+		}
+		for key, units := range sold {
+			_, attributes := splitCompositeKey(key)
+			if attributes[0] == chargerID {
+				supply[key], err = addAmounts(supply[key], units)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		if len(supply) == 0 {
+			continue
+		}
+
+		// In key order so every peer gives out the same movement IDs
+		keys := make([]string, 0, len(supply))
+		for key := range supply {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			_, attributes := splitCompositeKey(key)
+			pricePerUnit, seller := attributes[1], attributes[2]
+			err = putSupplyMovement(stub, SupplyMovement{Charger: chargerID, Offer: pricePerUnit, Seller: seller, Type: supplyMigrated, Quantity: supply[key], Available: tiers[pricePerUnit][seller]})
+			if err != nil {
+				return nil, err
+			}
+		}
+		migrated = append(migrated, chargerID)
+	}
+	return migrated, nil
+
+}
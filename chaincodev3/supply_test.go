@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func (s *mockStub) supply(t *testing.T, chargerID string) []SupplyMovement {
+	var movements []SupplyMovement
+	err := getStateByPartialCompositeKey(s, supplyObjectType, []string{chargerID}, func(key string, valAsBytes []byte) error {
+		var movement SupplyMovement
+		json.Unmarshal(valAsBytes, &movement)
+		movements = append(movements, movement)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("supply of %s: %v", chargerID, err)
+	}
+	return movements
+}
+
+func expectMovement(t *testing.T, got SupplyMovement, offerID string, seller string, movementType string, quantity int, available int) {
+	if got.Offer != offerID || got.Seller != seller || got.Type != movementType || got.Quantity != wholeAmount(int64(quantity)) || got.Available != wholeAmount(int64(available)) {
+		t.Fatalf("got movement %+v, want %s %d at %s by %s leaving %d", got, movementType, quantity, offerID, seller, available)
+	}
+}
+
+func TestOfferQuantityIsRecorded(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+	s.mustInvoke(t, "sam", "subtractOfferQuantity", "charger1", "5", "30")
+
+	// Subtracting more than the seller has takes back what they have
+	s.mustInvoke(t, "sam", "subtractOfferQuantity", "charger1", "5", "500")
+	s.mustFail(t, "sam", "subtractOfferQuantity", "charger1", "5", "10")
+
+	movements := s.supply(t, "charger1")
+	if len(movements) != 3 {
+		t.Fatalf("supply movements = %+v", movements)
+	}
+	expectMovement(t, movements[0], "5", "sam", supplyOffered, 100, 100)
+	expectMovement(t, movements[1], "5", "sam", supplyWithdrawn, -30, 70)
+	expectMovement(t, movements[2], "5", "sam", supplyWithdrawn, -70, 0)
+	if movements[2].MovementID != 3 || movements[2].Timestamp <= movements[0].Timestamp {
+		t.Fatalf("last movement = %+v", movements[2])
+	}
+}
+
+func TestAuditChecksSupply(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "admin", "addCustomer", "ross")
+	s.mustInvoke(t, "admin", "addRole", "ross", "seller")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+	s.mustInvoke(t, "ross", "addOfferQuantity", "charger1", "6", "20", "ross")
+
+	// Sold and refunded units come from the transactions
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "110")
+	s.mustInvoke(t, "charger1", "cancelTransaction", "charger1", "5")
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "5")
+	s.mustInvoke(t, "ross", "subtractOfferQuantity", "charger1", "6", "5", "ross")
+	expectTiers(t, "tiers", s.offerTiers(t, "charger1"), map[string]map[string]int{"6": {"ross": 5}})
+	report := s.audit(t)
+	if !report.Consistent {
+		t.Fatalf("audit returned %+v", report)
+	}
+
+	// A tier that holds more than was offered, and a tier that was removed while it still had units
+	marshalAndPut(s, createCompositeKey(offerObjectType, "charger1", "6", "ross"), wholeAmount(8))
+	report = s.audit(t)
+	expectChecks(t, "discrepancies", report.Discrepancies, auditSupply)
+	expectDetails(t, "supply", report.Discrepancies[0].Details, ErrorDetails{"charger": "charger1", "offer": "6", "seller": "ross", "expected": wholeAmount(5), "actual": wholeAmount(8)})
+	delete(s.state, createCompositeKey(offerObjectType, "charger1", "6", "ross"))
+	report = s.audit(t)
+	expectChecks(t, "discrepancies", report.Discrepancies, auditSupply)
+	expectDetails(t, "supply", report.Discrepancies[0].Details, ErrorDetails{"charger": "charger1", "offer": "6", "seller": "ross", "expected": wholeAmount(5), "actual": Amount(0)})
+}
+
+func TestMigrateStateRecordsSupply(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "admin", "addCharger", "charger2", "james")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "6", "10")
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "20")
+	s.mustInvoke(t, "charger1", "completeTransaction", "charger1")
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "85")
+
+	// Offers added before supply movements were recorded
+	for key := range s.state {
+		if strings.HasPrefix(key, supplyObjectType + compositeKeySeparator) || key == lastSupplyMovementIDKey {
+			delete(s.state, key)
+		}
+	}
+	report := s.audit(t)
+	expectChecks(t, "discrepancies", report.Discrepancies, auditLegacyState)
+	expectDetails(t, "legacyState", report.Discrepancies[0].Details, ErrorDetails{"key": createCompositeKey(supplyObjectType, "charger1")})
+
+	// The sold out tier is recorded with what was sold from it, charger2 has nothing to record
+	s.mustInvoke(t, "admin", "migrateState")
+	movements := s.supply(t, "charger1")
+	if len(movements) != 2 || len(s.supply(t, "charger2")) != 0 {
+		t.Fatalf("supply movements = %+v", movements)
+	}
+	expectMovement(t, movements[0], "5", "sam", supplyMigrated, 100, 0)
+	expectMovement(t, movements[1], "6", "sam", supplyMigrated, 10, 5)
+	if report := s.audit(t); !report.Consistent {
+		t.Fatalf("audit returned %+v", report)
+	}
+
+	// The pending transaction is settled against the migrated supply
+	s.mustInvoke(t, "charger1", "cancelTransaction", "charger1", "30")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "1")
+	if report := s.audit(t); !report.Consistent {
+		t.Fatalf("audit returned %+v", report)
+	}
+	expectError(t, s.mustFail(t, "admin", "migrateState"), "No legacy chaincode state to migrate")
+}
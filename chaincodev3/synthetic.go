@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+var syntheticTransactionObjectType = "synthetictx" // synthetictx~TXID~n -> Transaction injected with addTransaction
+
+// Source of the transactions injected with addTransaction, real sales have none
+var sourceAddTransaction = "addTransaction"
+
+// First argument of addTransaction
+// Earlier versions took the TXID first, the version makes sure a caller of that form is rejected instead of setting the timestamp
+var addTransactionVersion = "2"
+
+// Values of the synthetic argument of getTransactions
+var syntheticInclude = "include" // real and injected transactions
+var syntheticOnly = "only"       // injected transactions only
+
+//////////////////////////////////////// INVOKE FUNCTIONS ////////////////////////////////////////
+
+// Delete every injected transaction, meant to be run before go-live
+// Transactions injected before they were kept apart are recognized by their missing status
+func purgeSyntheticTransactions(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	var retStr string
+	var keys []string
+	purged := []int64{}
+
+	// Debug message
+	fmt.Println("Trying to purge the injected transactions")
+
+	// Collect the keys first, the state shouldn't change while it is being iterated over
+	for _, objectType := range []string{transactionObjectType, syntheticTransactionObjectType} {
+		err := getStateByPartialCompositeKey(stub, objectType, nil, func(key string, valAsBytes []byte) error {
+			var transaction Transaction
+			json.Unmarshal(valAsBytes, &transaction)
+			if isInjectedTransaction(transaction) {
+				keys = append(keys, key)
+				purged = append(purged, transaction.TXID)
+			}
+			return nil
+		})
+		if err != nil {
+			retStr = "Could not get transactions from chaincode state"
+			return createInvokeError(codeStateError, retStr)
+		}
+	}
+
+	for _, key := range keys {
+		err := stub.DelState(key)
+		if err != nil {
+			retStr = "Could not delete transaction " + key + " from chaincode state"
+			return createInvokeError(codeStateError, retStr)
+		}
+	}
+
+	// Successful return
+	retStr = "Successfully purged " + strconv.Itoa(len(purged)) + " injected transactions"
+	return createInvokeResponse(retStr, purged)
+
+}
+
+//////////////////////////////////////// UTILITY FUNCTIONS ////////////////////////////////////////
+
+// Transactions written by addTransaction have a source
+// Those injected before they were kept apart have no charger and no status, unlike any accepted offer
+func isInjectedTransaction(transaction Transaction) (bool) {
+	return len(transaction.Source) > 0 || (len(transaction.Charger) == 0 && len(transaction.Status) == 0)
+}
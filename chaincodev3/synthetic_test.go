@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSyntheticTransactionsAreKeptApart(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "10")
+	s.mustInvoke(t, "charger1", "completeTransaction", "charger1")
+	s.mustInvoke(t, "admin", "addTransaction", "2", "1490000000", "james", "20", "100", "5", "20")
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "10")
+	s.mustInvoke(t, "charger1", "completeTransaction", "charger1")
+	s.mustInvoke(t, "admin", "addTransaction", "2", "1490000000", "ross", "10", "50", "5", "10")
+
+	var page QueryResponseTransactionsPage
+	getPage := func(args ...string) {
+		retBytes, err := testChaincode.Query(s, "getTransactions", args)
+		if err != nil {
+			t.Fatalf("getTransactions %v: unexpected error: %v", args, err)
+		}
+		page = QueryResponseTransactionsPage{}
+		json.Unmarshal(retBytes, &page)
+		if !page.Success {
+			t.Fatalf("getTransactions %v failed: %s", args, retBytes)
+		}
+	}
+	txids := func() string {
+		ids := []string{}
+		for _, tx := range page.Data {
+			ids = append(ids, strconv.FormatInt(tx.TXID, 10))
+		}
+		return strings.Join(ids, ",")
+	}
+
+	getPage()
+	if txids() != "1,3" {
+		t.Fatalf("real transactions %s", txids())
+	}
+	getPage("", "", "", "", "", "", "", "", "only")
+	if txids() != "2,4" {
+		t.Fatalf("injected transactions %s", txids())
+	}
+	getPage("", "", "", "", "", "", "", "", "include")
+	if txids() != "1,2,3,4" {
+		t.Fatalf("all transactions %s", txids())
+	}
+
+	// Bookmarks carry over from one kind of transaction to the other
+	getPage("2", "", "", "", "", "", "", "", "include")
+	if txids() != "1,2" || !strings.HasPrefix(page.Bookmark, syntheticTransactionObjectType) {
+		t.Fatalf("first page %s, bookmark %q", txids(), page.Bookmark)
+	}
+	getPage("2", page.Bookmark, "", "", "", "", "", "", "include")
+	if txids() != "3,4" || page.Bookmark != "" {
+		t.Fatalf("last page %s, bookmark %q", txids(), page.Bookmark)
+	}
+	getPage("1", "", "", "", "", "", "", "", "include")
+	expectError(t, s.queryFails(t, "getTransactions", "1", page.Bookmark, "", "", "", "", "", "", "only"), "is not a valid bookmark")
+
+	getPage("", "", "", "", "2", "3", "", "", "include")
+	if txids() != "2,3" {
+		t.Fatalf("TXIDs 2 to 3: %s", txids())
+	}
+	expectError(t, s.queryFails(t, "getTransactions", "", "", "", "", "", "", "", "", "all"), "must be one of")
+}
+
+func TestPurgeSyntheticTransactions(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "10")
+	s.mustInvoke(t, "charger1", "completeTransaction", "charger1")
+	s.mustInvoke(t, "admin", "addTransaction", "2", "1490000000", "james", "20", "100", "5", "20")
+
+	// Injected before they were kept apart, with no source and no status, its TXID is its old timestamp
+	marshalAndPut(s, createCompositeKey(transactionObjectType, "00000000001489999999", "0"), Transaction{TXID: 1489999999, Timestamp: 1489999999, Buyer: "ross", Offers: map[string]Amount{"5": wholeAmount(1)}, Cost: wholeAmount(5), Energy: wholeAmount(1)})
+	report := s.audit(t)
+	if len(report.InjectedTransactions) != 2 {
+		t.Fatalf("audit returned %+v", report)
+	}
+
+	s.mustFailWith(t, codeNotAllowed, "james", "purgeSyntheticTransactions")
+	var purged []int64
+	s.invokeData(t, &purged, "admin", "purgeSyntheticTransactions")
+	if len(purged) != 2 || purged[0] != 1489999999 || purged[1] != 2 {
+		t.Fatalf("purged %v", purged)
+	}
+
+	var all []Transaction
+	s.query(t, &all, "getTransactions", `{"synthetic": "include"}`)
+	if len(all) != 1 || all[0].TXID != 1 {
+		t.Fatalf("transactions after purge = %+v", all)
+	}
+	report = s.audit(t)
+	if !report.Consistent || len(report.InjectedTransactions) != 0 {
+		t.Fatalf("audit after purge returned %+v", report)
+	}
+
+	// Nothing left to purge, and the TXIDs of purged transactions are not reused
+	s.invokeData(t, &purged, "admin", "purgeSyntheticTransactions")
+	if len(purged) != 0 {
+		t.Fatalf("purged %v", purged)
+	}
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "1")
+	s.mustInvoke(t, "charger1", "completeTransaction", "charger1")
+	if all = s.transactions(t); len(all) != 2 || all[1].TXID != 3 {
+		t.Fatalf("transactions after purge = %+v", all)
+	}
+}
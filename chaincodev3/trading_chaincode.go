@@ -6,7 +6,6 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	"sort"
@@ -17,35 +16,72 @@ import (
 type SimpleChaincode struct {
 }
 
-var customersKey = "_customers"       // key for list of customers
-var offersKey = "_offers"             // key for list of current offers
-var transactionsKey = "_transactions" // key for list of transactions
-var pendingTransactionKey = "_pendingtransaction" // key for tracking the pending transaction
+// Every entity is stored under its own composite key: objectType~attribute~attribute...
+var compositeKeySeparator = "~"
+var compositeKeyMaxSuffix = "\U0010FFFF"  // sorts after any attribute, used to bound range queries
+
+var customerObjectType = "customer"               // customer~customerID -> account balance
+var chargerObjectType = "charger"                 // charger~chargerID -> Charger
+var offerObjectType = "offer"                     // offer~chargerID~pricePerUnit~seller -> units for sale
+var pendingTransactionObjectType = "pending"      // pending~chargerID -> pending transaction array
+var transactionObjectType = "tx"                  // tx~TXID~n -> past Transaction
+
+// Keys of the monolithic JSON blobs used by earlier versions of the chaincode
+// Only read by migrateState, which splits them into per-entity keys
+var legacyCustomersKey = "_customers"
+var legacyChargersKey = "_chargers"
+var legacyOffersKey = "_offers"
+var legacyTransactionsKey = "_transactions"
+var legacyPendingTransactionKey = "_pendingtransaction"
+
+var lastTXIDKey = "_lasttxid" // key for the TXID given to the most recent past transaction
+
+// Fill modes of acceptOffer
+var fillOrKill = "fillorkill" // buy every requested unit or nothing
+var partialFill = "partial"   // buy as many of the requested units as are available
+
+var maxTransactionsPageSize = 100 // largest page of transactions returned by a paginated getTransactions
 
 // Transaction structure
 type Transaction struct {
-	TXID 	int64 			`json:"txid"`
-	Offers	map[string]int 	`json:"offers"`
+	TXID 		int64 			`json:"txid"`
+	Timestamp	int64			`json:"timestamp"`
+	Charger		string			`json:"charger"`
+	Offers	map[string]Amount 	`json:"offers"`
+	Sellers	map[string]map[string]Amount	`json:"sellers"`
 	Buyer	string			`json:"buyer"`
-	Cost 	int				`json:"cost"`
-	Energy 	int				`json:"energy"`
+	Cost 	Amount			`json:"cost"`
+	Energy 	Amount			`json:"energy"`
 	Status 	string			`json:"status"`
+	Accepted	int64		`json:"accepted"`
+	Timeout		int64		`json:"timeout"`
+	Source		string		`json:"source,omitempty"`
+	InjectedBy	string		`json:"injectedby,omitempty"`
+}
+
+// Charger structure
+// Each charger sells its own offer tiers and pays its revenue to its owner's customer account
+type Charger struct {
+	ID		string	`json:"id"`
+	Owner	string	`json:"owner"`
+}
+
+// Customer account, returned by addCustomer and addCustomerFunds
+// Only the balance is stored, under the customer's key
+type Customer struct {
+	ID		string	`json:"id"`
+	Balance	Amount	`json:"balance"`
 }
 
 // Query response structs, used to provide a predictable response structure
-type QueryResponseInt struct {
+type QueryResponseAmount struct {
 	Success	bool	`json:"success"`
-	Data	int		`json:"data"`
+	Data	Amount	`json:"data"`
 }
 
 type QueryResponseMap struct {
 	Success	bool			`json:"success"`
-	Data	map[string]int	`json:"data"`
-}
-
-type QueryResponseString struct {
-	Success	bool	`json:"success"`
-	Data	string	`json:"data"`
+	Data	map[string]Amount	`json:"data"`
 }
 
 type QueryResponseTransactions struct {
@@ -53,6 +89,25 @@ type QueryResponseTransactions struct {
 	Data	[]Transaction	`json:"data"`
 }
 
+// Returned by getTransactions when it is called with paging arguments
+// Bookmark is passed back to getTransactions to get the next page, it is empty on the last page
+type QueryResponseTransactionsPage struct {
+	Success		bool			`json:"success"`
+	Data		[]Transaction	`json:"data"`
+	Bookmark	string			`json:"bookmark"`
+}
+
+// Returned by getOfferTiers, price per unit to seller to units for sale
+type QueryResponseOfferTiers struct {
+	Success	bool						`json:"success"`
+	Data	map[string]map[string]Amount	`json:"data"`
+}
+
+type QueryResponseChargers struct {
+	Success	bool				`json:"success"`
+	Data	map[string]Charger	`json:"data"`
+}
+
 type QueryResponseBytes struct {
 	Success	bool	`json:"success"`
 	Data	[]byte	`json:"data"`
@@ -74,59 +129,113 @@ func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface, function string
 	var err error
 	var retStr string
 
-	// Check the number of args passed in
-	if len(args) != 1 {
-		retStr = "Incorrect number of arguments. Expecting 1: Initial value"
-		return []byte(retStr), errors.New(retStr)
+	// Check the args passed in, Init is also called directly when the chaincode is deployed
+	spec, _ := lookupFunction(kindInvoke, "init")
+	args, err = spec.arguments(args)
+	if err != nil {
+		return createInvokeErrorFrom(err, err.Error())
 	}
-
-	// Get initial value
-	initVal, err = strconv.Atoi(args[0])
+	err = spec.validate(args)
 	if err != nil {
-		retStr = "Incorrect number of arguments. Expecting 1: Initial value"
-		return []byte(retStr), errors.New(retStr)
+		return createInvokeErrorFrom(err, err.Error())
+	}
+
+	// The admin defaults to whoever deploys or re-initializes the chaincode
+	var adminID string
+	if len(args) == 2 && len(args[1]) > 0 {
+		adminID = strings.ToLower(args[1])
+	} else {
+		adminID, err = getCallerID(stub)
+		if err != nil {
+			retStr = "Could not determine the admin: " + err.Error()
+			return createInvokeError(codeBadArgument, retStr)
+		}
 	}
 
+	// Get initial value
+	initVal, _ = strconv.Atoi(args[0])
+
 	// Write initVal to the ledger
 	// Use test var ece because reasons
 	err = stub.PutState("ece", []byte(strconv.Itoa(initVal)))
 	if err != nil {
-		return nil, err
+		return createInvokeError(codeStateError, "Could not reset chaincode state: " + err.Error())
 	}
 
-	// Clear/initialize the list of customers
-	// "owner" represents the owner of the charger and is always present
-	emptyCustomers := make(map[string]int)
-	emptyCustomers["owner"] = 0
-	err = marshalAndPut(stub, customersKey, emptyCustomers)
+	// A chaincode deployed on top of an earlier version has no roles yet, one that already has them is being reset
+	reset := false
+	err = getStateByPartialCompositeKey(stub, roleObjectType, nil, func(key string, valAsBytes []byte) error {
+		reset = true
+		return nil
+	})
 	if err != nil {
-		return nil, err
+		return createInvokeError(codeStateError, "Could not reset chaincode state: " + err.Error())
+	}
+
+	// Clear the customers, chargers, offers, supply movements, pending transactions, past and injected transactions, payouts, ledgers and idempotency keys
+	// Charger owners are regular customers and are added with addCustomer
+	objectTypes := []string{customerObjectType, chargerObjectType, offerObjectType, supplyObjectType, pendingTransactionObjectType, transactionObjectType, syntheticTransactionObjectType, bidObjectType, roleObjectType, payoutObjectType, ledgerObjectType, idempotencyObjectType}
+	for _, objectType := range objectTypes {
+		err = deleteStateByObjectType(stub, objectType)
+		if err != nil {
+			return createInvokeError(codeStateError, "Could not reset chaincode state: " + err.Error())
+		}
 	}
 
-	// Clear the list of offers
-	emptyOffers := make(map[string]int)
-	err = marshalAndPut(stub, offersKey, emptyOffers)
+	// Restart TXIDs, bid IDs, payout IDs, ledger entry IDs and supply movement IDs
+	err = stub.DelState(lastTXIDKey)
 	if err != nil {
-		return nil, err
+		return createInvokeError(codeStateError, "Could not reset chaincode state: " + err.Error())
+	}
+	err = stub.DelState(lastBidIDKey)
+	if err != nil {
+		return createInvokeError(codeStateError, "Could not reset chaincode state: " + err.Error())
+	}
+	err = stub.DelState(lastPayoutIDKey)
+	if err != nil {
+		return createInvokeError(codeStateError, "Could not reset chaincode state: " + err.Error())
+	}
+	err = stub.DelState(lastLedgerEntryIDKey)
+	if err != nil {
+		return createInvokeError(codeStateError, "Could not reset chaincode state: " + err.Error())
+	}
+	err = stub.DelState(lastSupplyMovementIDKey)
+	if err != nil {
+		return createInvokeError(codeStateError, "Could not reset chaincode state: " + err.Error())
 	}
 
-	// Clear the list of transactions
-	var emptyTransactions []Transaction
-	err = marshalAndPut(stub, transactionsKey, emptyTransactions)
+	// Go back to the default pending transaction timeout, idempotency window and limits
+	err = stub.DelState(pendingTimeoutKey)
 	if err != nil {
-		return nil, err
+		return createInvokeError(codeStateError, "Could not reset chaincode state: " + err.Error())
+	}
+	err = stub.DelState(idempotencyWindowKey)
+	if err != nil {
+		return createInvokeError(codeStateError, "Could not reset chaincode state: " + err.Error())
+	}
+	err = stub.DelState(limitsKey)
+	if err != nil {
+		return createInvokeError(codeStateError, "Could not reset chaincode state: " + err.Error())
 	}
 
-	// Clear the pendingTransaction array
-	var emptyPendingTransaction []Transaction
-	err = marshalAndPut(stub, pendingTransactionKey, emptyPendingTransaction)
+	// Monolithic blobs left over from earlier versions are kept for migrateState when deploying
+	// A reset wipes them with the rest, or migrateState would bring the old state back
+	if reset {
+		err = deleteLegacyState(stub)
+		if err != nil {
+			return createInvokeError(codeStateError, "Could not reset chaincode state: " + err.Error())
+		}
+	}
+
+	// Everything else is done through the admin
+	err = grantRole(stub, adminID, roleAdmin)
 	if err != nil {
-		return nil, err
+		return createInvokeError(codeStateError, "Could not reset chaincode state: " + err.Error())
 	}
 
 	// Successful init return
 	retStr = "Chaincode state initialized successfully."
-	return []byte(retStr), nil
+	return createInvokeResponse(retStr, nil)
 }
 
 // Invoke function - entry point for invocations
@@ -135,34 +244,48 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface, function stri
 	// Print debug message
 	fmt.Println("Invoke() is running: " + function)
 
-	// Handle the different possible function calls
-	switch function {
-	case "addOfferQuantity":
-		return addOfferQuantity(stub, args)
-	case "subtractOfferQuantity":
-		return subtractOfferQuantity(stub, args)
-	case "addCustomer":
-		return addCustomer(stub, args)
-	case "addCustomerFunds":
-		return addCustomerFunds(stub, args)
-	case "acceptOffer":
-		return acceptOffer(stub, args)
-	case "completeTransaction":
-		return completeTransaction(stub)
-	case "cancelTransaction":
-		return cancelTransaction(stub, args)
-	case "addTransaction":
-		return addTransaction(stub, args)
-	case "init":
-		return t.Init(stub, "init", args)
-	default:
-		// Print error message if function not found
-		fmt.Println("Invoke() did not find function: " + function)
-		// Return error
-		return []byte("Invoke() did not find function: " + function), errors.New("Received unknown function invocation: " + function)
-	}
-
-	return nil, nil
+	// Invoke functions record their events on the wrapped stub
+	es := &eventStub{ChaincodeStubInterface: stub}
+	retBytes, err := invokeFunction(es, function, args)
+
+	// Clients are only told about invocations that succeeded
+	if err == nil {
+		err = es.flushEvents()
+		if err != nil {
+			return createInvokeError(codeStateError, "Could not set chaincode event: " + err.Error())
+		}
+	}
+	return retBytes, err
+
+}
+
+// Look up an invoke function, check the caller and the arguments and run it
+// Used by Invoke and for every operation of a batch
+func invokeFunction(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
+
+	spec, ok := lookupFunction(kindInvoke, function)
+	if !ok {
+		// Return error if function not found
+		return createInvokeErrorDetails(codeUnknownFunction, "Received unknown function invocation: " + function, ErrorDetails{"function": function})
+	}
+
+	// Arguments can also be passed as a single JSON object, functions only see positional arguments
+	args, err := spec.arguments(args)
+	if err != nil {
+		return createInvokeErrorFrom(err, err.Error())
+	}
+
+	// Make sure the caller is allowed to call this function
+	err = checkInvokePermission(stub, function, args)
+	if err != nil {
+		return createInvokeErrorFrom(err, err.Error())
+	}
+	err = spec.validate(args)
+	if err != nil {
+		return createInvokeErrorFrom(err, err.Error())
+	}
+
+	return spec.handler(stub, args)
 
 }
 
@@ -185,28 +308,24 @@ func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function strin
 	// Debug message
 	fmt.Println("Query() is running: " + function)
 
-	// Handle the different types of query functions
-	if function == "read" {
-		return read(stub, args)
-	} else if function == "getPendingTransaction" {
-		return getPendingTransaction(stub)
-	} else if function == "getOffers" {
-		return getOffers(stub)
-	} else if function == "getTransactions" {
-		return getTransactions(stub)
-	} else if function == "getCustomers" {
-		return getCustomers(stub)
-	} else if function == "getCustomer" {
-		return getCustomer(stub, args)
-	} else if function == "getTotalEnergyForSale" {
-		return getTotalEnergyForSale(stub)
-	}
+	spec, ok := lookupFunction(kindQuery, function)
+	if !ok {
+		// Print message if query function not found
+		fmt.Println("Query() did not find function: " + function)
 
-	// Print message if query function not found
-	fmt.Println("Query() did not find function: " + function)
+		// Return an error
+		return createQueryErrorDetails(codeUnknownFunction, "Query() did not find function: " + function, ErrorDetails{"function": function})
+	}
 
-	// Return an error
-	return createQueryResponseString(false, "Query() did not find function: " + function)
+	args, err := spec.arguments(args)
+	if err != nil {
+		return createQueryErrorFrom(err, err.Error())
+	}
+	err = spec.validate(args)
+	if err != nil {
+		return createQueryErrorFrom(err, err.Error())
+	}
+	return spec.handler(stub, args)
 
 }
 
@@ -217,15 +336,6 @@ func (t *SimpleChaincode) Query(stub shim.ChaincodeStubInterface, function strin
 // Mainly used for debugging purposes
 func read(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 
-	// Check to make sure number of arguments is correct
-	if len(args) != 1 {
-		return createQueryResponseString(false, "Incorrect number of arguments. Expecting 1: name of variable to query")
-	}
-	// Check variable name
-	if len(args[0]) == 0 {
-		return createQueryResponseString(false,	"First argument (variable name) cannot be an empty string")
-	}
-
 	// Debug message
 	fmt.Println("Trying to read variable named " + args[0])
 
@@ -233,13 +343,13 @@ func read(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	name := args[0]
 	valAsBytes, err := stub.GetState(name)
 	if err != nil {
-		return createQueryResponseString(false,	"Could not get state for variable " + name)
+		return createQueryError(codeStateError, "Could not get state for variable " + name)
 	}
 
 	// Return message if variable doesn't exist
 	// Variable does not exist if byte array has length 0
 	if len(valAsBytes) == 0 {
-		return createQueryResponseString(false, "Variable \"" + name + "\" does not exist")
+		return createQueryErrorDetails(codeUnknownVariable, "Variable \"" + name + "\" does not exist", ErrorDetails{"variable": name})
 	}
 
 	// Successful return
@@ -247,75 +357,287 @@ func read(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 
 }
 
-// See if there are any pending transactions. Return it if there is a pending transaction.
-func getPendingTransaction(stub shim.ChaincodeStubInterface) ([]byte, error) {
+// See if there are any pending transactions at a charger. Return it if there is a pending transaction.
+func getPendingTransaction(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 
 	var pt []Transaction
-	fmt.Println("Trying to get the pending transaction")
+
+	// Convert charger ID argument to lowercase
+	chargerID := strings.ToLower(args[0])
+	fmt.Println("Trying to get the pending transaction of charger " + chargerID)
+
+	// Make sure the charger exists
+	_, err := getCharger(stub, chargerID)
+	if err != nil {
+		return createQueryErrorFrom(err, err.Error())
+	}
 
 	// Get the pending transaction from the chaincode state
-	transactionAsBytes, err := stub.GetState(pendingTransactionKey)
+	transactionAsBytes, err := stub.GetState(createCompositeKey(pendingTransactionObjectType, chargerID))
 	if err != nil {
-		return createQueryResponseString(false, "Failed to get pending transaction")
+		return createQueryError(codeStateError, "Failed to get pending transaction")
 	}
 	json.Unmarshal(transactionAsBytes, &pt)
 
 	// Make sure there isn't more than 1 pending transaction
 	// Otherwise, return the pt array
 	if len(pt) > 1 {
-		return createQueryResponseString(false, "More than 1 pending transaction, something is wrong!")
+		return createQueryError(codeStateError, "More than 1 pending transaction, something is wrong!")
 	} else {
 		return createQueryResponseTransactions(true, pt)
 	}
 
 }
 
-// Get all of the available offers
-func getOffers(stub shim.ChaincodeStubInterface) ([]byte, error) {
+// Get all of the available offers at a charger
+func getOffers(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 
-	var offers map[string]int
-	fmt.Println("Trying to get the available offers")
+	var offers map[string]Amount
+
+	// Convert charger ID argument to lowercase
+	chargerID := strings.ToLower(args[0])
+	fmt.Println("Trying to get the available offers of charger " + chargerID)
+
+	// Make sure the charger exists
+	_, err := getCharger(stub, chargerID)
+	if err != nil {
+		return createQueryErrorFrom(err, err.Error())
+	}
 
 	// Get the available offers from the chaincode state
-	offersAsBytes, err := stub.GetState(offersKey)
+	offers, err = getChargerOffers(stub, chargerID)
 	if err != nil {
-		return createQueryResponseString(false, "Failed to get available offers")
+		return createQueryError(codeStateError, "Failed to get available offers")
 	}
-	json.Unmarshal(offersAsBytes, &offers)
 
 	return createQueryResponseMap(true, offers)
 
 }
 
+// Get the available offers at a charger with the units of every seller in each tier
+func getOfferTiers(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	// Convert charger ID argument to lowercase
+	chargerID := strings.ToLower(args[0])
+	fmt.Println("Trying to get the offer tiers of charger " + chargerID)
+
+	// Make sure the charger exists
+	_, err := getCharger(stub, chargerID)
+	if err != nil {
+		return createQueryErrorFrom(err, err.Error())
+	}
+
+	// Get the offer tiers from the chaincode state
+	tiers, err := getChargerOfferTiers(stub, chargerID)
+	if err != nil {
+		return createQueryError(codeStateError, "Failed to get offer tiers")
+	}
+
+	return createQueryResponseOfferTiers(true, tiers)
+
+}
+
+// Get the details of all of the chargers
+func getChargers(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	c := make(map[string]Charger)
+	fmt.Println("Trying to get the list of chargers")
+
+	// Get the chargers from the chaincode state
+	err := getStateByPartialCompositeKey(stub, chargerObjectType, nil, func(key string, valAsBytes []byte) error {
+		var charger Charger
+		json.Unmarshal(valAsBytes, &charger)
+		c[charger.ID] = charger
+		return nil
+	})
+	if err != nil {
+		return createQueryError(codeStateError, "Failed to get chargers")
+	}
+
+	return createQueryResponseChargers(true, c)
+}
+
 // Get all of the past transactions
-func getTransactions(stub shim.ChaincodeStubInterface) ([]byte, error) {
+// Passing any arguments switches to a filtered page of transactions, see getTransactionsPage
+func getTransactions(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 
 	var t []Transaction
+
+	// Paginated and filtered query
+	if len(args) > 0 {
+		return getTransactionsPage(stub, args)
+	}
+
 	fmt.Println("Trying to get the past transactions")
 
 	// Get the past transactions from the chaincode state
-	transactionsAsBytes, err := stub.GetState(transactionsKey)
+	// Transaction keys are ordered by TXID
+	err := getStateByPartialCompositeKey(stub, transactionObjectType, nil, func(key string, valAsBytes []byte) error {
+		var transaction Transaction
+		json.Unmarshal(valAsBytes, &transaction)
+		t = append(t, transaction)
+		return nil
+	})
 	if err != nil {
-		return createQueryResponseString(false, "Failed to get past transactions")
+		return createQueryError(codeStateError, "Failed to get past transactions")
 	}
-	json.Unmarshal(transactionsAsBytes, &t)
 
 	return createQueryResponseTransactions(true, t)
 
 }
 
+// Get a page of past transactions that match the filters
+// Arguments, all optional (empty string to skip): page size, bookmark, buyer, status, first TXID, last TXID, first timestamp, last timestamp, synthetic
+func getTransactionsPage(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	var t []Transaction
+	var err error
+
+	// Pad the arguments so missing trailing arguments read as empty strings
+	for len(args) < 9 {
+		args = append(args, "")
+	}
+
+	// Page size defaults to and cannot exceed the maximum page size
+	pageSize := maxTransactionsPageSize
+	if len(args[0]) > 0 {
+		pageSize, _ = strconv.Atoi(args[0])
+	}
+
+	// Injected transactions are only searched when asked for
+	objectTypes := []string{transactionObjectType}
+	switch strings.ToLower(args[8]) {
+	case syntheticInclude:
+		objectTypes = append(objectTypes, syntheticTransactionObjectType)
+	case syntheticOnly:
+		objectTypes = []string{syntheticTransactionObjectType}
+	}
+
+	// Bookmark is the key of the last transaction of the previous page
+	// Keys of every object type end in TXID~n, so the bookmark also says where to resume in the others
+	bookmark := args[1]
+	bookmarkSuffix := ""
+	for _, objectType := range objectTypes {
+		if strings.HasPrefix(bookmark, objectType + compositeKeySeparator) {
+			bookmarkSuffix = strings.TrimPrefix(bookmark, objectType + compositeKeySeparator)
+		}
+	}
+	if len(bookmark) > 0 && len(bookmarkSuffix) == 0 {
+		return createQueryError(codeBadArgument, "Second argument (bookmark) is not a valid bookmark")
+	}
+
+	// Buyer and status filters
+	// Status matches on prefix so "Refunded" finds every refunded transaction
+	buyer := strings.ToLower(args[2])
+	status := args[3]
+
+	// TXID range, both ends inclusive
+	startSuffix := ""
+	endSuffix := compositeKeyMaxSuffix
+	if len(args[4]) > 0 {
+		firstTXID, _ := strconv.ParseInt(args[4], 10, 64)
+		startSuffix = fmt.Sprintf("%020d", firstTXID) + compositeKeySeparator
+	}
+	if len(args[5]) > 0 {
+		lastTXID, _ := strconv.ParseInt(args[5], 10, 64)
+		endSuffix = fmt.Sprintf("%020d", lastTXID) + compositeKeySeparator + compositeKeyMaxSuffix
+	}
+	// Timestamp range, both ends inclusive
+	// Timestamps are not part of the key, so these are applied as filters
+	var firstTimestamp, lastTimestamp int64
+	if len(args[6]) > 0 {
+		firstTimestamp, _ = strconv.ParseInt(args[6], 10, 64)
+	}
+	if len(args[7]) > 0 {
+		lastTimestamp, _ = strconv.ParseInt(args[7], 10, 64)
+	}
+
+	// Resume after the bookmark
+	if bookmarkSuffix > startSuffix {
+		startSuffix = bookmarkSuffix
+	}
+
+	// Debug message
+	fmt.Println("Trying to get a page of " + strconv.Itoa(pageSize) + " past transactions from " + startSuffix)
+
+	// Walk the object types side by side, always taking the lowest key suffix next
+	iterators := make([]*transactionIterator, len(objectTypes))
+	for i, objectType := range objectTypes {
+		prefix := createCompositeKey(objectType) + compositeKeySeparator
+		iterators[i], err = newTransactionIterator(stub, prefix, startSuffix, endSuffix)
+		if err != nil {
+			return createQueryError(codeStateError, "Failed to get past transactions")
+		}
+		defer iterators[i].keysIter.Close()
+	}
+
+	// Fill the page, then look for one more match to know whether there is a next page
+	lastKey := ""
+	nextBookmark := ""
+	for {
+		var next *transactionIterator
+		for _, it := range iterators {
+			if it.ok && (next == nil || it.suffix < next.suffix) {
+				next = it
+			}
+		}
+		if next == nil {
+			break
+		}
+		key, valAsBytes := next.key, next.valAsBytes
+		err = next.advance()
+		if err != nil {
+			return createQueryError(codeStateError, "Failed to get past transactions")
+		}
+		// The bookmarked transaction was already returned on the previous page
+		if key == bookmark {
+			continue
+		}
+
+		var transaction Transaction
+		json.Unmarshal(valAsBytes, &transaction)
+		if len(buyer) > 0 && transaction.Buyer != buyer {
+			continue
+		}
+		if len(status) > 0 && !strings.HasPrefix(transaction.Status, status) {
+			continue
+		}
+		if len(args[6]) > 0 && transaction.Timestamp < firstTimestamp {
+			continue
+		}
+		if len(args[7]) > 0 && transaction.Timestamp > lastTimestamp {
+			continue
+		}
+
+		if len(t) == pageSize {
+			nextBookmark = lastKey
+			break
+		}
+		t = append(t, transaction)
+		lastKey = key
+	}
+
+	return createQueryResponseTransactionsPage(true, t, nextBookmark)
+
+}
+
 // Get the details of all of the customers
-func getCustomers(stub shim.ChaincodeStubInterface) ([]byte, error) {
+func getCustomers(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 
-	var c map[string]int
+	c := make(map[string]Amount)
 	fmt.Println("Trying to get the list of customers")
 
 	// Get the customers from the chaincode state
-	customersAsBytes, err := stub.GetState(customersKey)
+	err := getStateByPartialCompositeKey(stub, customerObjectType, nil, func(key string, valAsBytes []byte) error {
+		var balance Amount
+		json.Unmarshal(valAsBytes, &balance)
+		_, attributes := splitCompositeKey(key)
+		c[attributes[0]] = balance
+		return nil
+	})
 	if err != nil {
-		return createQueryResponseString(false, "Failed to get customers")
+		return createQueryError(codeStateError, "Failed to get customers")
 	}
-	json.Unmarshal(customersAsBytes, &c)
 
 	return createQueryResponseMap(true, c)
 }
@@ -323,228 +645,251 @@ func getCustomers(stub shim.ChaincodeStubInterface) ([]byte, error) {
 // Get the details of a specific customer
 func getCustomer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 
-	var customers map[string]int
-
-	// Check parameters
-	if len(args) != 1 {
-		return createQueryResponseString(false, "Incorrect number of arguments. Expecting 1: Customer ID")
-	}
-	// Check customer name
-	if len(args[0]) == 0 {
-		return createQueryResponseString(false,	"First argument (customer name) cannot be an empty string")
-	}
-
 	// Convert customer ID argument to lowercase
 	customerID := strings.ToLower(args[0])
 
 	// Debug message
 	fmt.Println("Trying to get the customer named " + customerID)
 
-	// Get the customers from the chaincode state
-	customersAsBytes, err := stub.GetState(customersKey)
+	// Get the customer from the chaincode state
+	customers, err := getCustomerBalances(stub, customerID)
 	if err != nil {
-		return createQueryResponseString(false, "Failed to get customers")
+		return createQueryError(codeStateError, "Failed to get customers")
 	}
-	json.Unmarshal(customersAsBytes, &customers)
 
 	// Make sure requested customer is in the list
 	if val, ok := customers[customerID]; ok {
-		return createQueryResponseInt(true, val)
+		return createQueryResponseAmount(true, val)
 	} else {
-		return createQueryResponseString(false, "Failed to find customer with ID " + customerID)
+		return createQueryErrorDetails(codeUnknownCustomer, "Failed to find customer with ID " + customerID, ErrorDetails{"customer": customerID})
 	}
 
 }
 
-// Calculate the total number of energy units available
-func getTotalEnergyForSale(stub shim.ChaincodeStubInterface) ([]byte, error) {
+// Calculate the total number of energy units available at a charger
+func getTotalEnergyForSale(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	var offers map[string]Amount
+
+	// Convert charger ID argument to lowercase
+	chargerID := strings.ToLower(args[0])
+	fmt.Println("Trying to calculate the total number of energy units available at charger " + chargerID)
 
-	var offers map[string]int
-	fmt.Println("Trying to calculate the total number of energy units available")
+	// Make sure the charger exists
+	_, err := getCharger(stub, chargerID)
+	if err != nil {
+		return createQueryErrorFrom(err, err.Error())
+	}
 
 	// Get the available offers from the chaincode state
-	offersAsBytes, err := stub.GetState(offersKey)
+	offers, err = getChargerOffers(stub, chargerID)
 	if err != nil {
-		return createQueryResponseString(false, "Failed to get available offers")
+		return createQueryError(codeStateError, "Failed to get available offers")
 	}
-	json.Unmarshal(offersAsBytes, &offers)
 
 	// Calculate the total energy for sale
 	// Sum the values over all of the keys
-	total := 0
+	var total Amount
 	for j := range offers {
-		total += offers[j]
-		fmt.Println("Key: " + j + ", Value: " + strconv.Itoa(offers[j]) + ". Total is now " + strconv.Itoa(total))
+		total, err = addAmounts(total, offers[j])
+		if err != nil {
+			return createQueryErrorFrom(err, "Failed to calculate the total energy for sale: " + err.Error())
+		}
+		fmt.Println("Key: " + j + ", Value: " + offers[j].String() + ". Total is now " + total.String())
 	}
 
 	// Return the total
-	return createQueryResponseInt(true, total)
+	return createQueryResponseAmount(true, total)
 }
 
 //////////////////////////////////////// INVOKE FUNCTIONS ////////////////////////////////////////
 
+// Add quantity to one of a charger's offer tiers
 func addOfferQuantity(stub shim.ChaincodeStubInterface, args []string) ([]byte,error) {
 
 	var retStr string
-	var offers map[string]int
+	var offers map[string]map[string]Amount
 
-	// Check parameters
-	if len(args) != 2 {
-		retStr = "Incorrect number of arguments. Expecting 2: offer ID, quantity to add to the offer"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
-	}
-	// Check variable lengths
-	if len(args[0]) == 0 {
-		retStr = "First argument (offer ID) cannot be an empty string"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+	// Make sure the charger exists
+	chargerID := strings.ToLower(args[0])
+	charger, err := getCharger(stub, chargerID)
+	if err != nil {
+		retStr = err.Error()
+		return createInvokeErrorFrom(err, retStr)
 	}
-	if len(args[1]) == 0 {
-		retStr = "Second argument (quantity to add) cannot be an empty string"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+
+	// Seller defaults to the owner of the charger
+	seller := charger.Owner
+	if len(args) == 4 && len(args[3]) > 0 {
+		seller = strings.ToLower(args[3])
 	}
 
-	// Check to make sure offer ID is a valid integer and not less than or equal to 0
-	offerIDInt, err := strconv.Atoi(args[0])
+	// Offers IDs are strings (thanks JSON!)
+	// Prices are written without trailing zeros, so "5.50" and "5.5" are the same offer
+	pricePerUnit, _ := parseAmount(args[1])
+	offerID := pricePerUnit.String()
+	quantity, _ := parseAmount(args[2])
+
+	// Keep the price and the seller's units in the offer within the limits
+	limits, err := getCurrentLimits(stub)
 	if err != nil {
-		retStr = "First argument (Offer ID) must be an integer string"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		retStr = "Could not get limits from chaincode state"
+		return createInvokeError(codeStateError, retStr)
 	}
-	if offerIDInt <= 0 {
-		retStr = "First argument (Offer ID) must not be less than zero"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+	err = checkLimit(limitPrice, pricePerUnit, limits.MaxPrice)
+	if err != nil {
+		return createInvokeErrorFrom(err, err.Error())
 	}
-	// Offers IDs are strings (thanks JSON!)
-	offerID := args[0]
 
-	// Check to make sure quantity to add is not less than or equal to 0
-	quantity, err := strconv.Atoi(args[1])
+	// Get the available offers of the charger from the chaincode state
+	offers, err = getChargerOfferTiers(stub, chargerID)
 	if err != nil {
-		retStr = "Second argument (quantity to add) must be an integer string"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
-	}
-	if quantity <= 0 {
-		retStr = "Second argument (quantity to add) must not be less than zero"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		retStr = "Could not get offers of charger " + chargerID + " from chaincode state"
+		return createInvokeError(codeStateError, retStr)
 	}
 
-	// Get the available offers from the chaincode state
-	offersAsBytes, err := stub.GetState(offersKey)
+	// Sellers must be customers so they can be paid
+	customers, err := getCustomerBalances(stub, seller)
 	if err != nil {
-		retStr = "Could not get offersKey from chaincode state"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		retStr = "Could not get customer " + seller + " from chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+	if _, ok := customers[seller]; !ok {
+		retStr = seller + " is not a valid seller"
+		return createInvokeErrorDetails(codeUnknownCustomer, retStr, ErrorDetails{"customer": seller})
 	}
-	json.Unmarshal(offersAsBytes, &offers)
 
 	// Try to find the specified offer
-	// If found, add quantity to the offer
-	// If not found, add new key and initialize value to quantity
-	if _, ok := offers[offerID]; ok {
-		offers[offerID] += quantity
-	} else {
-		offers[offerID] = quantity
+	// If found, add quantity to the seller's units in the offer
+	// If not found, add new key and initialize the seller's units to quantity
+	if _, ok := offers[offerID]; !ok {
+		offers[offerID] = make(map[string]Amount)
+	}
+	available, err := addAmounts(offers[offerID][seller], quantity)
+	if err == nil {
+		err = checkLimit(limitQuantity, available, limits.MaxQuantity)
 	}
+	if err != nil {
+		retStr = "Could not add quantity to offer " + offerID + ": " + err.Error()
+		return createInvokeErrorFrom(err, retStr)
+	}
+	offers[offerID][seller] = available
 
 	// Save updated offer list
-	marshalAndPut(stub, offersKey, offers)
+	err = putChargerOfferTiers(stub, chargerID, offers)
+	if err != nil {
+		retStr = "Could not write offers of charger " + chargerID + " to chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+
+	// Record the new supply for the audit
+	err = putSupplyMovement(stub, SupplyMovement{Charger: chargerID, Offer: offerID, Seller: seller, Type: supplyOffered, Quantity: quantity, Available: available})
+	if err != nil {
+		retStr = "Could not write supply movement of charger " + chargerID + " to chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+
+	// Tell subscribers about the new quantity
+	err = emitEvent(stub, eventOfferQuantityAdded, OfferQuantityEvent{Charger: chargerID, Offer: offerID, Seller: seller, Quantity: quantity, Available: offers[offerID][seller]})
+	if err != nil {
+		retStr = "Could not emit event: " + err.Error()
+		return createInvokeErrorFrom(err, retStr)
+	}
+
+	// New supply may fill resting bids
+	err = matchBids(stub, chargerID)
+	if err != nil {
+		retStr = "Could not match bids at charger " + chargerID + ": " + err.Error()
+		return createInvokeErrorFrom(err, retStr)
+	}
+
+	// Return the offer tiers left after matching
+	offers, err = getChargerOfferTiers(stub, chargerID)
+	if err != nil {
+		retStr = "Could not get offers of charger " + chargerID + " from chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
 
 	// Successful return
-	retStr = "Successfully added " + args[1] + " to offer " + args[0]
-	fmt.Println(retStr)
-	return []byte(retStr), nil
+	retStr = "Successfully added " + args[2] + " to offer " + offerID + " at charger " + chargerID + " for seller " + seller
+	return createInvokeResponse(retStr, offers)
 
 }
 
+// Subtract quantity from one of a charger's offer tiers
 func subtractOfferQuantity(stub shim.ChaincodeStubInterface, args []string) ([]byte,error) {
 
 	var retStr string
-	var offers map[string]int
-
-	// Check parameters
-	if len(args) != 2 {
-		retStr = "Incorrect number of arguments. Expecting 2: offer ID, quantity to subtract from the offer"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
-	}
-	// Check variable lengths
-	if len(args[0]) == 0 {
-		retStr = "First argument (offer ID) cannot be an empty string"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
-	}
-	if len(args[1]) == 0 {
-		retStr = "Second argument (quantity to subtract) cannot be an empty string"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
-	}
+	var offers map[string]map[string]Amount
 
-	// Check to make sure offer ID is a valid integer and not less than or equal to 0
-	offerIDInt, err := strconv.Atoi(args[0])
+	// Make sure the charger exists
+	chargerID := strings.ToLower(args[0])
+	charger, err := getCharger(stub, chargerID)
 	if err != nil {
-		retStr = "First argument (Offer ID) must be an integer string"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		retStr = err.Error()
+		return createInvokeErrorFrom(err, retStr)
 	}
-	if offerIDInt <= 0 {
-		retStr = "First argument (Offer ID) must not be less than zero"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
-	}
-	// Offers IDs are strings (thanks JSON!)
-	offerID := args[0]
 
-	// Check to make sure quantity to subtract is not less than or equal to 0
-	quantity, err := strconv.Atoi(args[1])
-	if err != nil {
-		retStr = "Second argument (quantity to subtract) must be an integer string"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
-	}
-	if quantity <= 0 {
-		retStr = "Second argument (quantity to subtract) must not be less than zero"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+	// Seller defaults to the owner of the charger
+	seller := charger.Owner
+	if len(args) == 4 && len(args[3]) > 0 {
+		seller = strings.ToLower(args[3])
 	}
 
-	// Get the available offers from the chaincode state
-	offersAsBytes, err := stub.GetState(offersKey)
+	// Offers IDs are strings (thanks JSON!)
+	// Prices are written without trailing zeros, so "5.50" and "5.5" are the same offer
+	pricePerUnit, _ := parseAmount(args[1])
+	offerID := pricePerUnit.String()
+	quantity, _ := parseAmount(args[2])
+
+	// Get the available offers of the charger from the chaincode state
+	offers, err = getChargerOfferTiers(stub, chargerID)
 	if err != nil {
-		retStr = "Could not get offersKey from chaincode state"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		retStr = "Could not get offers of charger " + chargerID + " from chaincode state"
+		return createInvokeError(codeStateError, retStr)
 	}
-	json.Unmarshal(offersAsBytes, &offers)
 
-	// Try to find the specified offer
-	// If found and quantity < val, subtract quantity from the offer
-	// If found and quantity >= val, remove offer from map
+	// Try to find the seller's units in the specified offer
+	// If found and quantity < val, subtract quantity from the seller's units
+	// If found and quantity >= val, remove the seller from the offer
 	// If not found, return error
-	if val, ok := offers[offerID]; ok {
+	withdrawn := quantity
+	if val, ok := offers[offerID][seller]; ok {
 		if quantity < val {
-			offers[offerID] -= quantity
+			offers[offerID][seller] -= quantity
 		} else {
-			delete(offers, offerID)
+			withdrawn = val
+			delete(offers[offerID], seller)
 		}
 	} else {
-		retStr = "Offer ID " + offerID + " does not exist"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		retStr = "Offer ID " + offerID + " does not exist at charger " + chargerID + " for seller " + seller
+		return createInvokeErrorDetails(codeUnknownOffer, retStr, ErrorDetails{"charger": chargerID, "offer": offerID, "seller": seller})
 	}
 
 	// Save updated offer list
-	marshalAndPut(stub, offersKey, offers)
+	err = putChargerOfferTiers(stub, chargerID, offers)
+	if err != nil {
+		retStr = "Could not write offers of charger " + chargerID + " to chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+
+	// Record the units taken back for the audit
+	err = putSupplyMovement(stub, SupplyMovement{Charger: chargerID, Offer: offerID, Seller: seller, Type: supplyWithdrawn, Quantity: -withdrawn, Available: offers[offerID][seller]})
+	if err != nil {
+		retStr = "Could not write supply movement of charger " + chargerID + " to chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+
+	// Tell subscribers about the new quantity
+	err = emitEvent(stub, eventOfferQuantitySubtracted, OfferQuantityEvent{Charger: chargerID, Offer: offerID, Seller: seller, Quantity: withdrawn, Available: offers[offerID][seller]})
+	if err != nil {
+		retStr = "Could not emit event: " + err.Error()
+		return createInvokeErrorFrom(err, retStr)
+	}
 
 	// Successful return
-	retStr = "Successfully subtracted " + args[1] + " from offer " + offerID
-	fmt.Println(retStr)
-	return []byte(retStr), errors.New(retStr)
+	retStr = "Successfully subtracted " + args[2] + " from offer " + offerID + " at charger " + chargerID + " for seller " + seller
+	return createInvokeResponse(retStr, offers)
 
 }
 
@@ -553,20 +898,7 @@ func addCustomer(stub shim.ChaincodeStubInterface, args []string) ([]byte,error)
 
 	var retStr string
 	var err error
-	var customers map[string]int
-
-	// Check parameters
-	if len(args) != 1 {
-		retStr = "Incorrect number of arguments. Expecting 1: new customer ID"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
-	}
-	// Check variable lengths
-	if len(args[0]) == 0 {
-		retStr = "First argument (customer ID) cannot be an empty string"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
-	}
+	var customers map[string]Amount
 
 	// Debug message
 	fmt.Println("Trying to add a customer with ID " + args[0])
@@ -574,32 +906,45 @@ func addCustomer(stub shim.ChaincodeStubInterface, args []string) ([]byte,error)
 	// Convert potential new customer's name to lowercase
 	newCustomer := strings.ToLower(args[0])
 
-	// Get the list of customers from the chaincode state
-	customerListBytes, err := stub.GetState(customersKey)
+	// Customer IDs are part of composite keys, so they cannot contain the separator
+	if strings.Contains(newCustomer, compositeKeySeparator) {
+		retStr = "Cannot add customer '" + newCustomer + "': customer ID cannot contain '" + compositeKeySeparator + "'"
+		return createInvokeError(codeBadArgument, retStr)
+	}
+
+	// Get the customer from the chaincode state
+	customers, err = getCustomerBalances(stub, newCustomer)
 	if err != nil {
-		retStr = "Could not get customersKey from chaincode state"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		retStr = "Could not get customer " + newCustomer + " from chaincode state"
+		return createInvokeError(codeStateError, retStr)
 	}
-	json.Unmarshal(customerListBytes, &customers)
 
 	// Check to see if the new customer is already a customer
 	if _, ok := customers[newCustomer]; ok {
 		retStr = "Cannot add customer '" + newCustomer + "': customer already exists"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		return createInvokeErrorDetails(codeCustomerExists, retStr, ErrorDetails{"customer": newCustomer})
 	}
 
 	// Customer is able to be added, add them to the list of customers
 	customers[newCustomer] = 0
 
-	// Write customer list to chaincode state
-	marshalAndPut(stub, customersKey, customers)
+	// Write customer to chaincode state
+	err = putCustomerBalances(stub, customers)
+	if err != nil {
+		retStr = "Could not write customer " + newCustomer + " to chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+
+	// The customer's enrollment ID can now buy energy
+	err = grantRole(stub, newCustomer, roleCustomer)
+	if err != nil {
+		retStr = "Could not write roles of " + newCustomer + " to chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
 
 	// Successful return
-	fmt.Println("Successfully added new customer")
 	retStr = "Successfully added new customer"
-	return []byte(retStr), nil
+	return createInvokeResponse(retStr, Customer{ID: newCustomer, Balance: 0})
 
 }
 
@@ -607,334 +952,459 @@ func addCustomer(stub shim.ChaincodeStubInterface, args []string) ([]byte,error)
 func addCustomerFunds(stub shim.ChaincodeStubInterface, args []string) ([]byte,error) {
 	var retStr string
 	var err error
-	var customers map[string]int
-
-	// Check parameters
-	if len(args) != 2 {
-		retStr = "Incorrect number of arguments. Expecting 2: customer ID, amount to add"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
-	}
-	// Check variable lengths
-	if len(args[0]) == 0 {
-		retStr = "First argument (customer ID) cannot be an empty string"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
-	}
-	if len(args[1]) == 0 {
-		retStr = "Second argument (amount to add) cannot be an empty string"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
-	}
+	var customers map[string]Amount
 
 	// Debug message
 	fmt.Println("Trying to add " + args[1] + " to " + args[0] + "'s balance")
 
 	// Build Customer to hold Customer update
 	customerName := strings.ToLower(args[0])
-	funds, err := strconv.Atoi(args[1])
-	if err != nil {
-		retStr = "Second argument (funds) must be a numeric string"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
-	}
-	// Funds to add cannot be zero or negative
-	if funds <= 0 {
-		retStr = "Second argument (funds) must not be negative"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
-	}
+	funds, _ := parseAmount(args[1])
 
-	// Get the list of customers from the chaincode state
-	customerListBytes, err := stub.GetState(customersKey)
+	// Get the customer from the chaincode state
+	customers, err = getCustomerBalances(stub, customerName)
 	if err != nil {
-		retStr = "Could not get customersKey from chaincode state"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		retStr = "Could not get customer " + customerName + " from chaincode state"
+		return createInvokeError(codeStateError, retStr)
 	}
-	json.Unmarshal(customerListBytes, &customers)
 
 	// Try to find the customer in the list of customers
 	if _, ok := customers[customerName]; ok {
-		// Update balance
-		customers[customerName] += funds
-		// Write updated customer list to the chaincode state
-		marshalAndPut(stub, customersKey, customers)
+		// Record the deposit in the customer's ledger
+		// and update the balance, as long as it stays within the maximum balance
+		err = applyLedgerEntries(stub, customers, []LedgerEntry{{Customer: customerName, Type: entryDeposit, Amount: funds}})
+		if err != nil {
+			retStr = "Could not add funds to " + customerName + ": " + err.Error()
+			return createInvokeErrorFrom(err, retStr)
+		}
+		// Write updated customer to the chaincode state
+		err = putCustomerBalances(stub, customers)
+		if err != nil {
+			retStr = "Could not write customer " + customerName + " to chaincode state"
+			return createInvokeError(codeStateError, retStr)
+		}
+		// Tell subscribers about the new balance
+		err = emitEvent(stub, eventCustomerFundsAdded, CustomerFundsEvent{Customer: customerName, Amount: funds, Balance: customers[customerName]})
+		if err != nil {
+			retStr = "Could not emit event: " + err.Error()
+			return createInvokeErrorFrom(err, retStr)
+		}
 		// Successful return
-		fmt.Println("Successfully added " + strconv.Itoa(funds) + " to " + customerName + "'s balance")
-		retStr = "Successfully added " + strconv.Itoa(funds) + " to " + customerName + "'s balance"
-		return []byte(retStr), nil
+		retStr = "Successfully added " + funds.String() + " to " + customerName + "'s balance"
+		return createInvokeResponse(retStr, Customer{ID: customerName, Balance: customers[customerName]})
 	} else {
 		// Customer wasn't found, return error message
 		retStr = "Could not find customer " + customerName + " to add funds"
-		fmt.Println(retStr)
-		return []byte(retStr), nil
+		return createInvokeErrorDetails(codeUnknownCustomer, retStr, ErrorDetails{"customer": customerName})
 	}
 
 }
-// Accept offer
-func acceptOffer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+// Add a new charger to the list of chargers
+func addCharger(stub shim.ChaincodeStubInterface, args []string) ([]byte,error) {
 
 	var retStr string
-	var pendingTransaction []Transaction
-	var newTransaction Transaction
-	var offers map[string]int
-	var customers map[string]int
+	var err error
+	var customers map[string]Amount
+	var newCharger Charger
+
+	// Debug message
+	fmt.Println("Trying to add a charger with ID " + args[0] + " owned by " + args[1])
+
+	// Convert charger and owner IDs to lowercase
+	newCharger.ID = strings.ToLower(args[0])
+	newCharger.Owner = strings.ToLower(args[1])
 
-	// Check parameters
-	if len(args) != 2 {
-		retStr = "Incorrect number of arguments. Expecting 2: customer ID, units of energy to buy"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+	// Charger IDs are part of composite keys, so they cannot contain the separator
+	if strings.Contains(newCharger.ID, compositeKeySeparator) {
+		retStr = "Cannot add charger '" + newCharger.ID + "': charger ID cannot contain '" + compositeKeySeparator + "'"
+		return createInvokeError(codeBadArgument, retStr)
 	}
-	// Check variable lengths
-	if len(args[0]) == 0 {
-		retStr = "First argument (customer ID) cannot be an empty string"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+
+	// Get the owner from the chaincode state
+	customers, err = getCustomerBalances(stub, newCharger.Owner)
+	if err != nil {
+		retStr = "Could not get customer " + newCharger.Owner + " from chaincode state"
+		return createInvokeError(codeStateError, retStr)
 	}
-	if len(args[1]) == 0 {
-		retStr = "Second argument (quantity to buy) cannot be an empty string"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+
+	// Make sure the owner is a valid customer
+	if _, ok := customers[newCharger.Owner]; !ok {
+		retStr = "Cannot add charger '" + newCharger.ID + "': owner '" + newCharger.Owner + "' is not a customer"
+		return createInvokeErrorDetails(codeUnknownCustomer, retStr, ErrorDetails{"customer": newCharger.Owner})
 	}
 
-	// Debug message
-	fmt.Println(args[0] + " is trying to purchase " + args[1] + " units of energy")
+	// Check to see if the new charger already exists
+	chargerKey := createCompositeKey(chargerObjectType, newCharger.ID)
+	chargerBytes, err := stub.GetState(chargerKey)
+	if err != nil {
+		retStr = "Could not get charger " + newCharger.ID + " from chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+	if len(chargerBytes) > 0 {
+		retStr = "Cannot add charger '" + newCharger.ID + "': charger already exists"
+		return createInvokeErrorDetails(codeChargerExists, retStr, ErrorDetails{"charger": newCharger.ID})
+	}
 
-	// Check to see if there is a pending transaction
-	fmt.Println("Checking to see if there is a pending transaction")
-	pendingTransactionsBytes, err := stub.GetState(pendingTransactionKey)
+	// Charger is able to be added, write it to chaincode state
+	// The charger starts without offers or a pending transaction
+	err = marshalAndPut(stub, chargerKey, newCharger)
 	if err != nil {
-		retStr = "Could not get pendingTransactionsKey from chaincode state"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		retStr = "Could not write charger " + newCharger.ID + " to chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+
+	// The charger's enrollment ID can now complete and cancel its sessions, its owner can sell energy
+	err = grantRole(stub, newCharger.ID, roleCharger)
+	if err == nil {
+		err = grantRole(stub, newCharger.Owner, roleSeller)
+	}
+	if err != nil {
+		retStr = "Could not write roles of charger " + newCharger.ID + " to chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+
+	// Successful return
+	retStr = "Successfully added new charger"
+	return createInvokeResponse(retStr, newCharger)
+
+}
+
+// Accept offer
+func acceptOffer(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	var retStr string
+	var pendingTransaction []Transaction
+	var newTransaction Transaction
+	var offers map[string]Amount
+	var tiers map[string]map[string]Amount
+	var customers map[string]Amount
+
+	// Debug message
+	fmt.Println(args[1] + " is trying to purchase " + args[2] + " units of energy at charger " + args[0])
+
+	// Make sure the charger exists
+	chargerID := strings.ToLower(args[0])
+	charger, err := getCharger(stub, chargerID)
+	if err != nil {
+		retStr = err.Error()
+		return createInvokeErrorFrom(err, retStr)
+	}
+
+	// A pending transaction that has been open for too long is expired first
+	now, err := getTxTimestamp(stub)
+	if err != nil {
+		retStr = "Could not get transaction timestamp"
+		return createInvokeError(codeStateError, retStr)
+	}
+	_, err = expirePendingTransaction(stub, charger, now)
+	if err != nil {
+		retStr = "Could not expire the pending transaction of charger " + chargerID + ": " + err.Error()
+		return createInvokeErrorFrom(err, retStr)
+	}
+
+	// Check to see if there is a pending transaction at this charger
+	fmt.Println("Checking to see if there is a pending transaction")
+	pendingTransactionsBytes, err := stub.GetState(createCompositeKey(pendingTransactionObjectType, chargerID))
+	if err != nil {
+		retStr = "Could not get pending transaction of charger " + chargerID + " from chaincode state"
+		return createInvokeError(codeStateError, retStr)
 	}
 	json.Unmarshal(pendingTransactionsBytes, &pendingTransaction)
 	// Return and do nothing if no pending transactions
 	if len(pendingTransaction) > 0 {
-		retStr = "There is already a pending transaction. Cannot accept an offer while a transaction is in progress."
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		retStr = "There is already a pending transaction at charger " + chargerID + ". Cannot accept an offer while a transaction is in progress."
+		return createInvokeErrorDetails(codePendingTXExists, retStr, ErrorDetails{"charger": chargerID})
 	}
 
 	// Process parameters
 	fmt.Println("Processing parameters")
-	buyer := strings.ToLower(args[0])
-	requestedQuantity, err := strconv.Atoi(args[1])
+	buyer := strings.ToLower(args[1])
+	requestedQuantity, _ := parseAmount(args[2])
+	limits, err := getCurrentLimits(stub)
 	if err != nil {
-		retStr = "Second argument (amount of energy) must be an integer string"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		retStr = "Could not get limits from chaincode state"
+		return createInvokeError(codeStateError, retStr)
 	}
-	// requestedQuantity cannot be less than or equal to 0
-	if requestedQuantity <= 0 {
-		retStr = "Second argument (amount of energy) cannot be less than or equal to 0"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+	err = checkLimit(limitQuantity, requestedQuantity, limits.MaxQuantity)
+	if err != nil {
+		return createInvokeErrorFrom(err, err.Error())
+	}
+
+	// Max price per unit is optional, 0 means any price
+	var maxPricePerUnit Amount
+	if len(args) > 3 && len(args[3]) > 0 {
+		maxPricePerUnit, _ = parseAmount(args[3])
+	}
+	// Fill mode is optional, defaults to fill or kill
+	fillMode := fillOrKill
+	if len(args) > 4 && len(args[4]) > 0 {
+		fillMode = strings.ToLower(args[4])
 	}
-	// Set new transaction energy total now because requestedQuantity will be altered later
-	newTransaction.Energy = requestedQuantity
 
-	// Get the list of available offers
+	// Get the list of available offers at this charger
+	// Tiers hold the units of every seller, offers the total units of each tier
 	fmt.Println("Getting available offers")
-	offerListBytes, err := stub.GetState(offersKey)
+	tiers, err = getChargerOfferTiers(stub, chargerID)
 	if err != nil {
-		retStr = "Could not get offersKey from chaincode state"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		retStr = "Could not get offers of charger " + chargerID + " from chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+	offers, err = sumOfferTiers(tiers)
+	if err != nil {
+		retStr = "Could not calculate the offers of charger " + chargerID + ": " + err.Error()
+		return createInvokeErrorFrom(err, retStr)
 	}
-	json.Unmarshal(offerListBytes, &offers)
 
 	// Make sure quantity to buy is not greater than quantity available
-	totalAvailable := 0
+	// Only tiers at or below the max price per unit are available
+	var totalAvailable Amount
 	for i, val := range offers {
-		totalAvailable += val
-		fmt.Println("Key: " + i + ", Value: " + strconv.Itoa(val) + ". Total available is now " + strconv.Itoa(totalAvailable))
+		pricePerUnit, _ := parseAmount(i)
+		if maxPricePerUnit > 0 && pricePerUnit > maxPricePerUnit {
+			continue
+		}
+		totalAvailable, err = addAmounts(totalAvailable, val)
+		if err != nil {
+			retStr = "Could not calculate the units available: " + err.Error()
+			return createInvokeErrorFrom(err, retStr)
+		}
+		fmt.Println("Key: " + i + ", Value: " + val.String() + ". Total available is now " + totalAvailable.String())
 	}
 	if totalAvailable < requestedQuantity {
-		retStr = "Requested " + args[1] + " with only " + strconv.Itoa(totalAvailable) + " available"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
-	}
-
-	// Get the list of customers from the chaincode state
-	customerListBytes, err := stub.GetState(customersKey)
-	if err != nil {
-		retStr = "Could not get customersKey from chaincode state"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
-	}
-	json.Unmarshal(customerListBytes, &customers)
-
-	// Make sure the buyer is a valid customer
-	if _, ok := customers[buyer]; !ok {
-		retStr = args[0] + " is not a valid buyer"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		// A partial fill buys whatever is available, as long as there is something
+		if fillMode == partialFill && totalAvailable > 0 {
+			fmt.Println("Partially filling " + totalAvailable.String() + " of " + args[2] + " requested units")
+			requestedQuantity = totalAvailable
+		} else {
+			retStr = "Requested " + args[2] + " with only " + totalAvailable.String() + " available"
+			if maxPricePerUnit > 0 {
+				retStr += " at or below " + maxPricePerUnit.String() + " per unit"
+			}
+			return createInvokeErrorDetails(codeInsufficientSupply, retStr, ErrorDetails{"charger": chargerID, "requested": requestedQuantity, "available": totalAvailable, "maxprice": maxPricePerUnit})
+		}
 	}
+	// Set new transaction energy total now because requestedQuantity will be altered later
+	newTransaction.Energy = requestedQuantity
 
 	// Calculate the cost of the transaction
-	// Initialize newTransaction map before writing offers details to it
-	newTransaction.Offers = make(map[string]int)
-	// Make an array of price per unit offers in ascending order as integers
-	ascendingOfferKeys := getMapStringKeysAsAscendingInts(offers)
-	totalCost := 0
+	// Initialize newTransaction maps before writing offers details to them
+	newTransaction.Offers = make(map[string]Amount)
+	newTransaction.Sellers = make(map[string]map[string]Amount)
+	// Every seller is paid for their units at each tier, rounded to amountScale decimal places
+	// The cost is the sum of the payments, so the buyer pays exactly what the sellers get
+	payments := make(map[string]Amount)
+	var totalCost Amount
+	// Make an array of price per unit offers in ascending order
+	ascendingOfferKeys := getMapStringKeysAsAscendingAmounts(offers)
 	for _, pricePerUnit := range ascendingOfferKeys {
-		pricePerUnitStr := strconv.Itoa(pricePerUnit)
+		// Tiers above the max price per unit are never bought from
+		if maxPricePerUnit > 0 && pricePerUnit > maxPricePerUnit {
+			break
+		}
+		pricePerUnitStr := pricePerUnit.String()
 		unitsAvailable := offers[pricePerUnitStr]
+		unitsBought := unitsAvailable
 		if unitsAvailable > requestedQuantity {
 			// This price tier has enough, don't need to go to the next one
-			// Subtract requested quantity from current price tier
-			offers[pricePerUnitStr] -= requestedQuantity
-			// Calculate cost and add to running total
-			totalCost += requestedQuantity * pricePerUnit
-			// Update new transaction to include this price tier
-			newTransaction.Offers[pricePerUnitStr] = requestedQuantity
-			// Done calculating cost and finding assets to buy, break
-			break
-		} else {
-			// Take everything from this price tier and move to the next one
-			// Update requested quantity
-			requestedQuantity -= unitsAvailable
-			// Calculate cost and add to running total
-			totalCost += unitsAvailable * pricePerUnit
-			// Update new transaction to include this tier
-			newTransaction.Offers[pricePerUnitStr] = unitsAvailable
-			// Delete the map key for this price tier
-			delete(offers, pricePerUnitStr)
-			// Check exit condition: requestedQuantity = 0
-			if requestedQuantity == 0 {
-				break
+			unitsBought = requestedQuantity
+		}
+		// Update new transaction to include this price tier and the sellers the units came from
+		newTransaction.Offers[pricePerUnitStr] = unitsBought
+		newTransaction.Sellers[pricePerUnitStr] = takeFromTier(tiers[pricePerUnitStr], unitsBought, false)
+		// Calculate what each seller is paid and add it to the running total
+		for seller, units := range newTransaction.Sellers[pricePerUnitStr] {
+			payment, err := multiplyAmounts(units, pricePerUnit)
+			if err == nil {
+				payments[seller], err = addAmounts(payments[seller], payment)
+			}
+			if err == nil {
+				totalCost, err = addAmounts(totalCost, payment)
 			}
-			// Continue to the next one
+			if err != nil {
+				retStr = "Could not calculate the cost of the transaction: " + err.Error()
+				return createInvokeErrorFrom(err, retStr)
+			}
+		}
+		if len(tiers[pricePerUnitStr]) == 0 {
+			// Delete the map key for a price tier that was bought out
+			delete(tiers, pricePerUnitStr)
 		}
+		// Check exit condition: requestedQuantity = 0
+		requestedQuantity -= unitsBought
+		if requestedQuantity == 0 {
+			break
+		}
+		// Continue to the next one
+	}
+
+	// Get the buyer and every seller that units were bought from
+	customerIDs := []string{buyer}
+	for seller := range payments {
+		customerIDs = append(customerIDs, seller)
+	}
+	customers, err = getCustomerBalances(stub, customerIDs...)
+	if err != nil {
+		retStr = "Could not get customers from chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+
+	// Make sure the buyer is a valid customer
+	if _, ok := customers[buyer]; !ok {
+		retStr = args[1] + " is not a valid buyer"
+		return createInvokeErrorDetails(codeUnknownCustomer, retStr, ErrorDetails{"customer": buyer})
 	}
 
 	// Make sure the customer has enough funds to purchase this transaction
 	if customers[buyer] < totalCost {
-		retStr = "Buyer does not have enough funds: total cost = " + strconv.Itoa(totalCost) + ", available funds = " + strconv.Itoa(customers[buyer])
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		retStr = "Buyer does not have enough funds: total cost = " + totalCost.String() + ", available funds = " + customers[buyer].String()
+		return createInvokeErrorDetails(codeInsufficientFunds, retStr, ErrorDetails{"customer": buyer, "required": totalCost, "available": customers[buyer]})
 	}
 
 	// TRANSACTION IS VALID
 	// Clean up transaction and finalize all changes that must be made
 
-	// Subtract funds from customer and add funds to "owner" (owner of the EV charger)
-	customers[buyer] -= totalCost
-	customers["owner"] += totalCost
+	// Subtract funds from customer and pay every seller for the units bought from them
+	entries := append([]LedgerEntry{{Customer: buyer, Type: entryPurchase, Amount: -totalCost, Charger: chargerID}}, counterpartyEntries(entrySale, payments, false, buyer, chargerID)...)
+	err = applyLedgerEntries(stub, customers, entries)
+	if err != nil {
+		retStr = "Could not pay for the transaction: " + err.Error()
+		return createInvokeErrorFrom(err, retStr)
+	}
 
 	// Add remaining fields to new transaction
 	newTransaction.Status = "Pending"
+	newTransaction.Charger = chargerID
 	newTransaction.Buyer = buyer
 	newTransaction.Cost = totalCost
 	// newTransaction.Energy was set at the beginning of this function
-	// newTransaction.Offers was set in the previous loop
+	// newTransaction.Offers and newTransaction.Sellers were set in the previous loop
 	// TXID will be updated upon completion or cancellation
 	newTransaction.TXID = 0
+	// The transaction expires if it is neither completed nor cancelled within the timeout
+	newTransaction.Accepted = now
+	newTransaction.Timeout, err = getPendingTimeout(stub)
+	if err != nil {
+		retStr = "Could not get pending transaction timeout from chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
 
 	// Update pending transactions
 	fmt.Println("Adding new transaction to pending transaction")
 	pendingTransaction = append(pendingTransaction, newTransaction)
-	err = marshalAndPut(stub, pendingTransactionKey, pendingTransaction)
+	err = marshalAndPut(stub, createCompositeKey(pendingTransactionObjectType, chargerID), pendingTransaction)
 	if err != nil {
-		retStr = "Could not write pendingTransactionKey to chaincode state"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		retStr = "Could not write pending transaction of charger " + chargerID + " to chaincode state"
+		return createInvokeError(codeStateError, retStr)
 	}
 
 	// Update customer accounts
-	fmt.Println("Writing updated customer list to chaincode state")
-	err = marshalAndPut(stub, customersKey, customers)
+	fmt.Println("Writing updated customer accounts to chaincode state")
+	err = putCustomerBalances(stub, customers)
 	if err != nil {
-		retStr = "Could not write customersKey to chaincode state"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		retStr = "Could not write customers to chaincode state"
+		return createInvokeError(codeStateError, retStr)
 	}
 
 	// Update available offers
 	fmt.Println("Writing updated available offers to chaincode state")
-	err = marshalAndPut(stub, offersKey, offers)
+	err = putChargerOfferTiers(stub, chargerID, tiers)
+	if err != nil {
+		retStr = "Could not write offers of charger " + chargerID + " to chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+
+	// Tell subscribers about the new pending transaction
+	err = emitEvent(stub, eventOfferAccepted, TransactionEvent{Transaction: newTransaction})
 	if err != nil {
-		retStr = "Could not write offersKey to chaincode state"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		retStr = "Could not emit event: " + err.Error()
+		return createInvokeErrorFrom(err, retStr)
 	}
 
 	// Successful return
 	retStr = "Successfully accepted the offer"
-	fmt.Println(retStr)
-	return []byte(retStr), nil
+	return createInvokeResponse(retStr, newTransaction)
 
 }
 
 // Complete transaction
-func completeTransaction(stub shim.ChaincodeStubInterface) ([]byte, error) {
+func completeTransaction(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 
 	var retStr string
 	var pendingTransaction []Transaction
 	var newTransaction Transaction
-	var pastTransactions []Transaction
 
 	// Debug message
-	fmt.Println("Trying to complete the transaction")
+	fmt.Println("Trying to complete the transaction at charger " + args[0])
 
-	// Check to see if there is a pending transaction
-	pendingTransactionsBytes, err := stub.GetState(pendingTransactionKey)
+	// Make sure the charger exists
+	chargerID := strings.ToLower(args[0])
+	_, err := getCharger(stub, chargerID)
 	if err != nil {
-		retStr = "Could not get pendingTransactionsKey from chaincode state"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		retStr = err.Error()
+		return createInvokeErrorFrom(err, retStr)
+	}
+
+	// Check to see if there is a pending transaction at this charger
+	pendingTransactionsBytes, err := stub.GetState(createCompositeKey(pendingTransactionObjectType, chargerID))
+	if err != nil {
+		retStr = "Could not get pending transaction of charger " + chargerID + " from chaincode state"
+		return createInvokeError(codeStateError, retStr)
 	}
 	json.Unmarshal(pendingTransactionsBytes, &pendingTransaction)
 	// Return and do nothing if no pending transactions
 	if len(pendingTransaction) == 0 {
-		retStr = "No pending transaction to be completed: accept an offer first"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		retStr = "No pending transaction to be completed at charger " + chargerID + ": accept an offer first"
+		return createInvokeErrorDetails(codeNoPendingTX, retStr, ErrorDetails{"charger": chargerID})
 	}
 
 	// Build the transaction to be added to the transactions list
 	newTransaction = pendingTransaction[0]
 	newTransaction.Status = "Completed"
-	// TXID is the current UTC timestamp
-	newTransaction.TXID = time.Now().Unix()
+	// TXID comes from a counter in the chaincode state, timestamp from the transaction proposal
+	// Both are the same on every endorsing peer
+	newTransaction.TXID, err = nextTXID(stub)
+	if err != nil {
+		retStr = "Could not get next TXID from chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+	newTransaction.Timestamp, err = getTxTimestamp(stub)
+	if err != nil {
+		retStr = "Could not get transaction timestamp"
+		return createInvokeError(codeStateError, retStr)
+	}
 
-	// Get the list of past transactions
-	transactionListBytes, err := stub.GetState(transactionsKey)
+	// Save the completed transaction to the chaincode state
+	err = putTransaction(stub, newTransaction)
 	if err != nil {
-		retStr = "Could not get transactionsKey from chaincode state"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		retStr = "Could not write transaction to chaincode state"
+		return createInvokeError(codeStateError, retStr)
 	}
-	json.Unmarshal(transactionListBytes, &pastTransactions)
 
-	// Append the new transaction to the list of completed transactions
-	pastTransactions = append(pastTransactions, newTransaction)
+	// Clear the pending transaction in the chaincode state
+	err = stub.DelState(createCompositeKey(pendingTransactionObjectType, chargerID))
+	if err != nil {
+		retStr = "Could not clear pending transaction of charger " + chargerID + " in chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
 
-	// Save the list of transactions to the chaincode state
-	err = marshalAndPut(stub, transactionsKey, pastTransactions)
+	// Tell subscribers about the completed transaction
+	err = emitEvent(stub, eventTransactionCompleted, TransactionEvent{Transaction: newTransaction})
 	if err != nil {
-		retStr = "Could not write pendingTransactionsKey to chaincode state"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		retStr = "Could not emit event: " + err.Error()
+		return createInvokeErrorFrom(err, retStr)
 	}
 
-	// Clear the pending transaction
-	var emptyTransactions []Transaction
-	// Update the pending transactions in the chaincode state
-	err = marshalAndPut(stub, pendingTransactionKey, emptyTransactions)
+	// The charger is free again, resting bids may be filled
+	err = matchBids(stub, chargerID)
 	if err != nil {
-		retStr = "Could not write pendingTransactionsKey to chaincode state"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		retStr = "Could not match bids at charger " + chargerID + ": " + err.Error()
+		return createInvokeErrorFrom(err, retStr)
 	}
 
 	// Successful return
 	retStr = "Successfully completed the pending transaction"
-	fmt.Println(retStr)
-	return []byte(retStr), nil
+	return createInvokeResponse(retStr, newTransaction)
 
 }
 
@@ -943,53 +1413,32 @@ func cancelTransaction(stub shim.ChaincodeStubInterface, args []string) ([]byte,
 	var retStr string
 	var err error
 	var pendingTransaction []Transaction
-	var pastTransactions []Transaction
-	var offers map[string]int
-	var customers map[string]int
 
-	// Check arguments
-	if len(args) != 1 {
-		retStr = "Incorrect number of arguments. Expecting 1: percentage to refund as an integer between 1 and 100"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
-	}
-	// Check variable lengths
-	if len(args[0]) == 0 {
-		retStr = "First argument (units to refund) cannot be an empty string"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
-	}
+	unitsToRefund, _ := parseAmount(args[1])
 
-	unitsToRefund, err := strconv.Atoi(args[0])
+	// Debug message
+	fmt.Println("Trying to cancel part the current transaction at charger " + args[0] + " and refund " + args[1] + " units")
+
+	// Make sure the charger exists
+	chargerID := strings.ToLower(args[0])
+	charger, err := getCharger(stub, chargerID)
 	if err != nil {
-		retStr = "Could not convert " + args[0] + " to integer"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
-	}
-	// unitsToRefund cannot be less than or equal to 0
-	if unitsToRefund <= 0 {
-		retStr = "First argument (units to refund) cannot be less than or equal to 0"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		retStr = err.Error()
+		return createInvokeErrorFrom(err, retStr)
 	}
 
-	// Debug message
-	fmt.Println("Trying to cancel part the current transaction and refund " + args[0] + " units")
-
-	// Check to see if there is a pending transaction
+	// Check to see if there is a pending transaction at this charger
 	fmt.Println("Getting pending transactions")
-	pendingTransactionsBytes, err := stub.GetState(pendingTransactionKey)
+	pendingTransactionsBytes, err := stub.GetState(createCompositeKey(pendingTransactionObjectType, chargerID))
 	if err != nil {
-		retStr = "Could not get pendingTransactionsKey from chaincode state"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		retStr = "Could not get pending transaction of charger " + chargerID + " from chaincode state"
+		return createInvokeError(codeStateError, retStr)
 	}
 	json.Unmarshal(pendingTransactionsBytes, &pendingTransaction)
 	// Return and do nothing if no pending transactions
 	if len(pendingTransaction) == 0 {
-		retStr = "No pending transactions to be completed: accept an offer first"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		retStr = "No pending transactions to be completed at charger " + chargerID + ": accept an offer first"
+		return createInvokeErrorDetails(codeNoPendingTX, retStr, ErrorDetails{"charger": chargerID})
 	}
 
 	// Get pending transaction
@@ -997,44 +1446,613 @@ func cancelTransaction(stub shim.ChaincodeStubInterface, args []string) ([]byte,
 
 	// Check to make sure unitsToRefund is not greater than the amount of energy in the transaction
 	if unitsToRefund > pt.Energy {
-		retStr = "Cannot refund " + args[0] + " units, there are only " + strconv.Itoa(pt.Energy) + " in the current transaction"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		retStr = "Cannot refund " + args[1] + " units, there are only " + pt.Energy.String() + " in the current transaction"
+		return createInvokeErrorDetails(codeRefundExceedsTransaction, retStr, ErrorDetails{"charger": chargerID, "requested": unitsToRefund, "available": pt.Energy})
 	}
 
-	// Get the list of customers from the chaincode state
-	fmt.Println("Getting customer accounts")
-	customerListBytes, err := stub.GetState(customersKey)
+	// Refund the most expensive units first and give them back to their sellers
+	unitsRefunded := unitsToRefund
+	totalRefund, err := refundPendingTransaction(stub, charger, &pt, unitsToRefund)
 	if err != nil {
-		retStr = "Could not get customersKey from chaincode state"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		retStr = err.Error()
+		return createInvokeErrorFrom(err, retStr)
 	}
-	json.Unmarshal(customerListBytes, &customers)
 
-	// Get the list of available offers
-	fmt.Println("Getting available offers")
-	offerListBytes, err := stub.GetState(offersKey)
+	// Update pending transaction fields
+	pt.Status = "Refunded " + unitsRefunded.String()
+	pt.TXID, err = nextTXID(stub)
+	if err != nil {
+		retStr = "Could not get next TXID from chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+	pt.Timestamp, err = getTxTimestamp(stub)
+	if err != nil {
+		retStr = "Could not get transaction timestamp"
+		return createInvokeError(codeStateError, retStr)
+	}
+
+	// Transaction has been refunded -- finalize transaction and save changes to the chaincode state
+
+	// Save the refunded transaction to the chaincode state
+	fmt.Println("Writing refunded transaction to chaincode state")
+	err = putTransaction(stub, pt)
+	if err != nil {
+		retStr = "Could not write transaction to chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+
+	// Clear the pending transaction in the chaincode state
+	fmt.Println("Clearing pending transaction in chaincode state")
+	err = stub.DelState(createCompositeKey(pendingTransactionObjectType, chargerID))
+	if err != nil {
+		retStr = "Could not clear pending transaction of charger " + chargerID + " in chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+
+	// Tell subscribers about the refund
+	err = emitEvent(stub, eventTransactionCancelled, TransactionCancelledEvent{Transaction: pt, UnitsRefunded: unitsRefunded, AmountRefunded: totalRefund})
+	if err != nil {
+		retStr = "Could not emit event: " + err.Error()
+		return createInvokeErrorFrom(err, retStr)
+	}
+
+	// The charger is free again and has the refunded units back, resting bids may be filled
+	err = matchBids(stub, chargerID)
+	if err != nil {
+		retStr = "Could not match bids at charger " + chargerID + ": " + err.Error()
+		return createInvokeErrorFrom(err, retStr)
+	}
+
+	// Successful return
+	retStr = "Successfully refunded " + args[1] + " units of the pending transaction"
+	return createInvokeResponse(retStr, pt)
+
+}
+
+// Add a transaction to the injected transactions directly
+// Used to create data for the website visualization, kept apart from real sales and removed with purgeSyntheticTransactions
+func addTransaction(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	var retStr string
+	var err error
+	var newTransaction Transaction
+
+	// Parameter order and needed type:
+	//	Version	"2"
+	//	Timestamp	int64
+	//	Buyer	string
+	//	Energy 	Amount
+	//	Cost 	Amount
+	//	Offers	map[string]Amount
+
+	// The version is checked against addTransactionVersion before this runs
+	args = args[1:]
+
+	// Process parameters and make new transaction
+	newTransaction.Timestamp, _ = strconv.ParseInt(args[0], 10, 64)
+	newTransaction.Buyer = strings.ToLower(args[1])
+	newTransaction.Energy, _ = parseAmount(args[2])
+	newTransaction.Cost, _ = parseAmount(args[3])
+	// Remaining parameters are offers and come in pairs: price tier, quantity
+	newTransaction.Offers = make(map[string]Amount)
+	offers := args[4:]
+	for len(offers) > 0 {
+		newTransaction.Offers[offers[0]], _ = parseAmount(offers[1])
+		offers = offers[2:]
+	}
+
+	// Flag the transaction with where it came from
+	newTransaction.Source = sourceAddTransaction
+	newTransaction.InjectedBy, err = getCallerID(stub)
+	if err != nil {
+		retStr = err.Error()
+		return createInvokeErrorFrom(err, retStr)
+	}
+
+	// Injected transactions get a TXID like any other transaction
+	newTransaction.TXID, err = nextTXID(stub)
+	if err != nil {
+		retStr = "Could not get next TXID from chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+
+	// Transaction has been built, save it to the chaincode state
+	fmt.Println("Writing new transaction to chaincode state")
+	err = putTransaction(stub, newTransaction)
+	if err != nil {
+		retStr = "Could not write transaction to chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+
+	// Successful return
+	retStr = "Successfully added injected transaction " + strconv.FormatInt(newTransaction.TXID, 10) + " to chaincode state"
+	return createInvokeResponse(retStr, newTransaction)
+
+}
+
+// Split the monolithic JSON blobs written by earlier versions of the chaincode into per-entity keys
+// Meant to be run once after upgrading, the blobs are deleted once they have been migrated
+func migrateState(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	var retStr string
+	var err error
+	var legacyCustomers map[string]Amount
+	var legacyChargers map[string]Charger
+	var legacyOffers map[string]Amount
+	var legacyPendingTransaction []Transaction
+	var legacyTransactions []Transaction
+
+	// Debug message
+	fmt.Println("Trying to migrate legacy chaincode state to per-entity keys")
+	migrated := false
+
+	// Migrate customers
+	customersBytes, err := stub.GetState(legacyCustomersKey)
+	if err != nil {
+		retStr = "Could not get " + legacyCustomersKey + " from chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+	if len(customersBytes) > 0 {
+		json.Unmarshal(customersBytes, &legacyCustomers)
+		fmt.Println("Migrating " + strconv.Itoa(len(legacyCustomers)) + " customers")
+		err = putCustomerBalances(stub, legacyCustomers)
+		if err != nil {
+			retStr = "Could not write customers to chaincode state"
+			return createInvokeError(codeStateError, retStr)
+		}
+		err = stub.DelState(legacyCustomersKey)
+		if err != nil {
+			retStr = "Could not delete " + legacyCustomersKey + " from chaincode state"
+			return createInvokeError(codeStateError, retStr)
+		}
+		migrated = true
+	}
+
+	// Migrate chargers along with their offers and pending transaction
+	chargersBytes, err := stub.GetState(legacyChargersKey)
+	if err != nil {
+		retStr = "Could not get " + legacyChargersKey + " from chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+	if len(chargersBytes) > 0 {
+		json.Unmarshal(chargersBytes, &legacyChargers)
+		fmt.Println("Migrating " + strconv.Itoa(len(legacyChargers)) + " chargers")
+		for chargerID, charger := range legacyChargers {
+			err = migrateLegacyCharger(stub, charger, legacyOffersKey + "_" + chargerID, legacyPendingTransactionKey + "_" + chargerID)
+			if err != nil {
+				retStr = err.Error()
+				return createInvokeErrorFrom(err, retStr)
+			}
+		}
+		err = stub.DelState(legacyChargersKey)
+		if err != nil {
+			retStr = "Could not delete " + legacyChargersKey + " from chaincode state"
+			return createInvokeError(codeStateError, retStr)
+		}
+		migrated = true
+	}
+
+	// Migrate the offers and pending transaction written before chargers existed
+	// They belonged to the single charger whose revenue went to the reserved "owner" account
+	offersBytes, err := stub.GetState(legacyOffersKey)
+	if err != nil {
+		retStr = "Could not get " + legacyOffersKey + " from chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+	pendingTransactionBytes, err := stub.GetState(legacyPendingTransactionKey)
+	if err != nil {
+		retStr = "Could not get " + legacyPendingTransactionKey + " from chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+	json.Unmarshal(offersBytes, &legacyOffers)
+	json.Unmarshal(pendingTransactionBytes, &legacyPendingTransaction)
+	if len(legacyOffers) > 0 || len(legacyPendingTransaction) > 0 {
+		if len(args) == 0 || len(args[0]) == 0 {
+			retStr = "Found offers or a pending transaction that predate chargers: a charger ID is needed to migrate them"
+			return createInvokeError(codeBadArgument, retStr)
+		}
+		var charger Charger
+		charger.ID = strings.ToLower(args[0])
+		charger.Owner = "owner"
+		fmt.Println("Migrating offers and pending transaction to charger " + charger.ID)
+		err = migrateLegacyCharger(stub, charger, legacyOffersKey, legacyPendingTransactionKey)
+		if err != nil {
+			retStr = err.Error()
+			return createInvokeErrorFrom(err, retStr)
+		}
+		migrated = true
+	} else if len(offersBytes) > 0 || len(pendingTransactionBytes) > 0 {
+		// Nothing worth keeping, just remove the empty blobs
+		for _, key := range []string{legacyOffersKey, legacyPendingTransactionKey} {
+			err = stub.DelState(key)
+			if err != nil {
+				retStr = "Could not delete " + key + " from chaincode state"
+				return createInvokeError(codeStateError, retStr)
+			}
+		}
+		migrated = true
+	}
+
+	// Migrate offer tiers written before sellers were recorded
+	// Their units were sold by the owner of the charger
+	legacyTiers := make(map[string]map[string]Amount)
+	err = getStateByPartialCompositeKey(stub, offerObjectType, []string{}, func(key string, valAsBytes []byte) error {
+		var quantity Amount
+		json.Unmarshal(valAsBytes, &quantity)
+		_, attributes := splitCompositeKey(key)
+		if len(attributes) == 2 {
+			if _, ok := legacyTiers[attributes[0]]; !ok {
+				legacyTiers[attributes[0]] = make(map[string]Amount)
+			}
+			legacyTiers[attributes[0]][attributes[1]] = quantity
+		}
+		return nil
+	})
+	if err != nil {
+		retStr = "Could not get offers from chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+	for chargerID, offers := range legacyTiers {
+		charger, err := getCharger(stub, chargerID)
+		if err != nil {
+			retStr = err.Error()
+			return createInvokeErrorFrom(err, retStr)
+		}
+		fmt.Println("Migrating " + strconv.Itoa(len(offers)) + " offer tiers of charger " + chargerID + " to seller " + charger.Owner)
+		for pricePerUnit, quantity := range offers {
+			err = marshalAndPut(stub, createCompositeKey(offerObjectType, chargerID, pricePerUnit, charger.Owner), quantity)
+			if err != nil {
+				retStr = "Could not write offers of charger " + chargerID + " to chaincode state"
+				return createInvokeError(codeStateError, retStr)
+			}
+			err = stub.DelState(createCompositeKey(offerObjectType, chargerID, pricePerUnit))
+			if err != nil {
+				retStr = "Could not delete offers of charger " + chargerID + " from chaincode state"
+				return createInvokeError(codeStateError, retStr)
+			}
+		}
+		migrated = true
+	}
+
+	// Migrate past transactions
+	transactionsBytes, err := stub.GetState(legacyTransactionsKey)
+	if err != nil {
+		retStr = "Could not get " + legacyTransactionsKey + " from chaincode state"
+		return createInvokeError(codeStateError, retStr)
+	}
+	if len(transactionsBytes) > 0 {
+		json.Unmarshal(transactionsBytes, &legacyTransactions)
+		fmt.Println("Migrating " + strconv.Itoa(len(legacyTransactions)) + " transactions")
+		for _, transaction := range legacyTransactions {
+			// Legacy TXIDs were the Unix time of completion
+			if transaction.Timestamp == 0 {
+				transaction.Timestamp = transaction.TXID
+			}
+			// The old addTransaction wrote straight into the past transactions, keep what it injected apart
+			if isInjectedTransaction(transaction) {
+				transaction.Source = sourceAddTransaction
+			}
+			err = putTransaction(stub, transaction)
+			if err != nil {
+				retStr = "Could not write transaction to chaincode state"
+				return createInvokeError(codeStateError, retStr)
+			}
+		}
+		err = stub.DelState(legacyTransactionsKey)
+		if err != nil {
+			retStr = "Could not delete " + legacyTransactionsKey + " from chaincode state"
+			return createInvokeError(codeStateError, retStr)
+		}
+		migrated = true
+	}
+
+	// Record the supply of chargers whose offers predate supply movements
+	// Done last, so it sees the offers and pending transactions migrated above
+	supplyChargerIDs, err := migrateChargerSupply(stub)
+	if err != nil {
+		retStr = "Could not record the supply of chargers: " + err.Error()
+		return createInvokeErrorFrom(err, retStr)
+	}
+	if len(supplyChargerIDs) > 0 {
+		fmt.Println("Recorded the supply of " + strconv.Itoa(len(supplyChargerIDs)) + " chargers: " + strings.Join(supplyChargerIDs, ", "))
+		migrated = true
+	}
+
+	// Nothing to do if the state was already migrated
+	if !migrated {
+		retStr = "No legacy chaincode state to migrate"
+		return createInvokeError(codeNothingToMigrate, retStr)
+	}
+
+	// Successful return
+	retStr = "Successfully migrated legacy chaincode state to per-entity keys"
+	return createInvokeResponse(retStr, nil)
+
+}
+
+//////////////////////////////////////// UTILITY FUNCTIONS ////////////////////////////////////////
+
+// Build a composite key out of an object type and the attributes that identify the entity, e.g. customer~ross
+func createCompositeKey(objectType string, attributes ...string) string {
+	return strings.Join(append([]string{objectType}, attributes...), compositeKeySeparator)
+}
+
+// Split a composite key back into its object type and attributes
+func splitCompositeKey(key string) (string, []string) {
+	parts := strings.Split(key, compositeKeySeparator)
+	return parts[0], parts[1:]
+}
+
+// Call fn for every key in the chaincode state that starts with the given object type and attributes
+// Keys are visited in lexical order
+func getStateByPartialCompositeKey(stub shim.ChaincodeStubInterface, objectType string, attributes []string, fn func(key string, valAsBytes []byte) error) (error) {
+
+	// Range over every key that starts with objectType~attributes~
+	prefix := createCompositeKey(objectType, attributes...) + compositeKeySeparator
+	keysIter, err := stub.RangeQueryState(prefix, prefix + compositeKeyMaxSuffix)
+	if err != nil {
+		return err
+	}
+	defer keysIter.Close()
+
+	for keysIter.HasNext() {
+		key, valAsBytes, err := keysIter.Next()
+		if err != nil {
+			return err
+		}
+		err = fn(key, valAsBytes)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+
+}
+
+// Range query over the keys prefix+startSuffix to prefix+endSuffix that keeps the key it is at
+// Used to walk several object types whose keys end the same way side by side
+type transactionIterator struct {
+	keysIter	shim.StateRangeQueryIteratorInterface
+	prefix		string
+	ok			bool
+	key			string
+	suffix		string
+	valAsBytes	[]byte
+}
+
+func newTransactionIterator(stub shim.ChaincodeStubInterface, prefix string, startSuffix string, endSuffix string) (*transactionIterator, error) {
+	keysIter, err := stub.RangeQueryState(prefix + startSuffix, prefix + endSuffix)
+	if err != nil {
+		return nil, err
+	}
+	it := &transactionIterator{keysIter: keysIter, prefix: prefix}
+	return it, it.advance()
+}
+
+// Move to the next key, ok is false once there are none left
+func (it *transactionIterator) advance() (error) {
+	it.ok = it.keysIter.HasNext()
+	if !it.ok {
+		return nil
+	}
+	key, valAsBytes, err := it.keysIter.Next()
+	if err != nil {
+		return err
+	}
+	it.key, it.suffix, it.valAsBytes = key, key[len(it.prefix):], valAsBytes
+	return nil
+}
+
+// Delete every key of an object type from the chaincode state
+func deleteStateByObjectType(stub shim.ChaincodeStubInterface, objectType string) (error) {
+
+	// Collect the keys first, the state shouldn't change while it is being iterated over
+	var keys []string
+	err := getStateByPartialCompositeKey(stub, objectType, nil, func(key string, valAsBytes []byte) error {
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		err = stub.DelState(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+
+}
+
+// Get the balances of the requested customers
+// Customers that do not exist are left out of the returned map
+func getCustomerBalances(stub shim.ChaincodeStubInterface, customerIDs ...string) (map[string]Amount, error) {
+
+	customers := make(map[string]Amount)
+	for _, customerID := range customerIDs {
+		balanceBytes, err := stub.GetState(createCompositeKey(customerObjectType, customerID))
+		if err != nil {
+			return nil, err
+		}
+		if len(balanceBytes) == 0 {
+			continue
+		}
+		var balance Amount
+		json.Unmarshal(balanceBytes, &balance)
+		customers[customerID] = balance
+	}
+	return customers, nil
+
+}
+
+// Write the balance of every customer in the map to its own key
+func putCustomerBalances(stub shim.ChaincodeStubInterface, customers map[string]Amount) (error) {
+
+	for customerID, balance := range customers {
+		err := marshalAndPut(stub, createCompositeKey(customerObjectType, customerID), balance)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+
+}
+
+// Get the offer tiers of a charger as a map of price per unit to units for sale from every seller
+func getChargerOffers(stub shim.ChaincodeStubInterface, chargerID string) (map[string]Amount, error) {
+
+	tiers, err := getChargerOfferTiers(stub, chargerID)
+	if err != nil {
+		return nil, err
+	}
+
+	return sumOfferTiers(tiers)
+
+}
+
+// Total units of each offer tier, summed over its sellers
+func sumOfferTiers(tiers map[string]map[string]Amount) (map[string]Amount, error) {
+
+	var err error
+	offers := make(map[string]Amount)
+	for pricePerUnit, tier := range tiers {
+		for _, quantity := range tier {
+			offers[pricePerUnit], err = addAmounts(offers[pricePerUnit], quantity)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return offers, nil
+
+}
+
+// Get the offer tiers of a charger as a map of price per unit to each seller's units for sale
+func getChargerOfferTiers(stub shim.ChaincodeStubInterface, chargerID string) (map[string]map[string]Amount, error) {
+
+	tiers := make(map[string]map[string]Amount)
+	err := getStateByPartialCompositeKey(stub, offerObjectType, []string{chargerID}, func(key string, valAsBytes []byte) error {
+		var quantity Amount
+		json.Unmarshal(valAsBytes, &quantity)
+		_, attributes := splitCompositeKey(key)
+		// Offers written before sellers were recorded are left for migrateState
+		if len(attributes) < 3 {
+			return nil
+		}
+		pricePerUnit, seller := attributes[1], attributes[2]
+		if _, ok := tiers[pricePerUnit]; !ok {
+			tiers[pricePerUnit] = make(map[string]Amount)
+		}
+		tiers[pricePerUnit][seller] = quantity
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return tiers, nil
+
+}
+
+// Write the offer tiers of a charger, one key per seller in each tier
+// Only quantities that changed are written, sellers and tiers missing from tiers are deleted
+func putChargerOfferTiers(stub shim.ChaincodeStubInterface, chargerID string, tiers map[string]map[string]Amount) (error) {
+
+	// Compare against what is currently stored
+	current, err := getChargerOfferTiers(stub, chargerID)
 	if err != nil {
-		retStr = "Could not get offersKey from chaincode state"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		return err
+	}
+
+	for pricePerUnit, tier := range current {
+		for seller := range tier {
+			if quantity, ok := tiers[pricePerUnit][seller]; !ok || quantity <= 0 {
+				err = stub.DelState(createCompositeKey(offerObjectType, chargerID, pricePerUnit, seller))
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	for pricePerUnit, tier := range tiers {
+		for seller, quantity := range tier {
+			if quantity <= 0 {
+				continue
+			}
+			if val, ok := current[pricePerUnit][seller]; ok && val == quantity {
+				continue
+			}
+			err = marshalAndPut(stub, createCompositeKey(offerObjectType, chargerID, pricePerUnit, seller), quantity)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+
+}
+
+// Take units from the sellers of a tier, in order of seller ID
+// Reverse takes them in the opposite order, so refunds give units back to the sellers that were taken from last
+// Returns the units taken from each seller, sellers that run out are removed from the tier
+func takeFromTier(tier map[string]Amount, units Amount, reverse bool) (map[string]Amount) {
+
+	// Order sellers by ID so every peer takes the same units
+	sellers := make([]string, 0, len(tier))
+	for seller := range tier {
+		sellers = append(sellers, seller)
+	}
+	sort.Strings(sellers)
+	if reverse {
+		for i, j := 0, len(sellers)-1; i < j; i, j = i+1, j-1 {
+			sellers[i], sellers[j] = sellers[j], sellers[i]
+		}
+	}
+
+	taken := make(map[string]Amount)
+	for _, seller := range sellers {
+		if units == 0 {
+			break
+		}
+		take := tier[seller]
+		if take > units {
+			take = units
+		}
+		taken[seller] = take
+		units -= take
+		tier[seller] -= take
+		if tier[seller] == 0 {
+			delete(tier, seller)
+		}
 	}
-	json.Unmarshal(offerListBytes, &offers)
+	return taken
+
+}
 
-	// Get the list of past transactions
-	transactionListBytes, err := stub.GetState(transactionsKey)
+// Refund units of a pending transaction, most expensive first, and give them back to the sellers they were bought from
+// Updates the offers, sellers, energy and cost of pt and writes the customer accounts and offer tiers
+// Returns the amount refunded to the buyer
+func refundPendingTransaction(stub shim.ChaincodeStubInterface, charger Charger, pt *Transaction, unitsToRefund Amount) (Amount, error) {
+
+	// Get the list of available offers at this charger
+	fmt.Println("Getting available offers")
+	tiers, err := getChargerOfferTiers(stub, charger.ID)
 	if err != nil {
-		retStr = "Could not get transactionsKey from chaincode state"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		return 0, errors.New("Could not get offers of charger " + charger.ID + " from chaincode state")
 	}
-	json.Unmarshal(transactionListBytes, &pastTransactions)
 
+	// Transactions accepted before sellers were recorded were sold by the charger owner
+	if pt.Sellers == nil {
+		pt.Sellers = make(map[string]map[string]Amount)
+		for pricePerUnitStr, units := range pt.Offers {
+			pt.Sellers[pricePerUnitStr] = map[string]Amount{charger.Owner: units}
+		}
+	}
 
 	// Make a slice out of the offer map's keys
 	// Reverse the order so the most expensive tier is first
-	offerKeys := reverseIntSlice(getMapStringKeysAsAscendingInts(pt.Offers))
+	offerKeys := reverseAmountSlice(getMapStringKeysAsAscendingAmounts(pt.Offers))
 	fmt.Println("Order of offer keys to refund: ", offerKeys)
 
 	// Set pt.Energy now because unitsToRefund will be used & changed in the algorithm below
@@ -1042,200 +2060,280 @@ func cancelTransaction(stub shim.ChaincodeStubInterface, args []string) ([]byte,
 
 	// Refund the most expensive units first
 	// Keep refunding until enough units have been returned
-	totalRefund := 0
+	// Within a tier, the units are given back to the sellers in reverse order of seller ID
+	// The refund is the sum of what every seller gives back: what they were paid for their units at the tier
+	// less what the units they keep are worth, both rounded like the cost, so the cost left is what the sellers keep
+	var totalRefund Amount
+	clawbacks := make(map[string]Amount)
 	for i, pricePerUnit := range offerKeys {
-		fmt.Println("Refund pass", i, "-", unitsToRefund, "units left to refund")
-		pricePerUnitStr := strconv.Itoa(pricePerUnit)
+		fmt.Println("Refund pass", i, "-", unitsToRefund.String(), "units left to refund")
+		pricePerUnitStr := pricePerUnit.String()
 		unitsBoughtAtCurrentTier := pt.Offers[pricePerUnitStr]
-		fmt.Println("Currently processing offer tier " + pricePerUnitStr + " - " + strconv.Itoa(unitsBoughtAtCurrentTier) + " bought at this tier")
-		if unitsToRefund <= unitsBoughtAtCurrentTier {
-			// This price tier is the last that needs to be refunded from
+		fmt.Println("Currently processing offer tier " + pricePerUnitStr + " - " + unitsBoughtAtCurrentTier.String() + " bought at this tier")
+		unitsRefundedAtCurrentTier := unitsBoughtAtCurrentTier
+		if unitsToRefund < unitsBoughtAtCurrentTier {
+			unitsRefundedAtCurrentTier = unitsToRefund
+		}
+		// Give the units back to the offers of the sellers they were bought from
+		// Create the offer tier if it does not exist anymore
+		if _, ok := tiers[pricePerUnitStr]; !ok {
+			tiers[pricePerUnitStr] = make(map[string]Amount)
+		}
+		sellers := pt.Sellers[pricePerUnitStr]
+		unitsBefore := make(map[string]Amount, len(sellers))
+		for seller, units := range sellers {
+			unitsBefore[seller] = units
+		}
+		for seller, units := range takeFromTier(sellers, unitsRefundedAtCurrentTier, true) {
+			// Refunded units go back even if the tier is now above the quantity limit
+			tiers[pricePerUnitStr][seller], err = addAmounts(tiers[pricePerUnitStr][seller], units)
+			if err != nil {
+				return 0, err
+			}
 			// Calculate cost of this part of the refund
-			totalRefund += unitsToRefund * pricePerUnit
-			// Check to see if this price tier still exists
-			// If it exists, add the number of units
-			// If it does not exist, create the offer tier and initialize it to
-			if _, ok := offers[pricePerUnitStr]; ok {
-				offers[pricePerUnitStr] += unitsToRefund
-			} else {
-				offers[pricePerUnitStr] = unitsToRefund
+			paidBefore, err := multiplyAmounts(unitsBefore[seller], pricePerUnit)
+			var paidAfter, clawback Amount
+			if err == nil {
+				paidAfter, err = multiplyAmounts(sellers[seller], pricePerUnit)
 			}
-			// Update this price tier in the pending transaction
-			// If units bought at this tier ends up being zero, delete this tier from the map
-			if unitsToRefund == unitsBoughtAtCurrentTier {
-				delete(pt.Offers, pricePerUnitStr)
-			} else {
-				pt.Offers[pricePerUnitStr] -= unitsToRefund
+			if err == nil {
+				clawback, err = subtractAmounts(paidBefore, paidAfter)
 			}
-			// Don't need to update unitsToRefund
-			// Last key that needs to be visited so break
-			break
-		} else {
-			// This price tier is not the last that needs to be refunded from
-			// Calculate cost of this part of the refund
-			totalRefund += unitsBoughtAtCurrentTier * pricePerUnit
-			// Check to see if this price tier still exists
-			// If it exists, add the number of units
-			// If it does not exist, create the offer tier and initialize it to
-			if _, ok := offers[pricePerUnitStr]; ok {
-				offers[pricePerUnitStr] += unitsBoughtAtCurrentTier
-			} else {
-				offers[pricePerUnitStr] = unitsBoughtAtCurrentTier
+			if err == nil {
+				clawbacks[seller], err = addAmounts(clawbacks[seller], clawback)
 			}
-			// Remove this price tier from the pending transaction
+			if err == nil {
+				totalRefund, err = addAmounts(totalRefund, clawback)
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+		// Update this price tier in the pending transaction
+		// If units bought at this tier ends up being zero, delete this tier from the maps
+		if unitsRefundedAtCurrentTier == unitsBoughtAtCurrentTier {
 			delete(pt.Offers, pricePerUnitStr)
-			// Update unitsToRefund
-			unitsToRefund -= unitsBoughtAtCurrentTier
+			delete(pt.Sellers, pricePerUnitStr)
+		} else {
+			pt.Offers[pricePerUnitStr] -= unitsRefundedAtCurrentTier
+		}
+		// Update unitsToRefund, stop once everything has been refunded
+		unitsToRefund -= unitsRefundedAtCurrentTier
+		if unitsToRefund == 0 {
+			break
 		}
 	}
 
-	// Refund the customer totalRefund from the owner's account
-	customers[pt.Buyer] += totalRefund
-	customers["owner"] -= totalRefund
-
-	// Update pending transaction fields
-	pt.Cost -= totalRefund
-	pt.TXID = time.Now().Unix()
-	pt.Status = "Refunded " + args[0]
-
-	// Transaction has been refunded -- finalize transaction and save changes to the chaincode state
-
-	// Append the pending transaction to past transactions
-	pastTransactions = append(pastTransactions, pt)
-
-	// Save the list of transactions to the chaincode state
-	fmt.Println("Writing updated past transaction list to chaincode state")
-	err = marshalAndPut(stub, transactionsKey, pastTransactions)
+	// Get the buyer and every seller that is refunded from the chaincode state
+	fmt.Println("Getting customer accounts")
+	customerIDs := []string{pt.Buyer}
+	for seller := range clawbacks {
+		customerIDs = append(customerIDs, seller)
+	}
+	customers, err := getCustomerBalances(stub, customerIDs...)
 	if err != nil {
-		retStr = "Could not write transactionsKey to chaincode state"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		return 0, errors.New("Could not get customers from chaincode state")
 	}
 
-	// Clear the pending transaction
-	var emptyTransaction []Transaction
-	fmt.Println("Writing updated pending transactions to chaincode state")
-	// Update the pending transactions in the chaincode state
-	err = marshalAndPut(stub, pendingTransactionKey, emptyTransaction)
+	// Refund the customer totalRefund from the accounts of the sellers
+	// A seller that already spent the payment cannot be refunded from
+	for seller, amount := range clawbacks {
+		if customers[seller] < amount {
+			return 0, newChaincodeError(codeInsufficientFunds, "Seller " + seller + " does not have enough funds to refund " + amount.String() + ", available funds = " + customers[seller].String(), ErrorDetails{"customer": seller, "required": amount, "available": customers[seller]})
+		}
+	}
+	entries := append(counterpartyEntries(entryRefund, clawbacks, true, pt.Buyer, charger.ID), LedgerEntry{Customer: pt.Buyer, Type: entryRefund, Amount: totalRefund, Charger: charger.ID})
+	err = applyLedgerEntries(stub, customers, entries)
 	if err != nil {
-		retStr = "Could not write pendingTransactionKey to chaincode state"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		return 0, err
 	}
+	pt.Cost -= totalRefund
 
 	// Update customer accounts
-	fmt.Println("Writing updated customer list to chaincode state")
-	err = marshalAndPut(stub, customersKey, customers)
+	fmt.Println("Writing updated customer accounts to chaincode state")
+	err = putCustomerBalances(stub, customers)
 	if err != nil {
-		retStr = "Could not write customersKey to chaincode state"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		return 0, errors.New("Could not write customers to chaincode state")
 	}
 
 	// Update available offers
 	fmt.Println("Writing updated available offers to chaincode state")
-	err = marshalAndPut(stub, offersKey, offers)
+	err = putChargerOfferTiers(stub, charger.ID, tiers)
 	if err != nil {
-		retStr = "Could not write offersKey to chaincode state"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		return 0, errors.New("Could not write offers of charger " + charger.ID + " to chaincode state")
 	}
+	return totalRefund, nil
 
-	// Successful return
-	retStr = "Successfully refunded " + args[0] + " units of the pending transaction"
-	fmt.Println(retStr)
-	return []byte(retStr), nil
 
 }
 
-// Add a transaction to the list of past transactions directly
-// Used to create data for the website visualization
-func addTransaction(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-
-	var retStr string
-	var err error
-	var newTransaction Transaction
-	var pastTransactions []Transaction
+// Write a past transaction to its own key, tx~TXID~n, or synthetictx~TXID~n if it was injected
+// TXID is zero padded so transactions are ordered by TXID, n keeps transactions that share a TXID apart
+func putTransaction(stub shim.ChaincodeStubInterface, transaction Transaction) (error) {
 
-	// Parameter order and needed type:
-	//	TXID 	int64
-	//	Buyer	string
-	//	Energy 	int
-	//	Cost 	int
-	//	Offers	map[string]int
+	txid := fmt.Sprintf("%020d", transaction.TXID)
+	objectType := transactionObjectType
+	if len(transaction.Source) > 0 {
+		objectType = syntheticTransactionObjectType
+	}
 
-	// Check parameters
-	// Number of parameters must be even and greater than or equal to 6
-	if len(args) < 6 || len(args) % 2 != 0 {
-		retStr = "Incorrect number of arguments: Expecting an even number >= 6, received " + strconv.Itoa(len(args))
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+	// Count the transactions that already use this TXID
+	n := 0
+	err := getStateByPartialCompositeKey(stub, objectType, []string{txid}, func(key string, valAsBytes []byte) error {
+		n++
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	// Process parameters and make new transaction
-	newTransaction.TXID, err = strconv.ParseInt(args[0], 10, 64)
+	return marshalAndPut(stub, createCompositeKey(objectType, txid, strconv.Itoa(n)), transaction)
+
+}
+
+// Get the next TXID from the counter in the chaincode state
+// The first call after a migration continues from the largest TXID already stored
+func nextTXID(stub shim.ChaincodeStubInterface) (int64, error) {
+
+	var lastTXID int64
+
+	lastTXIDBytes, err := stub.GetState(lastTXIDKey)
 	if err != nil {
-		retStr = "Could not parse first parameter [TXID] (" + args[0] + ") to int64"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		return 0, err
+	}
+	if len(lastTXIDBytes) > 0 {
+		json.Unmarshal(lastTXIDBytes, &lastTXID)
+	} else {
+		// Transaction keys are ordered by TXID, the last one of either kind holds the largest
+		for _, objectType := range []string{transactionObjectType, syntheticTransactionObjectType} {
+			err = getStateByPartialCompositeKey(stub, objectType, nil, func(key string, valAsBytes []byte) error {
+				var transaction Transaction
+				json.Unmarshal(valAsBytes, &transaction)
+				if transaction.TXID > lastTXID {
+					lastTXID = transaction.TXID
+				}
+				return nil
+			})
+			if err != nil {
+				return 0, err
+			}
+		}
 	}
-	newTransaction.Buyer = args[1]
-	newTransaction.Energy, err = strconv.Atoi(args[2])
+
+	lastTXID++
+	err = marshalAndPut(stub, lastTXIDKey, lastTXID)
 	if err != nil {
-		retStr = "Could not parse third parameter [amount of energy] (" + args[2] + ") to int"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		return 0, err
 	}
-	newTransaction.Cost, err = strconv.Atoi(args[3])
+	return lastTXID, nil
+
+}
+
+// Get the timestamp of the transaction proposal as Unix time
+// Unlike the local clock, it is the same on every endorsing peer
+func getTxTimestamp(stub shim.ChaincodeStubInterface) (int64, error) {
+
+	txTimestamp, err := stub.GetTxTimestamp()
 	if err != nil {
-		retStr = "Could not parse fourth parameter [cost] (" + args[3] + ") to int"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		return 0, err
 	}
-	// Remaining parameters are offers and come in pairs: price tier, quantity
-	newTransaction.Offers = make(map[string]int)
-	offers := args[4:]
-	for len(offers) > 0 {
-		newTransaction.Offers[offers[0]], err = strconv.Atoi(offers[1])
-		if err != nil {
-			retStr = "Could not parse offer parameter (" + offers[1] + ") to int"
-			fmt.Println(retStr)
-			return []byte(retStr), errors.New(retStr)
-		}
-		offers = offers[2:]
+	if txTimestamp == nil {
+		return 0, errors.New("Transaction timestamp is not set")
 	}
+	return txTimestamp.Seconds, nil
+
+}
 
-	// Transaction has been built, add it to past transactions list
+// Copy a charger from the legacy blobs to per-entity keys and delete its legacy offers and pending transaction
+func migrateLegacyCharger(stub shim.ChaincodeStubInterface, charger Charger, offersKey string, pendingTransactionKey string) (error) {
 
-	// Get the list of past transactions
-	transactionListBytes, err := stub.GetState(transactionsKey)
+	var offers map[string]Amount
+	var pendingTransaction []Transaction
+
+	// Write the charger
+	err := marshalAndPut(stub, createCompositeKey(chargerObjectType, charger.ID), charger)
 	if err != nil {
-		retStr = "Could not get transactionsKey from chaincode state"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		return errors.New("Could not write charger " + charger.ID + " to chaincode state")
 	}
-	json.Unmarshal(transactionListBytes, &pastTransactions)
 
-	// Add new transaction to past transactions
-	pastTransactions = append(pastTransactions, newTransaction)
+	// Split the offers into one key per tier
+	offersBytes, err := stub.GetState(offersKey)
+	if err != nil {
+		return errors.New("Could not get " + offersKey + " from chaincode state")
+	}
+	json.Unmarshal(offersBytes, &offers)
+	tiers := make(map[string]map[string]Amount)
+	for pricePerUnit, quantity := range offers {
+		tiers[pricePerUnit] = map[string]Amount{charger.Owner: quantity}
+	}
+	err = putChargerOfferTiers(stub, charger.ID, tiers)
+	if err != nil {
+		return errors.New("Could not write offers of charger " + charger.ID + " to chaincode state")
+	}
 
-	// Save the list of past transactions to the chaincode state
-	fmt.Println("Writing updated past transaction list to chaincode state")
-	err = marshalAndPut(stub, transactionsKey, pastTransactions)
+	// Move the pending transaction
+	pendingTransactionBytes, err := stub.GetState(pendingTransactionKey)
 	if err != nil {
-		retStr = "Could not write transactionsKey to chaincode state"
-		fmt.Println(retStr)
-		return []byte(retStr), errors.New(retStr)
+		return errors.New("Could not get " + pendingTransactionKey + " from chaincode state")
+	}
+	json.Unmarshal(pendingTransactionBytes, &pendingTransaction)
+	if len(pendingTransaction) > 0 {
+		now, err := getTxTimestamp(stub)
+		if err != nil {
+			return errors.New("Could not get transaction timestamp")
+		}
+		// Its timeout starts with the migration
+		for i := range pendingTransaction {
+			pendingTransaction[i].Charger = charger.ID
+			if pendingTransaction[i].Accepted == 0 {
+				err = startPendingTimeout(stub, &pendingTransaction[i], now)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		err = marshalAndPut(stub, createCompositeKey(pendingTransactionObjectType, charger.ID), pendingTransaction)
+		if err != nil {
+			return errors.New("Could not write pending transaction of charger " + charger.ID + " to chaincode state")
+		}
 	}
 
-	// Successful return
-	retStr = "Successfully added transaction to chaincode state"
-	fmt.Println(retStr)
-	return []byte(retStr), nil
+	// Remove the legacy keys
+	err = stub.DelState(offersKey)
+	if err != nil {
+		return errors.New("Could not delete " + offersKey + " from chaincode state")
+	}
+	err = stub.DelState(pendingTransactionKey)
+	if err != nil {
+		return errors.New("Could not delete " + pendingTransactionKey + " from chaincode state")
+	}
+	return nil
 
 }
 
-//////////////////////////////////////// UTILITY FUNCTIONS ////////////////////////////////////////
+// Delete the monolithic blobs written by earlier versions of the chaincode, including the offers and pending transaction of every legacy charger
+func deleteLegacyState(stub shim.ChaincodeStubInterface) (error) {
+
+	var legacyChargers map[string]Charger
+
+	chargersBytes, err := stub.GetState(legacyChargersKey)
+	if err != nil {
+		return err
+	}
+	json.Unmarshal(chargersBytes, &legacyChargers)
+	keys := []string{legacyCustomersKey, legacyChargersKey, legacyOffersKey, legacyPendingTransactionKey, legacyTransactionsKey}
+	for chargerID := range legacyChargers {
+		keys = append(keys, legacyOffersKey + "_" + chargerID, legacyPendingTransactionKey + "_" + chargerID)
+	}
+	for _, key := range keys {
+		err = stub.DelState(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+
+}
 
 // Use the json package to marshal the interface into bytes, then store it in the chaincode state as the value of key
 func marshalAndPut(stub shim.ChaincodeStubInterface, key string, v interface{}) (error) {
@@ -1250,21 +2348,27 @@ func marshalAndPut(stub shim.ChaincodeStubInterface, key string, v interface{})
 
 }
 
-// Use the json package to marshal the data into bytes and construct a query response
-func createQueryResponseString(success bool, data string) ([]byte, error) {
-	var response QueryResponseString
-	response.Success = success
-	response.Data = data
-	r, _ := json.Marshal(response)
-	// If success, error is nil. If not success, data is an error message
-	if success {
-		return r, nil
-	} else {
-		return r, errors.New(data)
+// Look up a charger by its (lowercase) ID, returns an error if the charger does not exist
+func getCharger(stub shim.ChaincodeStubInterface, chargerID string) (Charger, error) {
+
+	var charger Charger
+
+	// Get the charger from the chaincode state
+	chargerBytes, err := stub.GetState(createCompositeKey(chargerObjectType, chargerID))
+	if err != nil {
+		return Charger{}, errors.New("Could not get charger " + chargerID + " from chaincode state")
+	}
+
+	// Make sure the requested charger exists
+	if len(chargerBytes) == 0 {
+		return Charger{}, newChaincodeError(codeUnknownCharger, "Charger " + chargerID + " does not exist", ErrorDetails{"charger": chargerID})
 	}
+	json.Unmarshal(chargerBytes, &charger)
+	return charger, nil
+
 }
 
-func createQueryResponseMap(success bool, data map[string]int) ([]byte, error) {
+func createQueryResponseMap(success bool, data map[string]Amount) ([]byte, error) {
 	var response QueryResponseMap
 	response.Success = success
 	response.Data = data
@@ -1272,8 +2376,8 @@ func createQueryResponseMap(success bool, data map[string]int) ([]byte, error) {
 	return r, nil
 }
 
-func createQueryResponseInt(success bool, data int) ([]byte, error) {
-	var response QueryResponseInt
+func createQueryResponseAmount(success bool, data Amount) ([]byte, error) {
+	var response QueryResponseAmount
 	response.Success = success
 	response.Data = data
 	r, _ := json.Marshal(response)
@@ -1288,6 +2392,31 @@ func createQueryResponseTransactions(success bool, data []Transaction) ([]byte,
 	return r, nil
 }
 
+func createQueryResponseTransactionsPage(success bool, data []Transaction, bookmark string) ([]byte, error) {
+	var response QueryResponseTransactionsPage
+	response.Success = success
+	response.Data = data
+	response.Bookmark = bookmark
+	r, _ := json.Marshal(response)
+	return r, nil
+}
+
+func createQueryResponseOfferTiers(success bool, data map[string]map[string]Amount) ([]byte, error) {
+	var response QueryResponseOfferTiers
+	response.Success = success
+	response.Data = data
+	r, _ := json.Marshal(response)
+	return r, nil
+}
+
+func createQueryResponseChargers(success bool, data map[string]Charger) ([]byte, error) {
+	var response QueryResponseChargers
+	response.Success = success
+	response.Data = data
+	r, _ := json.Marshal(response)
+	return r, nil
+}
+
 func createQueryResponseBytes(success bool, data []byte) ([]byte, error) {
 	var response QueryResponseBytes
 	response.Success = success
@@ -1296,25 +2425,25 @@ func createQueryResponseBytes(success bool, data []byte) ([]byte, error) {
 	return r, nil
 }
 
-// Get the keys of a map[string]int as ints
-func getMapStringKeysAsAscendingInts(m map[string]int) ([]int) {
-	// Create keys int array
-	keys := make([]int, len(m))
+// Get the keys of a map[string]Amount as amounts
+func getMapStringKeysAsAscendingAmounts(m map[string]Amount) ([]Amount) {
+	// Create keys amount array
+	keys := make([]Amount, len(m))
 	i := 0
-	// Get all keys and turn them into ints with Atoi
+	// Get all keys and turn them into amounts with parseAmount
 	for j := range m {
-		keys[i], _ = strconv.Atoi(j)
+		keys[i], _ = parseAmount(j)
 		i++
 	}
-	// Sort the integers in ascending order
-	sort.Ints(keys)
+	// Sort the amounts in ascending order
+	sort.Sort(amountsAscending(keys))
 	// Print out sorted keys for sanity check
-	fmt.Println("Sorted integers:", keys)
+	fmt.Println("Sorted amounts:", keys)
 	return keys
 }
 
-func reverseIntSlice(s []int) ([]int) {
-	fmt.Println("Reversing integer slice")
+func reverseAmountSlice(s []Amount) ([]Amount) {
+	fmt.Println("Reversing amount slice")
 	fmt.Println(s)
 	for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
 		s[i], s[j] = s[j], s[i]
@@ -0,0 +1,743 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func expectError(t *testing.T, got string, want string) {
+	if !strings.Contains(got, want) {
+		t.Fatalf("got error %q, want it to contain %q", got, want)
+	}
+}
+
+//////////////////////////////////////// INIT AND INVOKE ////////////////////////////////////////
+
+func TestInit(t *testing.T) {
+	s := newMockStub()
+	s.caller = "admin"
+
+	for _, args := range [][]string{{}, {"x"}, {"1", "boss", "extra"}} {
+		if _, err := testChaincode.Init(s, "init", args); err == nil {
+			t.Fatalf("init %v: expected an error", args)
+		}
+	}
+
+	if _, err := testChaincode.Init(s, "init", []string{"7"}); err != nil {
+		t.Fatal(err)
+	}
+	if string(s.state["ece"]) != "7" {
+		t.Fatalf("ece = %q, want 7", s.state["ece"])
+	}
+	var roles []string
+	s.query(t, &roles, "getRoles", "admin")
+	if len(roles) != 1 || roles[0] != roleAdmin {
+		t.Fatalf("roles of admin = %v", roles)
+	}
+
+	// The admin can be named instead of being the caller
+	s.caller = ""
+	if _, err := testChaincode.Init(s, "init", []string{"1"}); err == nil {
+		t.Fatal("init without a caller or admin: expected an error")
+	}
+	if _, err := testChaincode.Init(s, "init", []string{"1", "Boss"}); err != nil {
+		t.Fatal(err)
+	}
+	s.query(t, &roles, "getRoles", "boss")
+	if len(roles) != 1 || roles[0] != roleAdmin {
+		t.Fatalf("roles of boss = %v", roles)
+	}
+	s.query(t, &roles, "getRoles", "admin")
+	if len(roles) != 0 {
+		t.Fatalf("re-init kept the roles of admin: %v", roles)
+	}
+}
+
+func TestReinitClearsState(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "10")
+	s.mustInvoke(t, "charger1", "completeTransaction", "charger1")
+
+	expectError(t, s.mustFail(t, "james", "init", "1"), "requires role admin")
+	s.mustInvoke(t, "admin", "init", "1")
+
+	expectInts(t, "customers", s.customers(t), map[string]int{})
+	if n := len(s.transactions(t)); n != 0 {
+		t.Fatalf("%d transactions left after init", n)
+	}
+	for key := range s.state {
+		if key != "ece" && key != createCompositeKey(roleObjectType, "admin") {
+			t.Fatalf("key %s left after init", key)
+		}
+	}
+}
+
+func TestInvokeUnknownFunction(t *testing.T) {
+	s := newMarket(t)
+	expectError(t, s.mustFail(t, "admin", "mintMoney", "james"), "Received unknown function invocation: mintMoney")
+}
+
+func TestQueryUnknownFunction(t *testing.T) {
+	s := newMarket(t)
+	expectError(t, s.queryFails(t, "mintMoney"), "Query() did not find function: mintMoney")
+}
+
+//////////////////////////////////////// CUSTOMERS AND CHARGERS ////////////////////////////////////////
+
+func TestAddCustomer(t *testing.T) {
+	s := newMarket(t)
+
+	s.mustInvoke(t, "admin", "addCustomer", "Ross")
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 0, "james": 10000, "ross": 0})
+	var roles []string
+	s.query(t, &roles, "getRoles", "ross")
+	if len(roles) != 1 || roles[0] != roleCustomer {
+		t.Fatalf("roles of ross = %v", roles)
+	}
+
+	expectError(t, s.mustFail(t, "admin", "addCustomer"), "Expecting 1")
+	expectError(t, s.mustFail(t, "admin", "addCustomer", ""), "cannot be an empty string")
+	expectError(t, s.mustFail(t, "admin", "addCustomer", "ross"), "customer already exists")
+	expectError(t, s.mustFail(t, "admin", "addCustomer", "a~b"), "cannot contain '~'")
+	expectError(t, s.mustFail(t, "james", "addCustomer", "joey"), "requires role admin")
+}
+
+func TestAddCustomerFunds(t *testing.T) {
+	s := newMarket(t)
+
+	s.mustInvoke(t, "admin", "addCustomerFunds", "SAM", "250")
+	s.mustInvoke(t, "admin", "addCustomerFunds", "sam", "50")
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 300, "james": 10000})
+
+	expectError(t, s.mustFail(t, "admin", "addCustomerFunds", "sam"), "Expecting 2")
+	expectError(t, s.mustFail(t, "admin", "addCustomerFunds", "", "5"), "cannot be an empty string")
+	expectError(t, s.mustFail(t, "admin", "addCustomerFunds", "sam", ""), "cannot be an empty string")
+	expectError(t, s.mustFail(t, "admin", "addCustomerFunds", "sam", "lots"), "Second argument (amount to add) must be a decimal string")
+	expectError(t, s.mustFail(t, "admin", "addCustomerFunds", "sam", "-5"), "must be a decimal string greater than 0")
+	expectError(t, s.mustFail(t, "james", "addCustomerFunds", "james", "5"), "requires role admin")
+
+	expectError(t, s.mustFailWith(t, codeUnknownCustomer, "admin", "addCustomerFunds", "nobody", "5"), "Could not find customer nobody")
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 300, "james": 10000})
+}
+
+func TestAddCharger(t *testing.T) {
+	s := newMarket(t)
+
+	s.mustInvoke(t, "admin", "addCharger", "Charger2", "James")
+	var chargers map[string]Charger
+	s.query(t, &chargers, "getChargers")
+	if len(chargers) != 2 || chargers["charger2"].Owner != "james" || chargers["charger1"].Owner != "sam" {
+		t.Fatalf("chargers = %v", chargers)
+	}
+	var roles []string
+	s.query(t, &roles, "getRoles", "charger2")
+	if len(roles) != 1 || roles[0] != roleCharger {
+		t.Fatalf("roles of charger2 = %v", roles)
+	}
+	s.query(t, &roles, "getRoles", "james")
+	if len(roles) != 2 || roles[0] != roleCustomer || roles[1] != roleSeller {
+		t.Fatalf("roles of james = %v", roles)
+	}
+	expectInts(t, "offers", s.offers(t, "charger2"), map[string]int{})
+	if len(s.pending(t, "charger2")) != 0 {
+		t.Fatal("new charger has a pending transaction")
+	}
+
+	expectError(t, s.mustFail(t, "admin", "addCharger", "charger3"), "Expecting 2")
+	expectError(t, s.mustFail(t, "admin", "addCharger", "", "sam"), "cannot be an empty string")
+	expectError(t, s.mustFail(t, "admin", "addCharger", "charger1", "james"), "charger already exists")
+	expectError(t, s.mustFail(t, "admin", "addCharger", "charger3", "nobody"), "is not a customer")
+	expectError(t, s.mustFail(t, "admin", "addCharger", "c~3", "sam"), "cannot contain '~'")
+	expectError(t, s.mustFail(t, "sam", "addCharger", "charger3", "sam"), "requires role admin")
+}
+
+//////////////////////////////////////// OFFERS ////////////////////////////////////////
+
+func TestAddOfferQuantity(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "admin", "addCustomer", "alice")
+	s.mustInvoke(t, "admin", "addRole", "alice", "seller")
+
+	// The seller defaults to the owner of the charger
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "CHARGER1", "5", "20")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "7", "300", "sam")
+	s.mustInvoke(t, "alice", "addOfferQuantity", "charger1", "5", "50", "alice")
+	expectTiers(t, "tiers", s.offerTiers(t, "charger1"), map[string]map[string]int{
+		"5": {"sam": 120, "alice": 50},
+		"7": {"sam": 300},
+	})
+	expectInts(t, "offers", s.offers(t, "charger1"), map[string]int{"5": 170, "7": 300})
+	if _, ok := s.state[createCompositeKey(offerObjectType, "charger1", "5", "alice")]; !ok {
+		t.Fatal("alice's units are not under their own key")
+	}
+
+	expectError(t, s.mustFail(t, "sam", "addOfferQuantity", "charger1", "5"), "Expecting 3 or 4")
+	expectError(t, s.mustFail(t, "sam", "addOfferQuantity", "charger1", "five", "10"), "Second argument (offer ID) must be a decimal string")
+	expectError(t, s.mustFail(t, "sam", "addOfferQuantity", "charger1", "5", "ten"), "Third argument (quantity to add) must be a decimal string")
+	expectError(t, s.mustFail(t, "sam", "addOfferQuantity", "charger1", "-5", "10"), "Second argument (offer ID) must be a decimal string greater than 0")
+	expectError(t, s.mustFail(t, "sam", "addOfferQuantity", "charger9", "5", "10"), "Charger charger9 does not exist")
+	expectError(t, s.mustFail(t, "alice", "addOfferQuantity", "charger1", "5", "10"), "not allowed to call addOfferQuantity for sam")
+	expectError(t, s.mustFail(t, "james", "addOfferQuantity", "charger1", "5", "10", "james"), "requires role seller")
+	s.mustInvoke(t, "admin", "addRole", "nobody", "seller")
+	expectError(t, s.mustFail(t, "nobody", "addOfferQuantity", "charger1", "5", "10", "nobody"), "nobody is not a valid seller")
+}
+
+func TestSubtractOfferQuantity(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "6", "100")
+
+	expectError(t, s.mustInvoke(t, "sam", "subtractOfferQuantity", "charger1", "5", "30"), "Successfully subtracted 30 from offer 5")
+	expectInts(t, "offers", s.offers(t, "charger1"), map[string]int{"5": 70, "6": 100})
+
+	// Subtracting everything removes the tier
+	s.mustInvoke(t, "sam", "subtractOfferQuantity", "charger1", "6", "150", "sam")
+	expectInts(t, "offers", s.offers(t, "charger1"), map[string]int{"5": 70})
+
+	expectError(t, s.mustFail(t, "sam", "subtractOfferQuantity", "charger1", "6", "10"), "Offer ID 6 does not exist at charger charger1 for seller sam")
+	expectError(t, s.mustFail(t, "sam", "subtractOfferQuantity", "charger1", "5"), "Expecting 3 or 4")
+	expectError(t, s.mustFail(t, "sam", "subtractOfferQuantity", "charger9", "5", "10"), "Charger charger9 does not exist")
+	expectError(t, s.mustFail(t, "james", "subtractOfferQuantity", "charger1", "5", "10"), "requires role seller")
+	expectInts(t, "offers", s.offers(t, "charger1"), map[string]int{"5": 70})
+}
+
+func TestWriteErrorsAreReported(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+
+	s.failPut = offerObjectType + compositeKeySeparator
+	s.mustFailWith(t, codeStateError, "sam", "addOfferQuantity", "charger1", "5", "10")
+	s.mustFailWith(t, codeStateError, "sam", "subtractOfferQuantity", "charger1", "5", "10")
+	s.failPut = customerObjectType + compositeKeySeparator
+	s.mustFailWith(t, codeStateError, "admin", "addCustomer", "ross")
+	s.mustFailWith(t, codeStateError, "admin", "addCustomerFunds", "sam", "10")
+	s.failPut = ""
+
+	expectInts(t, "offers", s.offers(t, "charger1"), map[string]int{"5": 100})
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 0, "james": 10000})
+}
+
+//////////////////////////////////////// BUYING ////////////////////////////////////////
+
+func TestAcceptOfferFillsCheapestTiersFirst(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "7", "300")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "6", "200")
+
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "James", "350")
+
+	// 100 at 5, 200 at 6 and 50 at 7
+	expectInts(t, "offers", s.offers(t, "charger1"), map[string]int{"7": 250})
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 2050, "james": 7950})
+	pending := s.pending(t, "charger1")
+	if len(pending) != 1 {
+		t.Fatalf("pending = %v", pending)
+	}
+	pt := pending[0]
+	if pt.Buyer != "james" || pt.Charger != "charger1" || pt.Energy != wholeAmount(350) || pt.Cost != wholeAmount(2050) || pt.Status != "Pending" || pt.TXID != 0 {
+		t.Fatalf("pending transaction = %+v", pt)
+	}
+	if pt.Accepted != s.now || pt.Timeout != defaultPendingTimeout {
+		t.Fatalf("accepted %d with timeout %d, want %d and %d", pt.Accepted, pt.Timeout, s.now, defaultPendingTimeout)
+	}
+	expectInts(t, "pending offers", pt.Offers, map[string]int{"5": 100, "6": 200, "7": 50})
+	expectTiers(t, "pending sellers", pt.Sellers, map[string]map[string]int{"5": {"sam": 100}, "6": {"sam": 200}, "7": {"sam": 50}})
+
+	// Exactly one tier
+	s = newMarket(t)
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "6", "200")
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "100")
+	expectInts(t, "offers", s.offers(t, "charger1"), map[string]int{"6": 200})
+	expectInts(t, "pending offers", s.pending(t, "charger1")[0].Offers, map[string]int{"5": 100})
+}
+
+func TestAcceptOfferPaysEverySeller(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "admin", "addCustomer", "alice")
+	s.mustInvoke(t, "admin", "addRole", "alice", "seller")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+	s.mustInvoke(t, "alice", "addOfferQuantity", "charger1", "5", "50", "alice")
+	s.mustInvoke(t, "alice", "addOfferQuantity", "charger1", "6", "100", "alice")
+
+	// Sellers in a tier are taken in order of customer ID: alice before sam
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "120")
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 350, "alice": 250, "james": 9400})
+	expectTiers(t, "tiers", s.offerTiers(t, "charger1"), map[string]map[string]int{"5": {"sam": 30}, "6": {"alice": 100}})
+	expectTiers(t, "pending sellers", s.pending(t, "charger1")[0].Sellers, map[string]map[string]int{"5": {"alice": 50, "sam": 70}})
+}
+
+func TestAcceptOfferMaxPriceAndFillMode(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "6", "200")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "8", "200")
+
+	// Fill or kill is the default and only counts the tiers at or below the max price
+	expectError(t, s.mustFail(t, "james", "acceptOffer", "charger1", "james", "350", "6"), "Requested 350 with only 300 available at or below 6 per unit")
+	expectError(t, s.mustFail(t, "james", "acceptOffer", "charger1", "james", "350", "6", "fillorkill"), "only 300 available")
+
+	// A partial fill buys what there is
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "350", "6", "partial")
+	pt := s.pending(t, "charger1")[0]
+	if pt.Energy != wholeAmount(300) || pt.Cost != wholeAmount(1700) {
+		t.Fatalf("partial fill bought %s for %s, want 300 for 1700", pt.Energy, pt.Cost)
+	}
+	expectInts(t, "offers", s.offers(t, "charger1"), map[string]int{"8": 200})
+	s.mustInvoke(t, "charger1", "completeTransaction", "charger1")
+
+	// Nothing at or below the max price
+	expectError(t, s.mustFail(t, "james", "acceptOffer", "charger1", "james", "10", "7", "partial"), "only 0 available")
+
+	// The max price can be left empty to set the fill mode only
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "500", "", "partial")
+	if pt = s.pending(t, "charger1")[0]; pt.Energy != wholeAmount(200) || pt.Cost != wholeAmount(1600) {
+		t.Fatalf("partial fill bought %s for %s, want 200 for 1600", pt.Energy, pt.Cost)
+	}
+	s.mustInvoke(t, "charger1", "completeTransaction", "charger1")
+
+	expectError(t, s.mustFail(t, "james", "acceptOffer", "charger1", "james", "1", "0"), "Fourth argument (max price per unit) must be a decimal string greater than 0")
+	expectError(t, s.mustFail(t, "james", "acceptOffer", "charger1", "james", "1", "x"), "Fourth argument (max price per unit) must be a decimal string")
+	expectError(t, s.mustFail(t, "james", "acceptOffer", "charger1", "james", "1", "5", "some"), "Fifth argument (fill mode) must be")
+}
+
+func TestAcceptOfferValidation(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "admin", "addCustomer", "ross")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "6", "2000")
+
+	expectError(t, s.mustFail(t, "james", "acceptOffer", "charger1", "james"), "Expecting 3 to 6")
+	expectError(t, s.mustFail(t, "james", "acceptOffer", "charger1", "james", "1", "5", "partial", "key", "extra"), "Expecting 3 to 6")
+	expectError(t, s.mustFail(t, "james", "acceptOffer", "", "james", "1"), "First argument (charger ID) cannot be an empty string")
+	expectError(t, s.mustFail(t, "james", "acceptOffer", "charger1", "james", ""), "Third argument (units of energy to buy) cannot be an empty string")
+	expectError(t, s.mustFail(t, "james", "acceptOffer", "charger1", "james", "lots"), "Third argument (units of energy to buy) must be a decimal string")
+	expectError(t, s.mustFail(t, "james", "acceptOffer", "charger1", "james", "0"), "must be a decimal string greater than 0")
+	expectError(t, s.mustFail(t, "james", "acceptOffer", "charger9", "james", "1"), "Charger charger9 does not exist")
+	expectError(t, s.mustFail(t, "james", "acceptOffer", "charger1", "james", "2101"), "Requested 2101 with only 2100 available")
+	expectError(t, s.mustFail(t, "ross", "acceptOffer", "charger1", "ross", "1"), "Buyer does not have enough funds: total cost = 5, available funds = 0")
+	expectError(t, s.mustFail(t, "james", "acceptOffer", "charger1", "james", "2000"), "Buyer does not have enough funds: total cost = 11900, available funds = 10000")
+	expectError(t, s.mustFail(t, "james", "acceptOffer", "charger1", "ross", "1"), "not allowed to call acceptOffer for ross")
+	expectError(t, s.mustFail(t, "charger1", "acceptOffer", "charger1", "charger1", "1"), "requires role customer")
+
+	// Only one pending transaction per charger
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "1")
+	s.mustInvoke(t, "admin", "addCustomerFunds", "ross", "100")
+	expectError(t, s.mustFail(t, "ross", "acceptOffer", "charger1", "ross", "1"), "There is already a pending transaction at charger charger1")
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 5, "james": 9995, "ross": 100})
+	expectInts(t, "offers", s.offers(t, "charger1"), map[string]int{"5": 99, "6": 2000})
+}
+
+func TestCompleteTransaction(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "40")
+
+	expectError(t, s.mustFail(t, "james", "completeTransaction", "charger1"), "requires role charger")
+	s.mustInvoke(t, "admin", "addCharger", "charger2", "sam")
+	expectError(t, s.mustFail(t, "charger2", "completeTransaction", "charger1"), "not allowed to call completeTransaction for charger1")
+	expectError(t, s.mustFail(t, "charger2", "completeTransaction", "charger2"), "No pending transaction to be completed at charger charger2")
+	expectError(t, s.mustFail(t, "charger1", "completeTransaction"), "Expecting 1")
+
+	s.mustInvoke(t, "charger1", "completeTransaction", "charger1")
+	if len(s.pending(t, "charger1")) != 0 {
+		t.Fatal("pending transaction was not cleared")
+	}
+	transactions := s.transactions(t)
+	if len(transactions) != 1 {
+		t.Fatalf("transactions = %v", transactions)
+	}
+	tx := transactions[0]
+	if tx.TXID != 1 || tx.Timestamp != s.now || tx.Status != "Completed" || tx.Energy != wholeAmount(40) || tx.Cost != wholeAmount(200) || tx.Buyer != "james" {
+		t.Fatalf("completed transaction = %+v", tx)
+	}
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 200, "james": 9800})
+
+	// TXIDs count up
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "10")
+	s.mustInvoke(t, "charger1", "completeTransaction", "charger1")
+	if tx = s.transactions(t)[1]; tx.TXID != 2 {
+		t.Fatalf("second TXID = %d", tx.TXID)
+	}
+	var lastTXID []byte
+	s.query(t, &lastTXID, "read", lastTXIDKey)
+	if string(lastTXID) != "2" {
+		t.Fatalf("%s = %q", lastTXIDKey, lastTXID)
+	}
+}
+
+func TestCancelTransactionRefundsMostExpensiveFirst(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "2", "100")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "4", "50")
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "150")
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 400, "james": 9600})
+
+	// 50 units at 4 and 25 units at 2
+	s.mustInvoke(t, "charger1", "cancelTransaction", "charger1", "75")
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 150, "james": 9850})
+	expectInts(t, "offers", s.offers(t, "charger1"), map[string]int{"2": 25, "4": 50})
+	if len(s.pending(t, "charger1")) != 0 {
+		t.Fatal("pending transaction was not cleared")
+	}
+	tx := s.transactions(t)[0]
+	if tx.TXID != 1 || tx.Timestamp != s.now || tx.Status != "Refunded 75" || tx.Energy != wholeAmount(75) || tx.Cost != wholeAmount(150) {
+		t.Fatalf("refunded transaction = %+v", tx)
+	}
+	expectInts(t, "refunded offers", tx.Offers, map[string]int{"2": 75})
+	expectTiers(t, "refunded sellers", tx.Sellers, map[string]map[string]int{"2": {"sam": 75}})
+
+	// Part of the most expensive tier only
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "75")
+	s.mustInvoke(t, "charger1", "cancelTransaction", "charger1", "20")
+	expectInts(t, "offers", s.offers(t, "charger1"), map[string]int{"4": 20})
+	expectInts(t, "refunded offers", s.transactions(t)[1].Offers, map[string]int{"2": 25, "4": 30})
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 320, "james": 9680})
+
+	// Everything
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "20")
+	s.mustInvoke(t, "charger1", "cancelTransaction", "charger1", "20")
+	if tx = s.transactions(t)[2]; tx.Energy != 0 || tx.Cost != 0 || len(tx.Offers) != 0 {
+		t.Fatalf("fully refunded transaction = %+v", tx)
+	}
+	expectInts(t, "offers", s.offers(t, "charger1"), map[string]int{"4": 20})
+}
+
+func TestCancelTransactionClawsBackFromSellers(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "admin", "addCustomer", "alice")
+	s.mustInvoke(t, "admin", "addRole", "alice", "seller")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+	s.mustInvoke(t, "alice", "addOfferQuantity", "charger1", "5", "50", "alice")
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "120")
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 350, "alice": 250, "james": 9400})
+
+	// Units go back in reverse order of seller ID: sam before alice
+	s.mustInvoke(t, "charger1", "cancelTransaction", "charger1", "90")
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 0, "alice": 150, "james": 9850})
+	expectTiers(t, "tiers", s.offerTiers(t, "charger1"), map[string]map[string]int{"5": {"sam": 100, "alice": 20}})
+	expectTiers(t, "refunded sellers", s.transactions(t)[0].Sellers, map[string]map[string]int{"5": {"alice": 30}})
+}
+
+func TestCancelTransactionRefusesWhenSellerSpentPayment(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "100")
+
+	// sam spends the payment at james' charger
+	s.mustInvoke(t, "admin", "addCharger", "charger2", "james")
+	s.mustInvoke(t, "james", "addOfferQuantity", "charger2", "10", "100")
+	s.mustInvoke(t, "sam", "acceptOffer", "charger2", "sam", "45")
+
+	expectError(t, s.mustFail(t, "charger1", "cancelTransaction", "charger1", "60"), "Seller sam does not have enough funds to refund 300, available funds = 50")
+	s.mustInvoke(t, "charger1", "cancelTransaction", "charger1", "10")
+	expectInts(t, "customers", s.customers(t), map[string]int{"sam": 0, "james": 10000 - 500 + 450 + 50})
+}
+
+func TestCancelTransactionValidation(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+
+	expectError(t, s.mustFail(t, "charger1", "cancelTransaction", "charger1", "10"), "No pending transactions to be completed at charger charger1")
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "40")
+
+	expectError(t, s.mustFail(t, "charger1", "cancelTransaction", "charger1"), "Expecting 2")
+	expectError(t, s.mustFail(t, "charger1", "cancelTransaction", "charger1", ""), "Second argument (units to refund) cannot be an empty string")
+	expectError(t, s.mustFail(t, "charger1", "cancelTransaction", "charger1", "ten"), "Second argument (units to refund) must be a decimal string")
+	expectError(t, s.mustFail(t, "charger1", "cancelTransaction", "charger1", "0"), "must be a decimal string greater than 0")
+	expectError(t, s.mustFail(t, "charger1", "cancelTransaction", "charger1", "41"), "Cannot refund 41 units, there are only 40 in the current transaction")
+	expectError(t, s.mustFail(t, "james", "cancelTransaction", "charger1", "10"), "requires role charger")
+	expectError(t, s.mustFail(t, "admin", "cancelTransaction", "charger1", "10"), "requires role charger")
+	if len(s.pending(t, "charger1")) != 1 {
+		t.Fatal("failed cancellations changed the pending transaction")
+	}
+}
+
+func TestAddTransaction(t *testing.T) {
+	s := newMarket(t)
+
+	// The buyer is lowercased like every customer ID
+	s.mustInvoke(t, "admin", "addTransaction", "2", "1490249345", "James", "150", "800", "5", "100", "6", "50")
+	var injected []Transaction
+	s.query(t, &injected, "getTransactions", "", "", "", "", "", "", "", "", "only")
+	tx := injected[0]
+	if tx.TXID != 1 || tx.Timestamp != 1490249345 || tx.Buyer != "james" || tx.Energy != wholeAmount(150) || tx.Cost != wholeAmount(800) {
+		t.Fatalf("injected transaction = %+v", tx)
+	}
+	if tx.Source != sourceAddTransaction || tx.InjectedBy != "admin" {
+		t.Fatalf("injected transaction is flagged as %q by %q", tx.Source, tx.InjectedBy)
+	}
+	expectInts(t, "injected offers", tx.Offers, map[string]int{"5": 100, "6": 50})
+	if n := len(s.transactions(t)); n != 0 {
+		t.Fatalf("%d real transactions, want 0", n)
+	}
+
+	// The form without a version took the TXID first, it is rejected rather than taken as a timestamp
+	expectError(t, s.mustFail(t, "admin", "addTransaction", "1490249345", "james", "150", "800", "5", "100"), "Expecting 5 followed by one or more groups of 2")
+	expectError(t, s.mustFail(t, "admin", "addTransaction", "1", "1490249345", "james", "150", "800", "5", "100"), "First argument (argument version) must be one of \"2\"")
+	expectError(t, s.mustFail(t, "admin", "addTransaction", "2", "1", "james", "1", "1", "1"), "Expecting 5 followed by one or more groups of 2")
+	expectError(t, s.mustFail(t, "admin", "addTransaction", "2", "x", "james", "1", "1", "1", "1"), "Second argument (timestamp) must be an integer string")
+	expectError(t, s.mustFail(t, "admin", "addTransaction", "2", "1", "james", "x", "1", "1", "1"), "Fourth argument (units of energy) must be a decimal string")
+	expectError(t, s.mustFail(t, "admin", "addTransaction", "2", "1", "james", "1", "x", "1", "1"), "Fifth argument (cost) must be a decimal string")
+	expectError(t, s.mustFail(t, "admin", "addTransaction", "2", "1", "james", "1", "1", "1", "x"), "Seventh argument (units bought at the price tier) must be a decimal string")
+	expectError(t, s.mustFail(t, "charger1", "addTransaction", "2", "1", "james", "1", "1", "1", "1"), "requires role admin")
+	s.query(t, &injected, "getTransactions", `{"synthetic": "only"}`)
+	if len(injected) != 1 {
+		t.Fatalf("%d injected transactions, want 1", len(injected))
+	}
+}
+
+//////////////////////////////////////// QUERIES ////////////////////////////////////////
+
+func TestRead(t *testing.T) {
+	s := newMarket(t)
+
+	var value []byte
+	s.query(t, &value, "read", "ece")
+	if string(value) != "1" {
+		t.Fatalf("ece = %q", value)
+	}
+	s.query(t, &value, "read", createCompositeKey(customerObjectType, "james"))
+	if string(value) != "10000" {
+		t.Fatalf("balance of james = %q", value)
+	}
+
+	expectError(t, s.queryFails(t, "read"), "Expecting 1")
+	expectError(t, s.queryFails(t, "read", ""), "cannot be an empty string")
+	expectError(t, s.queryFails(t, "read", "nothing"), "Variable \"nothing\" does not exist")
+}
+
+func TestGetPendingTransaction(t *testing.T) {
+	s := newMarket(t)
+	if len(s.pending(t, "charger1")) != 0 {
+		t.Fatal("unexpected pending transaction")
+	}
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+	s.mustInvoke(t, "james", "acceptOffer", "charger1", "james", "10")
+	if pending := s.pending(t, "Charger1"); len(pending) != 1 || pending[0].Energy != wholeAmount(10) {
+		t.Fatalf("pending = %v", pending)
+	}
+
+	expectError(t, s.queryFails(t, "getPendingTransaction"), "Expecting 1")
+	expectError(t, s.queryFails(t, "getPendingTransaction", ""), "cannot be an empty string")
+	expectError(t, s.queryFails(t, "getPendingTransaction", "charger9"), "Charger charger9 does not exist")
+}
+
+func TestGetOffers(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "admin", "addCharger", "charger2", "james")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+	s.mustInvoke(t, "james", "addOfferQuantity", "charger2", "9", "10")
+
+	// Every charger has its own tiers
+	expectInts(t, "offers of charger1", s.offers(t, "charger1"), map[string]int{"5": 100})
+	expectInts(t, "offers of charger2", s.offers(t, "charger2"), map[string]int{"9": 10})
+	expectTiers(t, "tiers of charger2", s.offerTiers(t, "charger2"), map[string]map[string]int{"9": {"james": 10}})
+
+	for _, function := range []string{"getOffers", "getOfferTiers"} {
+		expectError(t, s.queryFails(t, function), "Expecting 1")
+		expectError(t, s.queryFails(t, function, ""), "cannot be an empty string")
+		expectError(t, s.queryFails(t, function, "charger9"), "Charger charger9 does not exist")
+	}
+}
+
+func TestGetTotalEnergyForSale(t *testing.T) {
+	s := newMarket(t)
+	var total int
+	s.query(t, &total, "getTotalEnergyForSale", "charger1")
+	if total != 0 {
+		t.Fatalf("total = %d", total)
+	}
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "100")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "6", "250")
+	s.query(t, &total, "getTotalEnergyForSale", "charger1")
+	if total != 350 {
+		t.Fatalf("total = %d", total)
+	}
+
+	expectError(t, s.queryFails(t, "getTotalEnergyForSale"), "Expecting 1")
+	expectError(t, s.queryFails(t, "getTotalEnergyForSale", "charger9"), "Charger charger9 does not exist")
+}
+
+func TestGetCustomer(t *testing.T) {
+	s := newMarket(t)
+	var balance int
+	s.query(t, &balance, "getCustomer", "JAMES")
+	if balance != 10000 {
+		t.Fatalf("balance = %d", balance)
+	}
+	expectError(t, s.queryFails(t, "getCustomer"), "Expecting 1")
+	expectError(t, s.queryFails(t, "getCustomer", ""), "cannot be an empty string")
+	expectError(t, s.queryFails(t, "getCustomer", "nobody"), "Failed to find customer with ID nobody")
+}
+
+func TestGetTransactionsPaging(t *testing.T) {
+	s := newMarket(t)
+	s.mustInvoke(t, "admin", "addCustomer", "ross")
+	s.mustInvoke(t, "admin", "addCustomerFunds", "ross", "10000")
+	s.mustInvoke(t, "sam", "addOfferQuantity", "charger1", "5", "1000")
+	for i := 0; i < 5; i++ {
+		buyer := "james"
+		if i % 2 == 1 {
+			buyer = "ross"
+		}
+		s.mustInvoke(t, buyer, "acceptOffer", "charger1", buyer, "10")
+		if i == 4 {
+			s.mustInvoke(t, "charger1", "cancelTransaction", "charger1", "5")
+		} else {
+			s.mustInvoke(t, "charger1", "completeTransaction", "charger1")
+		}
+	}
+	all := s.transactions(t)
+	if len(all) != 5 {
+		t.Fatalf("%d transactions, want 5", len(all))
+	}
+
+	var page QueryResponseTransactionsPage
+	getPage := func(args ...string) {
+		page = QueryResponseTransactionsPage{}
+		retBytes, _ := testChaincode.Query(s, "getTransactions", args)
+		json.Unmarshal(retBytes, &page)
+		if !page.Success {
+			t.Fatalf("getTransactions %v failed: %s", args, retBytes)
+		}
+	}
+	txids := func() string {
+		ids := []string{}
+		for _, tx := range page.Data {
+			ids = append(ids, strconv.FormatInt(tx.TXID, 10))
+		}
+		return strings.Join(ids, ",")
+	}
+
+	getPage("2")
+	if txids() != "1,2" || page.Bookmark == "" {
+		t.Fatalf("first page %s, bookmark %q", txids(), page.Bookmark)
+	}
+	getPage("2", page.Bookmark)
+	if txids() != "3,4" || page.Bookmark == "" {
+		t.Fatalf("second page %s, bookmark %q", txids(), page.Bookmark)
+	}
+	getPage("2", page.Bookmark)
+	if txids() != "5" || page.Bookmark != "" {
+		t.Fatalf("last page %s, bookmark %q", txids(), page.Bookmark)
+	}
+
+	getPage("", "", "ross")
+	if txids() != "2,4" {
+		t.Fatalf("ross' transactions %s", txids())
+	}
+	getPage("", "", "", "Refunded")
+	if txids() != "5" {
+		t.Fatalf("refunded transactions %s", txids())
+	}
+	getPage("", "", "", "", "2", "3")
+	if txids() != "2,3" {
+		t.Fatalf("TXIDs 2 to 3: %s", txids())
+	}
+	getPage("", "", "", "", "", "", strconv.FormatInt(all[1].Timestamp, 10), strconv.FormatInt(all[3].Timestamp, 10))
+	if txids() != "2,3,4" {
+		t.Fatalf("timestamps of 2 to 4: %s", txids())
+	}
+
+	expectError(t, s.queryFails(t, "getTransactions", "0"), "must be between 1 and 100")
+	expectError(t, s.queryFails(t, "getTransactions", "x"), "First argument (page size) must be an integer string")
+	expectError(t, s.queryFails(t, "getTransactions", "", "nope"), "is not a valid bookmark")
+	expectError(t, s.queryFails(t, "getTransactions", "", "", "", "", "x"), "Fifth argument (first TXID)")
+	expectError(t, s.queryFails(t, "getTransactions", "1", "2", "3", "4", "5", "6", "7", "8", "include", "10"), "Expecting up to 9")
+}
+
+//////////////////////////////////////// MIGRATION ////////////////////////////////////////
+
+func TestMigrateState(t *testing.T) {
+	// State written by an earlier version, then the new version is deployed on top of it
+	s := newMockStub()
+	s.state[legacyCustomersKey] = []byte(`{"ross":100,"owner":50}`)
+	s.state[legacyChargersKey] = []byte(`{"c9":{"id":"c9","owner":"ross"}}`)
+	s.state[legacyOffersKey + "_c9"] = []byte(`{"5":10,"6":20}`)
+	s.state[legacyPendingTransactionKey + "_c9"] = []byte(`[{"txid":0,"offers":{"5":1},"buyer":"ross","cost":5,"energy":1,"status":"Pending"}]`)
+	s.state[legacyTransactionsKey] = []byte(`[{"txid":1490249345,"offers":{"5":2},"buyer":"ross","cost":10,"energy":2,"status":"Completed"},{"txid":1490249350,"offers":{"5":2},"buyer":"demo","cost":10,"energy":2}]`)
+	s.state[legacyOffersKey] = []byte(`{"3":7}`)
+	s.caller = "admin"
+	testChaincode.Init(s, "init", []string{"1"})
+
+	// Offers from before chargers existed need a charger ID
+	expectError(t, s.mustFail(t, "admin", "migrateState"), "a charger ID is needed")
+	expectError(t, s.mustFail(t, "ross", "migrateState", "c0"), "requires role admin")
+	s.mustInvoke(t, "admin", "migrateState", "c0")
+
+	expectInts(t, "customers", s.customers(t), map[string]int{"ross": 100, "owner": 50})
+	expectTiers(t, "tiers of c9", s.offerTiers(t, "c9"), map[string]map[string]int{"5": {"ross": 10}, "6": {"ross": 20}})
+	expectTiers(t, "tiers of c0", s.offerTiers(t, "c0"), map[string]map[string]int{"3": {"owner": 7}})
+	// Its timeout starts with the migration
+	if pending := s.pending(t, "c9"); len(pending) != 1 || pending[0].Charger != "c9" || pending[0].Accepted != s.now || pending[0].Timeout != defaultPendingTimeout {
+		t.Fatalf("pending of c9 = %v", pending)
+	}
+	// Supply is recorded with the unit the pending transaction took from the owner
+	if supply := s.supply(t, "c9"); len(supply) != 2 || len(s.supply(t, "c0")) != 1 {
+		t.Fatalf("supply of c9 = %+v", supply)
+	}
+	expectMovement(t, s.supply(t, "c9")[0], "5", "ross", supplyMigrated, 11, 10)
+	expectMovement(t, s.supply(t, "c0")[0], "3", "owner", supplyMigrated, 7, 7)
+	tx := s.transactions(t)[0]
+	if tx.TXID != 1490249345 || tx.Timestamp != 1490249345 || len(s.transactions(t)) != 1 {
+		t.Fatalf("migrated transactions = %+v", s.transactions(t))
+	}
+	// What the old addTransaction injected is kept apart
+	var injected []Transaction
+	s.query(t, &injected, "getTransactions", `{"synthetic": "only"}`)
+	if len(injected) != 1 || injected[0].TXID != 1490249350 || injected[0].Source != sourceAddTransaction {
+		t.Fatalf("migrated injected transactions = %+v", injected)
+	}
+	for _, key := range []string{legacyCustomersKey, legacyChargersKey, legacyOffersKey, legacyOffersKey + "_c9", legacyPendingTransactionKey + "_c9", legacyTransactionsKey} {
+		if _, ok := s.state[key]; ok {
+			t.Fatalf("%s was not removed", key)
+		}
+	}
+
+	// New TXIDs continue after the migrated ones
+	s.invokeData(t, &tx, "admin", "addTransaction", "2", "1", "ross", "1", "1", "1", "1")
+	if tx.TXID != 1490249351 {
+		t.Fatalf("TXID after migration = %d", tx.TXID)
+	}
+
+	expectError(t, s.mustFail(t, "admin", "migrateState"), "No legacy chaincode state to migrate")
+	expectError(t, s.mustFail(t, "admin", "migrateState", "a", "b"), "Expecting 0 or 1")
+}
+
+func TestInitWipesLegacyState(t *testing.T) {
+	s := newMarket(t)
+	s.state[legacyCustomersKey] = []byte(`{"ross":100}`)
+	s.state[legacyChargersKey] = []byte(`{"c9":{"id":"c9","owner":"ross"}}`)
+	s.state[legacyOffersKey + "_c9"] = []byte(`{"5":10}`)
+	s.state[legacyPendingTransactionKey + "_c9"] = []byte(`[{"txid":0,"offers":{"5":1},"buyer":"ross","cost":5,"energy":1,"status":"Pending"}]`)
+	s.state[legacyTransactionsKey] = []byte(`[{"txid":1490249345,"offers":{"5":2},"buyer":"ross","cost":10,"energy":2,"status":"Completed"}]`)
+
+	// Resetting an initialized chaincode doesn't leave anything for migrateState to bring back
+	s.mustInvoke(t, "admin", "init", "1")
+	for _, key := range []string{legacyCustomersKey, legacyChargersKey, legacyOffersKey + "_c9", legacyPendingTransactionKey + "_c9", legacyTransactionsKey} {
+		if _, ok := s.state[key]; ok {
+			t.Fatalf("%s was not removed", key)
+		}
+	}
+	expectError(t, s.mustFail(t, "admin", "migrateState"), "No legacy chaincode state to migrate")
+	if n := len(s.customers(t)); n != 0 {
+		t.Fatalf("%d customers after init, want 0", n)
+	}
+}
+
+func TestMigrateStateMovesOffersToSellers(t *testing.T) {
+	s := newMarket(t)
+	s.state[createCompositeKey(offerObjectType, "charger1", "5")] = []byte("100")
+
+	s.mustInvoke(t, "admin", "migrateState")
+	expectTiers(t, "tiers", s.offerTiers(t, "charger1"), map[string]map[string]int{"5": {"sam": 100}})
+	if _, ok := s.state[createCompositeKey(offerObjectType, "charger1", "5")]; ok {
+		t.Fatal("offer key without a seller was not removed")
+	}
+}